@@ -1,16 +1,63 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 
 	"github.com/dikuropiatnyk/dh-chat/internal/client/types"
+	"github.com/dikuropiatnyk/dh-chat/internal/logging"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
 )
 
 func main() {
-	user := types.DHClient{}
+	logConfig := logging.RegisterFlags(flag.CommandLine)
+	config := types.DefaultConfig()
+	flag.StringVar(&config.ServerAddress, "server", config.ServerAddress, "address of the server, e.g. localhost:8080, unix:///run/dh.sock, tls://host:8443 or wss://host/ws")
+	flag.BoolVar(&config.WaitForPeer, "wait-for-peer", config.WaitForPeer, "wait for the interlocutor to return, instead of ending the chat")
+	flag.BoolVar(&config.Reconnect, "reconnect", config.Reconnect, "resume the chat on a new connection, when the current one is lost")
+	flag.StringVar(&config.IdentityPath, "identity", config.IdentityPath, "file of the identity key, generated on the first use")
+	flag.BoolVar(&config.Visible, "visible", config.Visible, "show the presence to the contacts, while waiting in the lobby")
+	flag.BoolVar(&config.Multiplex, "multiplex", config.Multiplex, "chat with many interlocutors at once over one connection")
+	flag.StringVar(&config.ListenAddress, "listen", config.ListenAddress, "chat directly without the server, waiting for the peer on the address, e.g. :9090")
+	flag.StringVar(&config.PeerAddress, "peer", config.PeerAddress, "chat directly without the server, connecting to the peer on the address, e.g. 192.168.1.7:9090")
+	flag.BoolVar(&config.Discoverable, "discoverable", config.Discoverable, "announce the name and the identity fingerprint on the local network")
+	flag.BoolVar(&config.Discover, "discover", config.Discover, "pick the interlocutor among the peers announced on the local network")
+	flag.BoolVar(&config.Typing, "typing", config.Typing, "tell the interlocutor, while the message is typed")
+	tlsCA := flag.String("tls-ca", "", "PEM file of the authority, which signed the certificate of the tls:// server, the system roots if empty")
+	flag.Parse()
+	logger, logSink, err := logConfig.Logger()
+	if err != nil {
+		log.Fatalln("Logger configuration error:", err)
+	}
+	defer logSink.Close()
+
+	if *tlsCA != "" {
+		tlsTransport, err := transport.NewClientTLS(*tlsCA)
+		if err != nil {
+			logger.Error("TLS authority loading error", "error", err)
+			os.Exit(1)
+		}
+		transport.Register("tls", tlsTransport)
+	}
+
+	user := types.NewDHClient(config, logger)
+	switch {
+	case config.ListenAddress != "" && config.PeerAddress != "",
+		config.Discover && (config.ListenAddress != "" || config.PeerAddress != ""):
+		logger.Error("Either -listen, -peer or -discover is expected, not several of them")
+		os.Exit(1)
+	case config.Discover:
+		user.InteractDiscovered()
+		return
+	case config.ListenAddress != "" || config.PeerAddress != "":
+		user.InteractDirect()
+		return
+	}
 	connection, err := user.Connect()
 	if err != nil {
-		log.Fatalln("Couldn't connect to the server:", err)
+		logger.Error("Couldn't connect to the server", "error", err)
+		os.Exit(1)
 	}
 	user.Interact(connection)
 }
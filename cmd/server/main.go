@@ -1,8 +1,213 @@
 package main
 
-import "github.com/dikuropiatnyk/dh-chat/internal/server/types"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/internal/logging"
+	"github.com/dikuropiatnyk/dh-chat/internal/server/types"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
 
 func main() {
-	server := types.NewDHServer()
-	server.Start()
+	logConfig := logging.RegisterFlags(flag.CommandLine)
+	address := flag.String("address", constants.SERVER_ADDRESS, "address of the server, e.g. localhost:8080, unix:///run/dh.sock or tls://:8443")
+	tlsCert := flag.String("tls-cert", "", "certificate of the tls:// listener")
+	tlsKey := flag.String("tls-key", "", "key of the certificate of the tls:// listener")
+	metricsAddress := flag.String("metrics-address", "", "address of the Prometheus metrics endpoint, disabled if empty")
+	webSocketAddress := flag.String("ws-address", "", "address of the WebSocket listener, disabled if empty")
+	adminAddress := flag.String("admin-address", "", "loopback address of the admin API, disabled if empty")
+	limits := types.DefaultLimits()
+	flag.IntVar(&limits.MaxConnections, "max-connections", limits.MaxConnections, "maximum number of simultaneous connections, 0 to disable")
+	flag.IntVar(&limits.MaxConnectionsPerIP, "max-connections-per-ip", limits.MaxConnectionsPerIP, "maximum number of simultaneous connections from a single IP, 0 to disable")
+	flag.Float64Var(&limits.HandshakeRate, "handshake-rate", limits.HandshakeRate, "logins per second from a single IP, 0 to disable")
+	flag.IntVar(&limits.HandshakeBurst, "handshake-burst", limits.HandshakeBurst, "burst of logins from a single IP")
+	flag.Float64Var(&limits.MessageRate, "message-rate", limits.MessageRate, "relayed messages per second of a single connection, 0 to disable")
+	flag.IntVar(&limits.MessageBurst, "message-burst", limits.MessageBurst, "burst of relayed messages of a single connection")
+	flag.Float64Var(&limits.ControlRate, "control-rate", limits.ControlRate, "relayed receipts and typing signals per second of a single connection, 0 to disable")
+	flag.IntVar(&limits.ControlBurst, "control-burst", limits.ControlBurst, "burst of relayed receipts and typing signals of a single connection")
+	timeouts := communication.Timeouts{}
+	flag.DurationVar(&timeouts.Handshake, "handshake-timeout", constants.HANDSHAKE_TIMEOUT*time.Second, "read deadline until the chat is established, 0 to disable")
+	flag.DurationVar(&timeouts.Idle, "idle-timeout", constants.IDLE_TIMEOUT*time.Second, "read deadline of the established chat, 0 to disable")
+	flag.DurationVar(&timeouts.Write, "write-timeout", constants.WRITE_TIMEOUT*time.Second, "deadline of every write, 0 to disable")
+	accountsFile := flag.String("accounts-file", "", "JSON file of the registered accounts, kept in memory if empty")
+	closedRegistration := flag.Bool("closed-registration", false, "refuse the unknown names, instead of registering them on the first login")
+	contactsFile := flag.String("contacts-file", "", "JSON file of the contacts, kept in memory if empty")
+	federationName := flag.String("federation-name", "", "name of the server in the addresses name@server of its clients, federation is disabled if empty")
+	federationAddress := flag.String("federation-address", "", "address of the listener of the federated servers' links, e.g. :9443")
+	federationPeers := flag.String("federation-peers", "", "comma-separated federated servers, e.g. berlin=berlin.example.com:9443,kyiv=kyiv.example.com:9443")
+	federationCert := flag.String("federation-cert", "", "certificate of the server for the federated links")
+	federationKey := flag.String("federation-key", "", "key of the certificate for the federated links")
+	federationCA := flag.String("federation-ca", "", "PEM file of the authority, which signed the certificates of the federated servers")
+	brokerListen := flag.String("broker-listen", "", "address to share the pairing, the accounts and the contacts of this instance with the others, e.g. unix:///run/dh-broker.sock")
+	brokerAddress := flag.String("broker", "", "address of the pairing, the accounts and the contacts shared by another instance, they are in-process if empty")
+	heartbeatInterval := flag.Duration("heartbeat-interval", constants.HEARTBEAT_INTERVAL*time.Second, "interval of the pings to the clients")
+	flag.Parse()
+	logger, logSink, err := logConfig.Logger()
+	if err != nil {
+		log.Fatalln("Logger configuration error:", err)
+	}
+	defer logSink.Close()
+
+	// Stop the server gracefully on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *tlsCert != "" {
+		tlsTransport, err := transport.NewServerTLS(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Error("TLS certificate loading error", "error", err)
+			os.Exit(1)
+		}
+		transport.Register("tls", tlsTransport)
+	}
+
+	// The instances, which use the shared broker, keep no accounts and contacts
+	// of their own, so their files go with -broker-listen only
+	if *brokerAddress != "" && (*accountsFile != "" || *contactsFile != "") {
+		logger.Error("The accounts and the contacts are kept by the instance with -broker-listen, not -broker")
+		os.Exit(1)
+	}
+
+	accounts := types.NewMemoryAccounts()
+	if *accountsFile != "" {
+		if accounts, err = types.NewFileAccounts(*accountsFile); err != nil {
+			logger.Error("Accounts loading error", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	contacts := types.NewMemoryContacts()
+	if *contactsFile != "" {
+		if contacts, err = types.NewFileContacts(*contactsFile); err != nil {
+			logger.Error("Contacts loading error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *brokerAddress != "" {
+		accounts = types.NewRemoteAccounts(*brokerAddress)
+		contacts = types.NewRemoteContacts(*brokerAddress)
+	}
+
+	options := []types.Option{
+		types.WithAddress(*address),
+		types.WithLogger(logger),
+		types.WithAccounts(accounts),
+		types.WithOpenRegistration(!*closedRegistration),
+		types.WithContacts(contacts),
+		types.WithLimits(limits),
+		types.WithTimeouts(timeouts),
+		types.WithHeartbeatInterval(*heartbeatInterval),
+	}
+	if *federationName != "" {
+		federation, err := parseFederation(*federationName, *federationAddress, *federationPeers)
+		if err != nil {
+			logger.Error("Federation configuration error", "error", err)
+			os.Exit(1)
+		}
+		if federation.TLS, err = transport.NewMutualTLS(*federationCert, *federationKey, *federationCA); err != nil {
+			logger.Error("Federation certificate loading error", "error", err)
+			os.Exit(1)
+		}
+		options = append(options, types.WithFederation(federation))
+	}
+	switch {
+	case *brokerListen != "" && *brokerAddress != "":
+		logger.Error("Either -broker-listen or -broker is expected, not both")
+		os.Exit(1)
+	case *brokerListen != "":
+		broker := types.NewMemoryBroker()
+		brokerListener, err := types.ListenBroker(*brokerListen)
+		if err != nil {
+			logger.Error("Broker listener error", "error", err)
+			os.Exit(1)
+		}
+		defer brokerListener.Close()
+		go func() {
+			logger.Info("Broker is shared", "address", brokerListener.Addr().String())
+			if err := types.ServeBroker(brokerListener, broker, accounts, contacts, logger); err != nil {
+				logger.Error("Broker listener error", "error", err)
+			}
+		}()
+		options = append(options, types.WithBroker(broker))
+	case *brokerAddress != "":
+		options = append(options, types.WithBroker(types.NewRemoteBroker(*brokerAddress)))
+	}
+	server := types.NewDHServer(options...)
+
+	if *metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.MetricsHandler())
+		metricsServer := &http.Server{Addr: *metricsAddress, Handler: mux}
+		go func() {
+			logger.Info("Metrics endpoint is starting", "address", *metricsAddress)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Metrics endpoint error", "error", err)
+			}
+		}()
+		defer metricsServer.Close()
+	}
+
+	if *adminAddress != "" {
+		adminListener, err := types.ListenAdmin(*adminAddress)
+		if err != nil {
+			logger.Error("Admin API error", "error", err)
+			os.Exit(1)
+		}
+		adminServer := &http.Server{Handler: server.AdminHandler()}
+		go func() {
+			logger.Info("Admin API is starting", "address", adminListener.Addr().String())
+			if err := adminServer.Serve(adminListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Admin API error", "error", err)
+			}
+		}()
+		defer adminServer.Close()
+	}
+
+	if *webSocketAddress != "" {
+		// The WebSocket clients are served by the same server, via the ws:// transport
+		webSocketListener, err := transport.Listen("ws://" + *webSocketAddress + constants.WEBSOCKET_PATH)
+		if err != nil {
+			logger.Error("WebSocket listener error", "error", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := server.ServeListener(webSocketListener); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("WebSocket listener error", "error", err)
+			}
+		}()
+	}
+
+	if err := server.ListenAndServe(ctx); err != nil {
+		logger.Error("Server error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Parses the federated servers in the format "name=address,name=address"
+func parseFederation(name string, address string, peers string) (types.Federation, error) {
+	federation := types.Federation{Name: name, Address: address, Peers: make(map[string]string)}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer == "" {
+			continue
+		}
+		peerName, peerAddress, ok := strings.Cut(peer, "=")
+		if !ok || peerName == "" || peerAddress == "" || peerName == name {
+			return types.Federation{}, fmt.Errorf("invalid federated server %q", peer)
+		}
+		federation.Peers[peerName] = peerAddress
+	}
+	return federation, nil
 }
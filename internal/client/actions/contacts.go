@@ -0,0 +1,24 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContactList is the reply of the server to the contact commands
+type ContactList struct {
+	Contacts []string `json:"contacts"`
+	Requests []string `json:"requests"`
+	Blocked  []string `json:"blocked"`
+}
+
+func (c ContactList) String() string {
+	return fmt.Sprintf("Contacts: %s; requests: %s; blocked: %s", names(c.Contacts), names(c.Requests), names(c.Blocked))
+}
+
+func names(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,183 @@
+package actions
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/client/gui"
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+	"github.com/jroimartin/gocui"
+)
+
+var (
+	ErrDirectGreeting = errors.New("peer didn't greet as expected")
+	ErrPeerIdentity   = errors.New("peer couldn't prove its identity")
+)
+
+// DirectPeer is the interlocutor of the direct chat, verified by its identity
+type DirectPeer struct {
+	Name        string
+	Fingerprint string
+}
+
+// Greets the peer, which dialed the listening client, and generates the base
+// secrets of the chat, as the server does for the second client. Returns the
+// peer and the derived key.
+func ListenDirect(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string, generateSecrets func() (*big.Int, *big.Int, error), logger *slog.Logger) (DirectPeer, []byte, error) {
+	peerName, err := readGreeting(conn, buffer)
+	if err != nil {
+		return DirectPeer{}, nil, err
+	}
+	if err = communication.SendMessage(conn, constants.DIRECT+constants.DATA_SEPARATOR+clientName); err != nil {
+		return DirectPeer{}, nil, err
+	}
+	p, g, err := generateSecrets()
+	if err != nil {
+		return DirectPeer{}, nil, err
+	}
+	logger.Debug("Generated base secrets", "p_bits", p.BitLen(), "g", g.String())
+	sharedMessage := constants.INTERLOCUTOR_FOUND + constants.DATA_SEPARATOR + p.String() + constants.DATA_SEPARATOR + g.String()
+	if err = communication.SendMessage(conn, sharedMessage); err != nil {
+		return DirectPeer{}, nil, err
+	}
+	// There is no server to relay the public salts, so they are sent confirmed
+	derivedKey, publicSalt, peerSalt, err := exchangeSalts(conn, buffer, sharedMessage, constants.CHAT_CONFIRMED+constants.DATA_SEPARATOR, logger)
+	if err != nil {
+		return DirectPeer{}, nil, err
+	}
+	peer, err := authenticatePeer(conn, buffer, identityKey, clientName, peerName, handshakeTranscript(sharedMessage, publicSalt, peerSalt))
+	return peer, derivedKey, err
+}
+
+// Greets the listening peer and waits for the base secrets of the chat.
+// Returns the peer and the derived key.
+func DialDirect(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string, logger *slog.Logger) (DirectPeer, []byte, error) {
+	if err := communication.SendMessage(conn, constants.DIRECT+constants.DATA_SEPARATOR+clientName); err != nil {
+		return DirectPeer{}, nil, err
+	}
+	peerName, err := readGreeting(conn, buffer)
+	if err != nil {
+		return DirectPeer{}, nil, err
+	}
+	sharedMessage, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return DirectPeer{}, nil, err
+	}
+	if signal, _ := communication.ParseSignal(sharedMessage, constants.DATA_SEPARATOR); signal != constants.INTERLOCUTOR_FOUND {
+		return DirectPeer{}, nil, ErrDirectGreeting
+	}
+	derivedKey, publicSalt, peerSalt, err := exchangeSalts(conn, buffer, sharedMessage, constants.CHAT_CONFIRMED+constants.DATA_SEPARATOR, logger)
+	if err != nil {
+		return DirectPeer{}, nil, err
+	}
+	peer, err := authenticatePeer(conn, buffer, identityKey, clientName, peerName, handshakeTranscript(sharedMessage, peerSalt, publicSalt))
+	return peer, derivedKey, err
+}
+
+// Reads the name of the peer from its greeting
+func readGreeting(conn net.Conn, buffer []byte) (string, error) {
+	greeting, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return "", err
+	}
+	signal, peerName := communication.ParseSignal(greeting, constants.DATA_SEPARATOR)
+	if signal != constants.DIRECT || peerName == "" {
+		return "", ErrDirectGreeting
+	}
+	return peerName, nil
+}
+
+// Joins the base secrets and the public salts of the handshake as "p:g:A:B",
+// where A is the listener's salt. Both sides sign the same transcript, so the
+// base secrets, replaced on the way, fail the authentication.
+func handshakeTranscript(sharedMessage string, listenerSalt string, dialerSalt string) string {
+	_, parameters := communication.ParseSignal(sharedMessage, constants.DATA_SEPARATOR)
+	return parameters + constants.DATA_SEPARATOR + listenerSalt + constants.DATA_SEPARATOR + dialerSalt
+}
+
+// Both peers sign the transcript of the handshake with their identities, as
+// they answer the challenge of the server. The man in the middle has to
+// exchange other salts with each peer, so it can't reuse their signatures.
+func authenticatePeer(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string, peerName string, transcript string) (DirectPeer, error) {
+	publicKey := identityKey.Public().(ed25519.PublicKey)
+	proof := constants.AUTH_RESPONSE + constants.DATA_SEPARATOR + identity.EncodePublicKey(publicKey) +
+		constants.DATA_SEPARATOR + identity.Sign(identityKey, clientName, transcript)
+	if err := communication.SendMessage(conn, proof); err != nil {
+		return DirectPeer{}, err
+	}
+	peerProof, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return DirectPeer{}, err
+	}
+	signal, payload := communication.ParseSignal(peerProof, constants.DATA_SEPARATOR)
+	encodedKey, signature := communication.ParseSignal(payload, constants.DATA_SEPARATOR)
+	if signal != constants.AUTH_RESPONSE {
+		return DirectPeer{}, ErrPeerIdentity
+	}
+	peerKey, err := identity.DecodePublicKey(encodedKey)
+	if err != nil || !identity.Verify(peerKey, peerName, transcript, signature) {
+		return DirectPeer{}, ErrPeerIdentity
+	}
+	return DirectPeer{Name: peerName, Fingerprint: identity.Fingerprint(peerKey)}, nil
+}
+
+// Handles the messages of the direct chat until it's over. There's no server,
+// so only the peer's own messages are handled, and whatever looks like a
+// server's signal is dropped: the peer mustn't end or rekey the chat in its
+// name.
+func HandleDirectPeer(chat *session.Session, buffer []byte, renderedGUI *gocui.Gui, interlocutorName string, presence *gui.Presence, transcript *gui.Transcript, logger *slog.Logger) {
+	for {
+		conn := chat.Conn()
+		peerMessage, err := communication.ReadMessage(conn, buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || chat.Left() {
+				logger.Info("Connection closed by the user, see ya!")
+				os.Exit(0)
+			}
+			renderedGUI.Close()
+			if communication.IsTimeout(err) {
+				logger.Info("Peer doesn't respond, see ya!")
+				os.Exit(0)
+			}
+			logger.Info("Connection closed by the peer, see ya!", "reason", err)
+			os.Exit(0)
+		}
+		signal, payload := communication.ParseSignal(peerMessage, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.CHAT_MESSAGE, constants.CHAT_CONTROL:
+			receiveChatMessage(chat, signal, payload, renderedGUI, interlocutorName, presence, transcript, logger)
+		case constants.PING:
+			if err = communication.SendMessage(conn, constants.PONG+constants.DATA_SEPARATOR+payload); err != nil {
+				logger.Warn("Couldn't answer the heartbeat", "error", err)
+			}
+		case constants.PONG:
+			sentAt, err := strconv.ParseInt(payload, 10, 64)
+			if err != nil {
+				logger.Debug("Invalid pong is dropped")
+				continue
+			}
+			presence.SetRTT(renderedGUI, time.Since(time.Unix(0, sentAt)))
+		case constants.LEAVE:
+			// Nobody keeps the chat, so the peer can't return to it
+			chat.Suspend()
+			transcript.ForgetUnread()
+			presence.SetTyping(renderedGUI, false)
+			presence.SetStatus(renderedGUI, constants.STATUS_DISCONNECTED)
+			transcript.Notice(renderedGUI, fmt.Sprintf("%s left the chat", interlocutorName))
+			transcript.Notice(renderedGUI, "Press Ctrl+C to exit")
+			return
+		default:
+			logger.Debug("Unexpected peer message is dropped", "bytes", len(peerMessage))
+		}
+	}
+}
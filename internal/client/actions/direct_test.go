@@ -0,0 +1,122 @@
+package actions
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
+)
+
+func testBaseSecrets() (*big.Int, *big.Int, error) {
+	p, _ := new(big.Int).SetString(diffiehellman.MODP_2048_PRIME, 16)
+	return p, big.NewInt(2), nil
+}
+
+// Connects two ends over the loopback, since both sides of the handshake send
+// their salts first, and the pipe would block them
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return accepted, dialed
+}
+
+type handshake struct {
+	peer DirectPeer
+	key  []byte
+	err  error
+}
+
+// Runs both sides of the direct handshake over the connections, and returns
+// the results of the listener and the dialer
+func directHandshake(t *testing.T, listening net.Conn, dialing net.Conn) (handshake, handshake) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, aliceKey, _ := ed25519.GenerateKey(nil)
+	_, bobKey, _ := ed25519.GenerateKey(nil)
+	listened := make(chan handshake, 1)
+	go func() {
+		peer, key, err := ListenDirect(listening, make([]byte, constants.BUFFER_SIZE), aliceKey, "alice", testBaseSecrets, logger)
+		// The failed side hangs up, so the other one doesn't wait for it
+		if err != nil {
+			listening.Close()
+		}
+		listened <- handshake{peer, key, err}
+	}()
+	peer, key, err := DialDirect(dialing, make([]byte, constants.BUFFER_SIZE), bobKey, "bob", logger)
+	if err != nil {
+		dialing.Close()
+	}
+	return <-listened, handshake{peer, key, err}
+}
+
+func TestDirectHandshake(t *testing.T) {
+	listening, dialing := connPair(t)
+	alice, bob := directHandshake(t, listening, dialing)
+	if alice.err != nil || bob.err != nil {
+		t.Fatalf("handshake failed: %v, %v", alice.err, bob.err)
+	}
+	if alice.peer.Name != "bob" || bob.peer.Name != "alice" {
+		t.Fatalf("peers are %q and %q", alice.peer.Name, bob.peer.Name)
+	}
+	if !bytes.Equal(alice.key, bob.key) {
+		t.Fatal("peers derived different keys")
+	}
+}
+
+// The man in the middle, which replaces the generator on the way, can't pass
+// the authentication, since the base secrets are signed too
+func TestTamperedBaseSecrets(t *testing.T) {
+	listening, listenerSide := connPair(t)
+	dialerSide, dialing := connPair(t)
+	relay := func(from net.Conn, to net.Conn) {
+		defer to.Close()
+		buffer := make([]byte, constants.BUFFER_SIZE)
+		for {
+			message, err := communication.ReadMessage(from, buffer)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(message, constants.INTERLOCUTOR_FOUND) {
+				message = message[:strings.LastIndex(message, constants.DATA_SEPARATOR)] + ":5"
+			}
+			if communication.SendMessage(to, message) != nil {
+				return
+			}
+		}
+	}
+	go relay(listenerSide, dialerSide)
+	go relay(dialerSide, listenerSide)
+
+	alice, bob := directHandshake(t, listening, dialing)
+	if !errors.Is(alice.err, ErrPeerIdentity) && !errors.Is(bob.err, ErrPeerIdentity) {
+		t.Fatalf("tampered handshake ended with %v, %v", alice.err, bob.err)
+	}
+	if alice.err == nil || bob.err == nil {
+		t.Fatal("tampered handshake succeeded on one side")
+	}
+}
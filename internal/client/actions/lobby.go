@@ -0,0 +1,185 @@
+package actions
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+var ErrLobbyLeft = errors.New("client left the lobby")
+
+const LOBBY_USAGE = "Commands: /who, /invite <name>, /accept <name>, /decline <name>, /visible, /hidden, /quit"
+
+// Commands of the lobby with the signals they are sent with
+var lobbyCommands = map[string]string{
+	"/who":     constants.WHO,
+	"/invite":  constants.INVITE,
+	"/accept":  constants.INVITE_ACCEPT,
+	"/decline": constants.INVITE_DECLINE,
+}
+
+// Online contact, as listed by the presence directory
+type PresenceInfo struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// Joins the lobby, where the client lists its online contacts and exchanges
+// the invitations, until a chat is agreed. Returns the interlocutor.
+func Lobby(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string, visible bool, input *os.File, logger *slog.Logger) (string, error) {
+	visibility := constants.HIDDEN
+	if visible {
+		visibility = constants.VISIBLE
+	}
+	login := constants.LOBBY + constants.DATA_SEPARATOR + clientName + constants.DATA_SEPARATOR + visibility
+	if err := communication.SendMessage(conn, login); err != nil {
+		return "", err
+	}
+	serverResponse, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return "", err
+	}
+	if serverResponse, err = answerChallenge(conn, buffer, serverResponse, identityKey, clientName); err != nil {
+		return "", err
+	}
+	if serverResponse != constants.LOBBY_JOINED {
+		if refusal, ok := serverRefusals[serverResponse]; ok {
+			return "", refusal
+		}
+		return "", ErrUnknownResponse
+	}
+	fmt.Printf("You are in the lobby as %s. %s\n", visibility, LOBBY_USAGE)
+
+	// The interlocutor of the agreed chat, or the failure of the lobby
+	agreed := make(chan string, 1)
+	failed := make(chan error, 1)
+	// The refused answer to the invitation
+	refused := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go readLobby(conn, buffer, agreed, failed, refused)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(constants.HEARTBEAT_INTERVAL * time.Second):
+			}
+			ping := constants.PING + constants.DATA_SEPARATOR + strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := communication.SendMessage(conn, ping); err != nil {
+				logger.Debug("Couldn't send the heartbeat", "error", err)
+			}
+		}
+	}()
+
+	// The input is read in the background, so the agreed chat starts right
+	// away, even if the user isn't typing
+	lines := communication.ReadLines(input)
+	defer lines.Stop()
+	for {
+		var line string
+		select {
+		case interlocutorName := <-agreed:
+			return interlocutorName, nil
+		case err = <-failed:
+			return "", err
+		case read, ok := <-lines.C:
+			if !ok {
+				return "", lines.Err()
+			}
+			line = read
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "/quit":
+			return "", ErrLobbyLeft
+		case "/visible", "/hidden":
+			visibility = strings.TrimPrefix(fields[0], "/")
+			err = communication.SendMessage(conn, constants.VISIBILITY+constants.DATA_SEPARATOR+visibility)
+		case "/who":
+			err = communication.SendMessage(conn, constants.WHO)
+		case "/invite", "/accept", "/decline":
+			if len(fields) != 2 {
+				fmt.Println(LOBBY_USAGE)
+				continue
+			}
+			err = communication.SendMessage(conn, lobbyCommands[fields[0]]+constants.DATA_SEPARATOR+fields[1])
+		default:
+			fmt.Println(LOBBY_USAGE)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// The accepted invitation starts the chat right away
+		if fields[0] == "/accept" {
+			select {
+			case interlocutorName := <-agreed:
+				return interlocutorName, nil
+			case err = <-failed:
+				return "", err
+			case <-refused:
+			}
+		}
+	}
+}
+
+// Shows the messages of the lobby, until the chat is agreed, or the lobby fails
+func readLobby(conn net.Conn, buffer []byte, agreed chan<- string, failed chan<- error, refused chan<- struct{}) {
+	for {
+		message, err := communication.ReadMessage(conn, buffer)
+		if err != nil {
+			failed <- err
+			return
+		}
+		signal, payload := communication.ParseSignal(message, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.WHO_LIST:
+			var online []PresenceInfo
+			if err = json.Unmarshal([]byte(payload), &online); err != nil {
+				continue
+			}
+			if len(online) == 0 {
+				fmt.Println("None of your contacts is online")
+			}
+			for _, contact := range online {
+				fmt.Printf("%s is %s\n", contact.Name, contact.Status)
+			}
+		case constants.VISIBILITY:
+			fmt.Printf("You are %s now\n", payload)
+		case constants.INVITATION:
+			fmt.Printf("%s invites you to chat, type /accept %s or /decline %s\n", payload, payload, payload)
+		case constants.INVITE_SENT:
+			fmt.Printf("Invitation is sent to %s, waiting for the answer...\n", payload)
+		case constants.INVITE_DECLINED:
+			fmt.Printf("%s declined the invitation\n", payload)
+		case constants.INVITE_ERROR:
+			fmt.Printf("Invitation failed: %s\n", payload)
+			select {
+			case refused <- struct{}{}:
+			default:
+			}
+		case constants.INVITE_ACCEPTED:
+			fmt.Printf("The chat with %s is agreed, starting it...\n", payload)
+			agreed <- payload
+			return
+		case constants.SERVER_SHUTDOWN:
+			failed <- ErrServerShutdown
+			return
+		}
+	}
+}
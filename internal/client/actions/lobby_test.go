@@ -0,0 +1,78 @@
+package actions
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// The agreed chat starts without waiting for the input, which stays free for
+// the chat afterwards
+func TestLobbyStartsAgreedChat(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	input, typed, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	defer typed.Close()
+
+	go func() {
+		buffer := make([]byte, constants.BUFFER_SIZE)
+		if _, err := communication.ReadMessage(server, buffer); err != nil {
+			return
+		}
+		if err := communication.SendMessage(server, constants.LOBBY_JOINED); err != nil {
+			return
+		}
+		_ = communication.SendMessage(server, constants.INVITE_ACCEPTED+constants.DATA_SEPARATOR+"bob")
+	}()
+
+	seed := sha256.Sum256([]byte("alice"))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	type result struct {
+		interlocutor string
+		err          error
+	}
+	results := make(chan result, 1)
+	go func() {
+		interlocutor, err := Lobby(client, make([]byte, constants.BUFFER_SIZE), ed25519.NewKeyFromSeed(seed[:]), "alice", true, input, logger)
+		results <- result{interlocutor, err}
+	}()
+	select {
+	case lobby := <-results:
+		if lobby.err != nil || lobby.interlocutor != "bob" {
+			t.Fatalf("lobby returned %q, %v", lobby.interlocutor, lobby.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lobby waits for the input")
+	}
+
+	if _, err = typed.WriteString("hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(input).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "hello\n" {
+			t.Fatalf("chat read %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the input is still taken by the lobby")
+	}
+}
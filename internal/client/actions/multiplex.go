@@ -0,0 +1,184 @@
+package actions
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/client/gui"
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/crypt"
+	"github.com/jroimartin/gocui"
+)
+
+// Opens the multiplexed session, which carries the chats with many
+// interlocutors at once. The name is claimed with the identity key.
+func JoinMultiplex(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string) error {
+	if err := communication.SendMessage(conn, constants.MULTIPLEX+constants.DATA_SEPARATOR+clientName); err != nil {
+		return err
+	}
+	serverResponse, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return err
+	}
+	if serverResponse, err = answerChallenge(conn, buffer, serverResponse, identityKey, clientName); err != nil {
+		return err
+	}
+	if serverResponse == constants.MULTIPLEX_JOINED {
+		return nil
+	}
+	if refusal, ok := serverRefusals[serverResponse]; ok {
+		return refusal
+	}
+	return ErrUnknownResponse
+}
+
+// Handles the control stream of the multiplexed session until it's over,
+// while the conversations are handled on their own streams
+func HandleMultiplex(mux *session.Multiplex, buffer []byte, renderedGUI *gocui.Gui, logger *slog.Logger) {
+	go acceptConversations(mux, renderedGUI, logger)
+	for {
+		serverMessage, err := communication.ReadMessage(mux.Conn(), buffer)
+		if err != nil {
+			// The stream only tells the connection is over, the multiplexer tells why
+			if linkErr := mux.Link().Err(); linkErr != nil {
+				err = linkErr
+			}
+			if errors.Is(err, communication.ErrMultiplexerClosed) {
+				logger.Info("Connection closed by the user, see ya!")
+				os.Exit(0)
+			}
+			renderedGUI.Close()
+			if communication.IsTimeout(err) {
+				logger.Info("Server doesn't respond, see ya!")
+			} else {
+				logger.Info("Connection is closed, see ya!", "reason", err)
+			}
+			os.Exit(0)
+		}
+		signal, payload := communication.ParseSignal(serverMessage, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.SERVER_SHUTDOWN:
+			renderedGUI.Close()
+			logger.Info("Server is shutting down, see ya!")
+			os.Exit(0)
+		case constants.CLIENT_KICKED:
+			renderedGUI.Close()
+			logger.Info("You have been disconnected by the server admin, see ya!")
+			os.Exit(0)
+		case constants.CHAT_ERROR:
+			peer, data, _ := strings.Cut(payload, constants.DATA_SEPARATOR)
+			gui.ShowNotice(renderedGUI, fmt.Sprintf("Chat with %s: %s", peer, data))
+		case constants.CONTACT_REQUEST:
+			gui.ShowNotice(renderedGUI, fmt.Sprintf("%s wants to chat with you, type /accept %s or /block %s", payload, payload, payload))
+		case constants.CONTACT_LIST:
+			var contacts ContactList
+			if err = json.Unmarshal([]byte(payload), &contacts); err != nil {
+				logger.Debug("Invalid contact list is dropped")
+				continue
+			}
+			gui.ShowNotice(renderedGUI, contacts.String())
+		case constants.CONTACT_ERROR:
+			gui.ShowNotice(renderedGUI, "Contacts: "+payload)
+		case constants.MESSAGE_RATE_LIMITED:
+			gui.ShowNotice(renderedGUI, "You are sending messages too fast, the last one was dropped")
+		case constants.PONG:
+		default:
+			logger.Debug("Unknown server message is dropped", "bytes", len(serverMessage))
+		}
+	}
+}
+
+// Accepts the streams of the conversations, which the server opens, until
+// the connection is over
+func acceptConversations(mux *session.Multiplex, renderedGUI *gocui.Gui, logger *slog.Logger) {
+	for {
+		stream, err := mux.Link().Accept()
+		if err != nil {
+			return
+		}
+		go handleConversation(mux, stream, renderedGUI, logger)
+	}
+}
+
+// Handles the stream of the conversation until either peer closes it. The
+// stream starts with the base secrets, so the conversation agrees on its own
+// key before anything else.
+func handleConversation(mux *session.Multiplex, stream net.Conn, renderedGUI *gocui.Gui, logger *slog.Logger) {
+	defer stream.Close()
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	opened, err := communication.ReadMessage(stream, buffer)
+	if err != nil {
+		logger.Debug("Conversation is over before it's opened", "error", err)
+		return
+	}
+	signal, payload := communication.ParseSignal(opened, constants.DATA_SEPARATOR)
+	peer, secrets, _ := strings.Cut(payload, constants.DATA_SEPARATOR)
+	if signal != constants.CHAT_OPENED {
+		logger.Debug("Conversation without the base secrets is dropped")
+		return
+	}
+	rekey, publicSalt, err := StartRekey(constants.CHAT_OPENED + constants.DATA_SEPARATOR + secrets)
+	if err != nil {
+		logger.Warn("Couldn't start the key exchange", "interlocutor", peer, "error", err)
+		return
+	}
+	if !mux.Open(peer, stream) {
+		logger.Debug("Second conversation with the same peer is dropped", "interlocutor", peer)
+		return
+	}
+	gui.ShowConversationNotice(renderedGUI, mux, peer, fmt.Sprintf("The chat with %s is open, securing it...", peer))
+	if err = communication.SendMessage(stream, constants.CHAT_KEY+constants.DATA_SEPARATOR+publicSalt); err != nil {
+		logger.Warn("Couldn't send the public salt", "error", err)
+	}
+	for {
+		message, err := communication.ReadMessage(stream, buffer)
+		if err != nil {
+			// The conversation, which the user has closed, is gone already
+			if mux.Ended(peer, stream) {
+				gui.RefreshConversations(renderedGUI, mux)
+				gui.ShowNotice(renderedGUI, fmt.Sprintf("%s closed the chat", peer))
+			}
+			return
+		}
+		signal, data := communication.ParseSignal(message, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.CHAT_KEY:
+			if rekey == nil {
+				logger.Debug("Unexpected public salt is dropped")
+				continue
+			}
+			key, err := rekey.Finish(data)
+			if err != nil {
+				logger.Warn("Couldn't finish the key exchange", "interlocutor", peer, "error", err)
+				continue
+			}
+			rekey = nil
+			mux.SetKey(peer, key)
+			gui.ShowConversationNotice(renderedGUI, mux, peer, "The chat is secured with its own key")
+		case constants.CHAT_MESSAGE:
+			key, err := mux.Key(peer)
+			if err != nil {
+				logger.Debug("Message without the key is dropped")
+				continue
+			}
+			decryptedMessage, err := crypt.DecryptMessage(data, key)
+			if err != nil {
+				logger.Warn("Couldn't decrypt the message", "interlocutor", peer, "error", err)
+				continue
+			}
+			gui.ShowConversationLine(renderedGUI, mux, peer, fmt.Sprintf("%s[%s] %s", constants.RED_COLOR, peer, decryptedMessage))
+		case constants.CHAT_ENDED:
+			gui.ShowNotice(renderedGUI, fmt.Sprintf("The chat with %s has been ended by the server admin", peer))
+		default:
+			logger.Debug("Unknown chat message is dropped", "bytes", len(message))
+		}
+	}
+}
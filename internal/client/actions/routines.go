@@ -1,34 +1,258 @@
 package actions
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dikuropiatnyk/dh-chat/internal/client/gui"
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
 	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/crypt"
 	"github.com/jroimartin/gocui"
 )
 
-func HandleServerResponse(conn net.Conn, buffer []byte, renderedGUI *gocui.Gui, interlocutorName string, clientKey []byte) {
+// Rejoin re-establishes the chat with the returning interlocutor on a new connection
+type Rejoin func() (net.Conn, []byte, error)
+
+// Reconnect resumes the chat with the session ticket on a new connection
+type Reconnect func(ticket string) (net.Conn, error)
+
+// Handles the messages of the chat until it's over. If the interlocutor leaves,
+// the chat is re-established via rejoin, unless it's nil. The lost connection
+// is replaced via reconnect, unless it's nil.
+func HandleServerResponse(chat *session.Session, buffer []byte, renderedGUI *gocui.Gui, interlocutorName string, presence *gui.Presence, transcript *gui.Transcript, rejoin Rejoin, reconnect Reconnect, logger *slog.Logger) {
+	// The key exchange in progress, started by the server after the chat is resumed
+	var rekey *Rekey
 	for {
-		serverMessage, err := communication.ReadEncryptedMessage(conn, buffer, clientKey)
+		conn := chat.Conn()
+		serverMessage, err := communication.ReadMessage(conn, buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) || chat.Left() {
+				logger.Info("Connection closed by the user, see ya!")
+				os.Exit(0)
+			}
+			if ticket := chat.Ticket(); reconnect != nil && ticket != "" {
+				conn.Close()
+				transcript.Notice(renderedGUI, "Connection to the server is lost, reconnecting...")
+				newConn, err := reconnect(ticket)
+				if err != nil {
+					logger.Warn("Couldn't resume the chat", "error", err)
+					transcript.Notice(renderedGUI, fmt.Sprintf("Couldn't reconnect: %s. Press Ctrl+C to exit", err))
+					return
+				}
+				chat.Reconnect(newConn)
+				transcript.Notice(renderedGUI, "Reconnected to the server")
+				continue
+			}
 			if err.Error() == io.EOF.Error() {
 				renderedGUI.Close()
-				log.Println("Connection closed by the server, see ya!")
+				logger.Info("Connection closed by the server, see ya!")
 				os.Exit(0)
-			} else if errors.Is(err, net.ErrClosed) {
-				log.Println("Connection closed by the user, see ya!")
+			} else if communication.IsTimeout(err) {
+				// The server pings the client regularly, so the silence means it's gone
+				renderedGUI.Close()
+				logger.Info("Server doesn't respond, see ya!")
 				os.Exit(0)
 			} else {
-				log.Fatalln("Couldn't read the message. Unexpected error: ", err)
+				logger.Error("Couldn't read the message. Unexpected error", "error", err)
+				os.Exit(1)
+			}
+		}
+		// Server signals are sent in plain text, unlike the interlocutor's messages
+		signal, payload := communication.ParseSignal(serverMessage, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.SERVER_SHUTDOWN:
+			renderedGUI.Close()
+			logger.Info("Server is shutting down, see ya!")
+			os.Exit(0)
+		case constants.CLIENT_KICKED:
+			renderedGUI.Close()
+			logger.Info("You have been disconnected by the server admin, see ya!")
+			os.Exit(0)
+		case constants.CHAT_ENDED:
+			renderedGUI.Close()
+			logger.Info("The chat has been ended by the server admin, see ya!")
+			os.Exit(0)
+		case constants.IDLE_TIMEOUT_EXCEEDED:
+			renderedGUI.Close()
+			logger.Info("You have been silent for too long, see ya!")
+			os.Exit(0)
+		case constants.INTERLOCUTOR_IDLE:
+			// The server tells that the interlocutor left right after this signal
+			transcript.Notice(renderedGUI, fmt.Sprintf("%s has been silent for too long", interlocutorName))
+		case constants.PEER_LEFT:
+			chat.Suspend()
+			transcript.ForgetUnread()
+			presence.SetTyping(renderedGUI, false)
+			presence.SetStatus(renderedGUI, constants.STATUS_DISCONNECTED)
+			transcript.Notice(renderedGUI, fmt.Sprintf("%s left the chat", interlocutorName))
+			if rejoin == nil {
+				transcript.Notice(renderedGUI, "Press Ctrl+C to exit")
+				return
+			}
+			transcript.Notice(renderedGUI, fmt.Sprintf("Waiting for %s to return...", interlocutorName))
+			conn.Close()
+			newConn, newKey, err := rejoin()
+			if err != nil {
+				logger.Warn("Couldn't rejoin the chat", "error", err)
+				transcript.Notice(renderedGUI, fmt.Sprintf("Couldn't wait for %s: %s. Press Ctrl+C to exit", interlocutorName, err))
+				return
+			}
+			chat.Resume(newConn, newKey)
+			presence.SetStatus(renderedGUI, constants.STATUS_ONLINE)
+			transcript.Notice(renderedGUI, fmt.Sprintf("%s is back, the chat is secured with a new key", interlocutorName))
+		case constants.SESSION_TICKET:
+			chat.SetTicket(payload)
+		// The public salts of the rekey are signed with the current key, which
+		// proves the resumed party is the one, which has left
+		case constants.REKEY:
+			key, err := chat.Key()
+			if err != nil {
+				logger.Debug("Rekey without the key is dropped")
+				continue
+			}
+			var publicSalt, signedSalt string
+			if rekey, publicSalt, err = StartRekey(serverMessage); err != nil {
+				logger.Warn("Couldn't start the rekey", "error", err)
+				continue
+			}
+			if signedSalt, err = rekey.Sign(publicSalt, key); err != nil {
+				logger.Warn("Couldn't sign the public salt", "error", err)
+				continue
+			}
+			if err = communication.SendMessage(conn, constants.REKEY_SALT+constants.DATA_SEPARATOR+signedSalt); err != nil {
+				logger.Warn("Couldn't send the public salt", "error", err)
+			}
+		case constants.REKEY_SALT:
+			key, err := chat.Key()
+			if rekey == nil || err != nil {
+				logger.Debug("Unexpected public salt is dropped")
+				continue
+			}
+			newKey, err := rekey.FinishSigned(payload, key)
+			rekey = nil
+			if errors.Is(err, ErrRekeyForged) {
+				logger.Warn("Forged rekey is refused")
+				transcript.Notice(renderedGUI, fmt.Sprintf("The new key doesn't come from %s, it's refused", interlocutorName))
+				continue
+			}
+			if err != nil {
+				logger.Warn("Couldn't finish the rekey", "error", err)
+				continue
+			}
+			chat.Rekey(newKey)
+			transcript.Notice(renderedGUI, "The chat is secured with a new key")
+		case constants.CONTACT_REQUEST:
+			transcript.Notice(renderedGUI, fmt.Sprintf("%s wants to chat with you, type /accept %s or /block %s", payload, payload, payload))
+		case constants.CONTACT_LIST:
+			var contacts ContactList
+			if err = json.Unmarshal([]byte(payload), &contacts); err != nil {
+				logger.Debug("Invalid contact list is dropped")
+				continue
+			}
+			transcript.Notice(renderedGUI, contacts.String())
+		case constants.CONTACT_ERROR:
+			transcript.Notice(renderedGUI, "Contacts: "+payload)
+		case constants.MESSAGE_RATE_LIMITED:
+			transcript.Notice(renderedGUI, "You are sending messages too fast, the last one was dropped")
+		case constants.PING:
+			if err = communication.SendMessage(conn, constants.PONG+constants.DATA_SEPARATOR+payload); err != nil {
+				logger.Warn("Couldn't answer the heartbeat", "error", err)
 			}
+		case constants.PONG:
+			// The payload of the pong is the timestamp of the client's ping
+			sentAt, err := strconv.ParseInt(payload, 10, 64)
+			if err != nil {
+				logger.Debug("Invalid pong is dropped")
+				continue
+			}
+			presence.SetRTT(renderedGUI, time.Since(time.Unix(0, sentAt)))
+		case constants.PEER_STATUS:
+			presence.SetStatus(renderedGUI, payload)
+		case constants.CHAT_MESSAGE, constants.CHAT_CONTROL:
+			receiveChatMessage(chat, signal, payload, renderedGUI, interlocutorName, presence, transcript, logger)
+		default:
+			logger.Debug("Unknown server message is dropped", "bytes", len(serverMessage))
+		}
+	}
+}
+
+// Decrypts the interlocutor's message or control message, and handles it
+func receiveChatMessage(chat *session.Session, signal string, encryptedMessage string, renderedGUI *gocui.Gui, interlocutorName string, presence *gui.Presence, transcript *gui.Transcript, logger *slog.Logger) {
+	clientKey, err := chat.Key()
+	if err != nil {
+		logger.Debug("Message without the key is dropped")
+		return
+	}
+	decryptedMessage, err := crypt.DecryptMessage(encryptedMessage, clientKey)
+	// The message may be sent right before the rekey
+	if previousKey := chat.PreviousKey(); err != nil && previousKey != nil {
+		decryptedMessage, err = crypt.DecryptMessage(encryptedMessage, previousKey)
+	}
+	if err != nil {
+		logger.Error("Couldn't decrypt the message", "error", err)
+		os.Exit(1)
+	}
+	// The control messages aren't limited as the conversation, so they can't carry it
+	if signal == constants.CHAT_CONTROL && strings.HasPrefix(decryptedMessage, constants.MESSAGE+constants.DATA_SEPARATOR) {
+		logger.Debug("Message in the control message is dropped")
+		return
+	}
+	handleChatMessage(chat, decryptedMessage, renderedGUI, interlocutorName, presence, transcript, logger)
+}
+
+// Displays the decrypted message of the interlocutor and acknowledges it, marks
+// the outgoing messages with the interlocutor's receipt, or displays its typing
+func handleChatMessage(chat *session.Session, message string, renderedGUI *gocui.Gui, interlocutorName string, presence *gui.Presence, transcript *gui.Transcript, logger *slog.Logger) {
+	signal, payload := communication.ParseSignal(message, constants.DATA_SEPARATOR)
+	switch signal {
+	case constants.MESSAGE:
+		// The message is in the format "MESSAGE:id:text"
+		id, text, _ := strings.Cut(payload, constants.DATA_SEPARATOR)
+		// The sent message ends the typing without the stop
+		presence.SetTyping(renderedGUI, false)
+		receipt := constants.MESSAGE_DELIVERED
+		if transcript.Received(renderedGUI, id, fmt.Sprintf("%s[%s] %s", constants.RED_COLOR, interlocutorName, text)) {
+			receipt = constants.MESSAGE_READ
+		}
+		if err := chat.SendControl(receipt + constants.DATA_SEPARATOR + id); err != nil {
+			logger.Warn("Couldn't acknowledge the message", "error", err)
 		}
-		if err = gui.UpdateChatView(renderedGUI, serverMessage, interlocutorName); err != nil {
-			log.Fatalln(err)
+	case constants.MESSAGE_DELIVERED:
+		transcript.Acknowledge(renderedGUI, strings.Split(payload, constants.ID_SEPARATOR), gui.RECEIPT_DELIVERED)
+	case constants.MESSAGE_READ:
+		transcript.Acknowledge(renderedGUI, strings.Split(payload, constants.ID_SEPARATOR), gui.RECEIPT_READ)
+	case constants.TYPING_STARTED:
+		presence.SetTyping(renderedGUI, true)
+	case constants.TYPING_STOPPED:
+		presence.SetTyping(renderedGUI, false)
+	default:
+		logger.Debug("Unknown chat message is dropped", "bytes", len(message))
+	}
+}
+
+// Connected is the chat or the multiplexed session, whose connection may be replaced
+type Connected interface {
+	Conn() net.Conn
+}
+
+// Pings the server with the interval via the current connection of the chat.
+// The failed pings are ignored, since the connection may be re-established.
+func SendHeartbeats(chat Connected, interval time.Duration, logger *slog.Logger) {
+	for {
+		time.Sleep(interval)
+		ping := constants.PING + constants.DATA_SEPARATOR + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := communication.SendMessage(chat.Conn(), ping); err != nil {
+			logger.Debug("Couldn't send the heartbeat", "error", err)
 		}
 	}
 }
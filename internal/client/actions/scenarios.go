@@ -1,9 +1,9 @@
 package actions
 
 import (
-	"bufio"
+	"crypto/ed25519"
 	"errors"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"strings"
@@ -12,72 +12,247 @@ import (
 	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
 	"github.com/dikuropiatnyk/dh-chat/pkg/crypt"
 	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
 )
 
 var ErrStringToBigInt = errors.New("couldn't convert the string to a big integer")
 
+// The public salt of the rekey isn't signed with the key of the chat
+var ErrRekeyForged = errors.New("rekey isn't signed with the key of the chat")
+
+// Refusals of the server, which end the attempt to join the chat
+var (
+	ErrClientExists        = errors.New("client already exists")
+	ErrServerShutdown      = errors.New("server is shutting down")
+	ErrServerMaintenance   = errors.New("server is under maintenance")
+	ErrTooManyConnections  = errors.New("server has too many connections")
+	ErrRateLimited         = errors.New("too many attempts to connect")
+	ErrInterlocutorTimeout = errors.New("interlocutor didn't show up")
+	ErrClientKicked        = errors.New("client is disconnected by the server admin")
+	ErrUnknownResponse     = errors.New("unknown server response")
+	ErrResumeFailed        = errors.New("server couldn't resume the chat")
+	ErrServerUnreachable   = errors.New("interlocutor's server is unreachable")
+	// Refusals of the login, which the server considers invalid
+	ErrMalformedLogin = errors.New("names mustn't contain the separator")
+	ErrNameRequired   = errors.New("both names are required")
+	ErrNameTooLong    = errors.New("name is too long")
+	ErrInvalidName    = errors.New("names may contain only letters, digits, '_', '-' and '.'")
+	ErrReservedName   = errors.New("name is reserved")
+	ErrUnknownServer  = errors.New("interlocutor's server isn't federated")
+	ErrAuthFailed     = errors.New("name is registered with another identity")
+	ErrUnknownAccount = errors.New("name isn't registered on the server")
+	// The interlocutor isn't a contact yet, and has been asked to become one
+	ErrContactRequested = errors.New("contact request is sent")
+)
+
+var serverRefusals = map[string]error{
+	constants.CLIENT_EXISTS:             ErrClientExists,
+	constants.SERVER_SHUTDOWN:           ErrServerShutdown,
+	constants.SERVER_MAINTENANCE:        ErrServerMaintenance,
+	constants.TOO_MANY_CONNECTIONS:      ErrTooManyConnections,
+	constants.RATE_LIMITED:              ErrRateLimited,
+	constants.INTERLOCUTOR_WAIT_TIMEOUT: ErrInterlocutorTimeout,
+	constants.CLIENT_KICKED:             ErrClientKicked,
+	constants.MALFORMED_LOGIN:           ErrMalformedLogin,
+	constants.NAME_REQUIRED:             ErrNameRequired,
+	constants.NAME_TOO_LONG:             ErrNameTooLong,
+	constants.INVALID_NAME:              ErrInvalidName,
+	constants.RESERVED_NAME:             ErrReservedName,
+	constants.UNKNOWN_SERVER:            ErrUnknownServer,
+	constants.SERVER_UNREACHABLE:        ErrServerUnreachable,
+	constants.AUTH_FAILED:               ErrAuthFailed,
+	constants.UNKNOWN_ACCOUNT:           ErrUnknownAccount,
+	constants.CONTACT_REQUESTED:         ErrContactRequested,
+}
+
+// Logs in to the server and waits until the chat with the interlocutor is
+// established. The name is claimed with the identity key. Returns the
+// derived key of the chat.
+func JoinChat(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string, interlocutorName string, logger *slog.Logger) ([]byte, error) {
+	// Concatenate the user name and the interlocutor's name
+	if err := communication.SendMessage(conn, clientName+constants.DATA_SEPARATOR+interlocutorName); err != nil {
+		return nil, err
+	}
+	// First reading from the connection to get the user name and the interlocutor
+	serverResponse, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return nil, err
+	}
+	if serverResponse, err = answerChallenge(conn, buffer, serverResponse, identityKey, clientName); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(serverResponse, constants.NO_INTERLOCUTOR) {
+		logger.Info("No interlocutor found! Wait, please...")
+		if serverResponse, err = communication.ReadMessage(conn, buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	signal, _ := communication.ParseSignal(serverResponse, constants.DATA_SEPARATOR)
+	if signal != constants.INTERLOCUTOR_FOUND {
+		if refusal, ok := serverRefusals[signal]; ok {
+			return nil, refusal
+		}
+		return nil, ErrUnknownResponse
+	}
+	logger.Info("Interlocutor found! Start chatting...")
+	return Handshake(conn, buffer, serverResponse, logger)
+}
+
+// Proves the name belongs to the identity, if the server asks for it.
+// Returns the next message of the server.
+func answerChallenge(conn net.Conn, buffer []byte, serverResponse string, identityKey ed25519.PrivateKey, clientName string) (string, error) {
+	signal, nonce := communication.ParseSignal(serverResponse, constants.DATA_SEPARATOR)
+	if signal != constants.AUTH_CHALLENGE {
+		return serverResponse, nil
+	}
+	publicKey := identityKey.Public().(ed25519.PublicKey)
+	response := constants.AUTH_RESPONSE + constants.DATA_SEPARATOR + identity.EncodePublicKey(publicKey) +
+		constants.DATA_SEPARATOR + identity.Sign(identityKey, clientName, nonce)
+	if err := communication.SendMessage(conn, response); err != nil {
+		return "", err
+	}
+	return communication.ReadMessage(conn, buffer)
+}
+
 // A handshake of the chat between the user and the interlocutor
-func Handshake(userConnection net.Conn, buffer []byte, reader *bufio.Reader, sharedMessage string) ([]byte, error) {
-	// Split the client data into the client name and the interlocutor
-	// The client data is in the format "clientName;interlocutor"
+func Handshake(userConnection net.Conn, buffer []byte, sharedMessage string, logger *slog.Logger) ([]byte, error) {
+	// The server confirms the chat by relaying the public salt of the interlocutor
+	derivedKey, _, _, err := exchangeSalts(userConnection, buffer, sharedMessage, "", logger)
+	return derivedKey, err
+}
+
+// Sends the public salt with the prefix and derives the key with the public
+// salt of the interlocutor. Returns the key and both public salts.
+func exchangeSalts(userConnection net.Conn, buffer []byte, sharedMessage string, saltPrefix string, logger *slog.Logger) ([]byte, string, string, error) {
+	rekey, publicSalt, err := StartRekey(sharedMessage)
+	if err != nil {
+		return nil, "", "", err
+	}
+	// The private salt itself is never logged
+	logger.Debug("Generated private salt. Don't show it to no one!")
+
+	// Send the public salt to the user
+	if err = communication.SendMessage(userConnection, saltPrefix+publicSalt); err != nil {
+		return nil, "", "", err
+	}
+	// Read the public salt from the interlocutor
+	chatConfirmation, err := communication.ReadMessage(userConnection, buffer)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if !strings.HasPrefix(chatConfirmation, constants.CHAT_CONFIRMED) {
+		return nil, "", "", errors.New("chat confirmation failed")
+	}
+	chatConfirmationSlice := strings.Split(chatConfirmation, constants.DATA_SEPARATOR)
+	if len(chatConfirmationSlice) != 2 {
+		return nil, "", "", errors.New("invalid chat confirmation")
+	}
+	derivedKey, err := rekey.Finish(chatConfirmationSlice[1])
+	if err != nil {
+		return nil, "", "", err
+	}
+	logger.Debug("Derived the symmetric key", "key", derivedKey)
+
+	return derivedKey, publicSalt, chatConfirmationSlice[1], nil
+}
+
+// Rekey is the key exchange in progress, waiting for the interlocutor's public salt
+type Rekey struct {
+	p           *big.Int
+	privateSalt *big.Int
+	// Base secrets in the format "p:g", which the rekey signature covers
+	parameters string
+}
+
+// StartRekey generates the salts with the base secrets of the message, which
+// is in the format "signal:p:g". Returns the public salt to share.
+func StartRekey(sharedMessage string) (*Rekey, string, error) {
 	sharedMessageSlice := strings.Split(sharedMessage, constants.DATA_SEPARATOR)
 	if len(sharedMessageSlice) != 3 {
-		return nil, errors.New("invalid shared message")
+		return nil, "", errors.New("invalid shared message")
 	}
-	// The shared message is in the format "signal:p:g"
 	pStr, gStr := sharedMessageSlice[1], sharedMessageSlice[2]
 
 	// Convert the public secrets to big integers
 	p, success := new(big.Int).SetString(pStr, 10)
 	if !success {
-		return nil, ErrStringToBigInt
+		return nil, "", ErrStringToBigInt
 	}
 	g, success := new(big.Int).SetString(gStr, 10)
 	if !success {
-		return nil, ErrStringToBigInt
+		return nil, "", ErrStringToBigInt
+	}
+	// The secrets come from the server or the peer, so the weak ones are refused
+	if err := diffiehellman.ValidateBaseSecrets(p, g); err != nil {
+		return nil, "", err
 	}
 
-	// Generate a private salt
 	privateSalt, err := diffiehellman.GeneratePrivateSalt(p)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	log.Println("Generated private salt. Don't show it to no one!")
-	log.Println(privateSalt)
-
-	// Generate a public salt
 	publicSalt := diffiehellman.GeneratePublicSalt(p, g, privateSalt)
+	return &Rekey{p: p, privateSalt: privateSalt, parameters: pStr + constants.DATA_SEPARATOR + gStr}, publicSalt.String(), nil
+}
 
-	// Send the public salt to the user
-	if err = communication.SendMessage(userConnection, publicSalt.String()); err != nil {
-		return nil, err
+// Finish derives the key with the interlocutor's public salt
+func (r *Rekey) Finish(interlocutorPublicSaltStr string) ([]byte, error) {
+	interlocutorPublicSalt, success := new(big.Int).SetString(interlocutorPublicSaltStr, 10)
+	if !success {
+		return nil, ErrStringToBigInt
 	}
-	// Read the public salt from the interlocutor
-	chatConfirmation, err := communication.ReadMessage(userConnection, buffer)
+	symmetricKey := diffiehellman.GenerateSymmetricKey(r.p, interlocutorPublicSalt, r.privateSalt)
+	return crypt.DeriveKey(symmetricKey)
+}
+
+// Sign proves the public salt of the rekey comes from the party of the
+// current key. Returns the salt with the signature, in the format "salt:signature".
+func (r *Rekey) Sign(publicSalt string, key []byte) (string, error) {
+	signature, err := crypt.SignRekey(r.parameters+constants.DATA_SEPARATOR+publicSalt, key)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	if !strings.HasPrefix(chatConfirmation, constants.CHAT_CONFIRMED) {
-		return nil, errors.New("chat confirmation failed")
-	}
-	chatConfirmationSlice := strings.Split(chatConfirmation, constants.DATA_SEPARATOR)
-	if len(chatConfirmationSlice) != 2 {
-		return nil, errors.New("invalid chat confirmation")
+	return publicSalt + constants.DATA_SEPARATOR + signature, nil
+}
+
+// FinishSigned derives the next key with the interlocutor's signed public
+// salt, in the format "salt:signature". Both the signature and the derivation
+// rely on the current key, so the party without it can't take over the chat.
+func (r *Rekey) FinishSigned(signedSalt string, key []byte) ([]byte, error) {
+	publicSaltStr, signature, _ := strings.Cut(signedSalt, constants.DATA_SEPARATOR)
+	if !crypt.VerifyRekey(r.parameters+constants.DATA_SEPARATOR+publicSaltStr, signature, key) {
+		return nil, ErrRekeyForged
 	}
-	interlocutorPublicSaltStr := chatConfirmationSlice[1]
-	interlocutorPublicSalt, success := new(big.Int).SetString(interlocutorPublicSaltStr, 10)
+	interlocutorPublicSalt, success := new(big.Int).SetString(publicSaltStr, 10)
 	if !success {
 		return nil, ErrStringToBigInt
 	}
+	symmetricKey := diffiehellman.GenerateSymmetricKey(r.p, interlocutorPublicSalt, r.privateSalt)
+	return crypt.DeriveNextKey(symmetricKey, key)
+}
 
-	// Generate the symmetric key
-	symmetricKey := diffiehellman.GenerateSymmetricKey(p, interlocutorPublicSalt, privateSalt)
-	// Derive the key
-	derivedKey, err := crypt.DeriveKey(symmetricKey)
+// Presents the session ticket to resume the chat on a new connection, and
+// proves the name of the chat belongs to the identity
+func ResumeChat(conn net.Conn, buffer []byte, identityKey ed25519.PrivateKey, clientName string, ticket string) error {
+	if err := communication.SendMessage(conn, constants.RESUME+constants.DATA_SEPARATOR+ticket); err != nil {
+		return err
+	}
+	serverResponse, err := communication.ReadMessage(conn, buffer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Println("Derived key:", derivedKey)
-
-	return derivedKey, nil
+	if serverResponse, err = answerChallenge(conn, buffer, serverResponse, identityKey, clientName); err != nil {
+		return err
+	}
+	switch serverResponse {
+	case constants.RESUMED:
+		return nil
+	case constants.RESUME_FAILED:
+		return ErrResumeFailed
+	}
+	if refusal, ok := serverRefusals[serverResponse]; ok {
+		return refusal
+	}
+	return ErrUnknownResponse
 }
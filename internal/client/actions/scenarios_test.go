@@ -0,0 +1,96 @@
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
+)
+
+func testSharedMessage(signal string, g string) string {
+	p, _ := new(big.Int).SetString(diffiehellman.MODP_2048_PRIME, 16)
+	return signal + constants.DATA_SEPARATOR + p.String() + constants.DATA_SEPARATOR + g
+}
+
+// Runs both sides of the rekey, with the old keys of each side, and the
+// base secrets as each of them received them
+func rekey(t *testing.T, aliceKey []byte, bobKey []byte, aliceMessage string, bobMessage string) ([]byte, []byte, error) {
+	t.Helper()
+	aliceRekey, alicePublicSalt, err := StartRekey(aliceMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobRekey, bobPublicSalt, err := StartRekey(bobMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceSalt, err := aliceRekey.Sign(alicePublicSalt, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSalt, err := bobRekey.Sign(bobPublicSalt, bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceNewKey, err := aliceRekey.FinishSigned(bobSalt, aliceKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	bobNewKey, err := bobRekey.FinishSigned(aliceSalt, bobKey)
+	return aliceNewKey, bobNewKey, err
+}
+
+func TestSignedRekey(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	message := testSharedMessage(constants.REKEY, "2")
+	aliceKey, bobKey, err := rekey(t, oldKey, oldKey, message, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aliceKey, bobKey) {
+		t.Fatal("peers derived different keys")
+	}
+	if bytes.Equal(aliceKey, oldKey) {
+		t.Fatal("key isn't replaced")
+	}
+}
+
+func TestForgedRekey(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	message := testSharedMessage(constants.REKEY, "2")
+	// The party, which has only the ticket, doesn't know the old key
+	if _, _, err := rekey(t, oldKey, bytes.Repeat([]byte{2}, 32), message, message); !errors.Is(err, ErrRekeyForged) {
+		t.Fatalf("salt of the stranger is accepted: %v", err)
+	}
+	// The server can't give the peers different base secrets either
+	other := testSharedMessage(constants.REKEY, "5")
+	if _, _, err := rekey(t, oldKey, oldKey, message, other); !errors.Is(err, ErrRekeyForged) {
+		t.Fatalf("salt of other base secrets is accepted: %v", err)
+	}
+}
+
+// The base secrets, which the salts could be confined with, are refused
+func TestWeakBaseSecrets(t *testing.T) {
+	p, _ := new(big.Int).SetString(diffiehellman.MODP_2048_PRIME, 16)
+	// The neighbour of the safe prime isn't prime
+	notPrime := new(big.Int).Add(p, big.NewInt(2))
+	// The Mersenne prime 2^2203-1 is big enough, but its (p-1)/2 isn't prime
+	notSafe := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 2203), big.NewInt(1))
+	for name, message := range map[string]string{
+		"small":     constants.REKEY + ":23:5",
+		"not prime": constants.REKEY + constants.DATA_SEPARATOR + notPrime.String() + ":2",
+		"not safe":  constants.REKEY + constants.DATA_SEPARATOR + notSafe.String() + ":3",
+	} {
+		if _, _, err := StartRekey(message); !errors.Is(err, diffiehellman.ErrWeakPrime) {
+			t.Errorf("%s prime is accepted: %v", name, err)
+		}
+	}
+	for _, g := range []string{"0", "1", new(big.Int).Sub(p, big.NewInt(1)).String()} {
+		if _, _, err := StartRekey(testSharedMessage(constants.REKEY, g)); !errors.Is(err, diffiehellman.ErrInvalidGenerator) {
+			t.Errorf("generator %s is accepted: %v", g, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package gui
+
+import (
+	"net"
+	"strings"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/jroimartin/gocui"
+)
+
+const COMMAND_PREFIX = "/"
+
+// Commands of the chat input, which are addressed to the server, and so aren't encrypted
+var commandSignals = map[string]string{
+	"/contacts": constants.CONTACTS,
+	"/accept":   constants.CONTACT_ACCEPT,
+	"/block":    constants.CONTACT_BLOCK,
+}
+
+// Commands with a name argument
+var namedCommands = map[string]bool{
+	"/accept": true,
+	"/block":  true,
+}
+
+const COMMANDS_USAGE = "Commands: /contacts, /accept <name>, /block <name>"
+
+// Sends the command of the input to the server. The reply is shown by the
+// handler of the server messages, the errors are shown with the notice.
+func sendCommand(g *gocui.Gui, conn net.Conn, input string, notice func(*gocui.Gui, string)) {
+	fields := strings.Fields(input)
+	command := fields[0]
+	signal, ok := commandSignals[command]
+	expectedFields := 1
+	if namedCommands[command] {
+		expectedFields = 2
+	}
+	if !ok || len(fields) != expectedFields {
+		notice(g, COMMANDS_USAGE)
+		return
+	}
+	if namedCommands[command] {
+		signal += constants.DATA_SEPARATOR + fields[1]
+	}
+	if err := communication.SendMessage(conn, signal); err != nil {
+		notice(g, "The command wasn't sent: "+err.Error())
+	}
+}
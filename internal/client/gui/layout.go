@@ -2,23 +2,28 @@ package gui
 
 import (
 	"fmt"
-	"net"
+	"strings"
 	"sync"
 
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
 	"github.com/dikuropiatnyk/dh-chat/internal/constants"
-	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
 	"github.com/jroimartin/gocui"
 )
 
-func InitLayout(g *gocui.Gui) error {
+// Renders the views of the chat, whose input is edited with the editor
+func InitLayout(g *gocui.Gui, editor gocui.Editor) error {
 	// Render two views: one for the chat and one for the input
 	maxX, maxY := g.Size()
 	chatView, err := g.SetView(constants.CHAT_VIEWNAME, 0, 0, maxX-1, maxY-3)
 	if err != nil && err != gocui.ErrUnknownView {
 		return err
 	}
-	chatView.Title = "Chat"
-	chatView.Autoscroll = true
+	// The title is set only once, afterwards it displays the interlocutor's presence.
+	// The chat follows the new messages, unless it's scrolled up by the user.
+	if err == gocui.ErrUnknownView {
+		chatView.Title = "Chat"
+		chatView.Autoscroll = true
+	}
 	inputView, err := g.SetView(constants.INPUT_VIEWNAME, 0, maxY-3, maxX-1, maxY-1)
 	if err != nil && err != gocui.ErrUnknownView {
 		return err
@@ -26,48 +31,96 @@ func InitLayout(g *gocui.Gui) error {
 	inputView.Title = "Enter your message"
 	inputView.Editable = true
 	inputView.Wrap = true
-	if _, err := g.SetCurrentView(constants.INPUT_VIEWNAME); err != nil {
-		return err
+	// The input is focused at first, afterwards the focus is switched by the user
+	if err == gocui.ErrUnknownView {
+		inputView.Editor = editor
+		if _, err := g.SetCurrentView(constants.INPUT_VIEWNAME); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func exit(_ *gocui.Gui, _ *gocui.View, wg *sync.WaitGroup) error {
+func exit(_ *gocui.Gui, _ *gocui.View, chat *session.Session, wg *sync.WaitGroup) error {
 	defer wg.Done()
+	// The connection may be lost already, which doesn't matter on exit
+	_ = chat.Leave()
 	return gocui.ErrQuit
 }
 
-func sendMessage(g *gocui.Gui, v *gocui.View, conn net.Conn, clientName string, clientKey []byte) error {
+func sendMessage(g *gocui.Gui, v *gocui.View, chat *session.Session, transcript *Transcript, typing *Typing, clientName string) error {
 	// Get the message from the input view
-	message := v.Buffer()
+	message := strings.TrimSuffix(v.Buffer(), "\n")
 	v.Clear()
 	if err := v.SetCursor(0, 0); err != nil {
 		return err
 	}
-	// Display the message to the chat view
-	chatView, err := g.View(constants.CHAT_VIEWNAME)
-	if err != nil {
-		return err
+	if strings.HasPrefix(message, COMMAND_PREFIX) {
+		sendCommand(g, chat.Conn(), message, transcript.Notice)
+		return nil
+	}
+	// The message can't be encrypted, until the interlocutor returns
+	if _, err := chat.Key(); err != nil {
+		transcript.Notice(g, "The message wasn't sent: "+err.Error())
+		return nil
 	}
-	// Display client's name and the message with the specific color
-	fmt.Fprintf(chatView, "%s[%s] %s", constants.GREEN_COLOR, clientName, message)
+	typing.Sent()
+	// Display the message with its receipt, the ID is encrypted along with it
+	id := chat.NextMessageID()
+	transcript.Sent(g, id, fmt.Sprintf("%s[%s] %s", constants.GREEN_COLOR, clientName, message))
+	// The connection may be lost, which isn't a reason to close the GUI
+	if err := chat.SendEncrypted(constants.MESSAGE + constants.DATA_SEPARATOR + id + constants.DATA_SEPARATOR + message); err != nil {
+		transcript.Failed(g, id)
+		transcript.Notice(g, "The message wasn't sent: "+err.Error())
+	}
+	return nil
+}
 
-	// Send the message to the server
-	if err = communication.SendEncryptedMessage(conn, message, clientKey); err != nil {
+// Focuses the chat view, so the messages of the interlocutor are read
+func focusChat(g *gocui.Gui, chat *session.Session, transcript *Transcript) error {
+	if _, err := g.SetCurrentView(constants.CHAT_VIEWNAME); err != nil {
 		return err
 	}
-
+	read := transcript.Focus(true)
+	if len(read) == 0 {
+		return nil
+	}
+	if err := chat.SendControl(constants.MESSAGE_READ + constants.DATA_SEPARATOR + strings.Join(read, constants.ID_SEPARATOR)); err != nil {
+		transcript.Notice(g, "The read receipts weren't sent: "+err.Error())
+	}
 	return nil
 }
 
-func SetKeyBindings(g *gocui.Gui, conn net.Conn, wg *sync.WaitGroup, clientName string, clientKey []byte) error {
+// Focuses the input view, the messages received afterwards stay unread
+func focusInput(g *gocui.Gui, transcript *Transcript) error {
+	transcript.Focus(false)
+	_, err := g.SetCurrentView(constants.INPUT_VIEWNAME)
+	return err
+}
+
+// Scrolls the focused chat view, which follows the new messages again, once
+// it's scrolled to the bottom
+func scrollChat(v *gocui.View, delta int) error {
+	ox, oy := v.Origin()
+	_, height := v.Size()
+	oy += delta
+	if oy+height >= len(v.BufferLines()) {
+		v.Autoscroll = true
+		return nil
+	}
+	v.Autoscroll = false
+	return v.SetOrigin(ox, max(oy, 0))
+}
+
+// Binds the keys of the chat, the typing is nil, unless it's told to the interlocutor
+func SetKeyBindings(g *gocui.Gui, chat *session.Session, transcript *Transcript, typing *Typing, wg *sync.WaitGroup, clientName string) error {
 	// Default keybingding to exit the application
 
 	if err := g.SetKeybinding(
 		"",
 		gocui.KeyCtrlC,
 		gocui.ModNone,
-		func(g *gocui.Gui, v *gocui.View) error { return exit(g, v, wg) }); err != nil {
+		func(g *gocui.Gui, v *gocui.View) error { return exit(g, v, chat, wg) }); err != nil {
 		return err
 	}
 
@@ -76,20 +129,51 @@ func SetKeyBindings(g *gocui.Gui, conn net.Conn, wg *sync.WaitGroup, clientName
 		constants.INPUT_VIEWNAME,
 		gocui.KeyEnter,
 		gocui.ModNone,
-		func(g *gocui.Gui, v *gocui.View) error { return sendMessage(g, v, conn, clientName, clientKey) }); err != nil {
+		func(g *gocui.Gui, v *gocui.View) error {
+			return sendMessage(g, v, chat, transcript, typing, clientName)
+		}); err != nil {
 		return err
 	}
-	return nil
+
+	// Keybindings to switch the focus between the input and the chat
+	if err := g.SetKeybinding(
+		constants.INPUT_VIEWNAME,
+		gocui.KeyTab,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error { return focusChat(g, chat, transcript) }); err != nil {
+		return err
+	}
+	if err := g.SetKeybinding(
+		constants.CHAT_VIEWNAME,
+		gocui.KeyTab,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error { return focusInput(g, transcript) }); err != nil {
+		return err
+	}
+
+	// Keybindings to scroll the focused chat
+	if err := g.SetKeybinding(
+		constants.CHAT_VIEWNAME,
+		gocui.KeyArrowUp,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error { return scrollChat(v, -1) }); err != nil {
+		return err
+	}
+	return g.SetKeybinding(
+		constants.CHAT_VIEWNAME,
+		gocui.KeyArrowDown,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error { return scrollChat(v, 1) })
 }
 
-func UpdateChatView(g *gocui.Gui, message string, interlocutorName string) error {
+// Displays a notice, which isn't a part of any conversation
+func ShowNotice(g *gocui.Gui, notice string) {
 	g.Update(func(g *gocui.Gui) error {
 		chatView, err := g.View(constants.CHAT_VIEWNAME)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(chatView, "%s[%s] %s", constants.RED_COLOR, interlocutorName, message)
+		fmt.Fprintf(chatView, "%s* %s\n", constants.YELLOW_COLOR, notice)
 		return nil
 	})
-	return nil
 }
@@ -0,0 +1,212 @@
+package gui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/crypt"
+	"github.com/jroimartin/gocui"
+)
+
+const MULTIPLEX_USAGE = "Commands: /open <name>, /close, /contacts, /accept <name>, /block <name>. Tab switches the conversation"
+
+func InitMultiplexLayout(g *gocui.Gui) error {
+	// Render the list of conversations to the left of the chat and the input
+	maxX, maxY := g.Size()
+	sidebarView, err := g.SetView(constants.CONVERSATIONS_VIEWNAME, 0, 0, constants.SIDEBAR_WIDTH, maxY-1)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	sidebarView.Title = "Conversations"
+	chatView, err := g.SetView(constants.CHAT_VIEWNAME, constants.SIDEBAR_WIDTH+1, 0, maxX-1, maxY-3)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	// The title is set only once, afterwards it displays the current conversation
+	if err == gocui.ErrUnknownView {
+		chatView.Title = "Chat"
+	}
+	chatView.Autoscroll = true
+	inputView, err := g.SetView(constants.INPUT_VIEWNAME, constants.SIDEBAR_WIDTH+1, maxY-3, maxX-1, maxY-1)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	inputView.Title = "Enter your message"
+	inputView.Editable = true
+	inputView.Wrap = true
+	if _, err := g.SetCurrentView(constants.INPUT_VIEWNAME); err != nil {
+		return err
+	}
+	return nil
+}
+
+func SetMultiplexKeyBindings(g *gocui.Gui, mux *session.Multiplex, wg *sync.WaitGroup, clientName string) error {
+	if err := g.SetKeybinding(
+		"",
+		gocui.KeyCtrlC,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error {
+			defer wg.Done()
+			mux.Link().Close()
+			return gocui.ErrQuit
+		}); err != nil {
+		return err
+	}
+
+	// Keybinding to send the message to the current conversation
+	if err := g.SetKeybinding(
+		constants.INPUT_VIEWNAME,
+		gocui.KeyEnter,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error { return sendConversationMessage(g, v, mux, clientName) }); err != nil {
+		return err
+	}
+
+	// Keybinding to switch to the next conversation
+	return g.SetKeybinding(
+		constants.INPUT_VIEWNAME,
+		gocui.KeyTab,
+		gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error {
+			showHistory(g, mux, mux.Switch(1))
+			return nil
+		})
+}
+
+func sendConversationMessage(g *gocui.Gui, v *gocui.View, mux *session.Multiplex, clientName string) error {
+	message := v.Buffer()
+	v.Clear()
+	if err := v.SetCursor(0, 0); err != nil {
+		return err
+	}
+	if strings.HasPrefix(message, COMMAND_PREFIX) {
+		sendMultiplexCommand(g, mux, message)
+		return nil
+	}
+	peer := mux.Current()
+	if peer == "" {
+		ShowNotice(g, MULTIPLEX_USAGE)
+		return nil
+	}
+	// The message can't be encrypted, until the key of the conversation is agreed
+	key, err := mux.Key(peer)
+	if err != nil {
+		ShowNotice(g, "The message wasn't sent: "+err.Error())
+		return nil
+	}
+	stream, err := mux.Stream(peer)
+	if err != nil {
+		ShowNotice(g, "The message wasn't sent: "+err.Error())
+		return nil
+	}
+	encryptedMessage, err := crypt.EncryptMessage(message, key)
+	if err != nil {
+		return err
+	}
+	ShowConversationLine(g, mux, peer, fmt.Sprintf("%s[%s] %s", constants.GREEN_COLOR, clientName, message))
+	// The server relays the message on the stream of the conversation to the peer's one
+	if err = communication.SendMessage(stream, constants.CHAT_MESSAGE+constants.DATA_SEPARATOR+encryptedMessage); err != nil {
+		ShowNotice(g, "The message wasn't sent: "+err.Error())
+	}
+	return nil
+}
+
+// Opens and closes the conversations, the rest of the commands are the usual ones
+func sendMultiplexCommand(g *gocui.Gui, mux *session.Multiplex, input string) {
+	fields := strings.Fields(input)
+	var signal string
+	switch {
+	case fields[0] == "/open" && len(fields) == 2:
+		signal = constants.OPEN_CHAT + constants.DATA_SEPARATOR + fields[1]
+	case fields[0] == "/close" && len(fields) == 1 && mux.Current() != "":
+		// The peer learns the conversation is over, as soon as its stream is closed
+		mux.Close(mux.Current())
+		showHistory(g, mux, mux.Switch(0))
+		return
+	case commandSignals[fields[0]] != "":
+		sendCommand(g, mux.Conn(), input, ShowNotice)
+		return
+	default:
+		ShowNotice(g, MULTIPLEX_USAGE)
+		return
+	}
+	if err := communication.SendMessage(mux.Conn(), signal); err != nil {
+		ShowNotice(g, "The command wasn't sent: "+err.Error())
+	}
+}
+
+// Records the line of the conversation, which is displayed right away only
+// if the conversation is the current one
+func ShowConversationLine(g *gocui.Gui, mux *session.Multiplex, peer string, line string) {
+	current := mux.Record(peer, line)
+	g.Update(func(g *gocui.Gui) error {
+		if current {
+			chatView, err := g.View(constants.CHAT_VIEWNAME)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(chatView, line)
+		}
+		return renderConversations(g, mux)
+	})
+}
+
+// Displays the notice within the conversation
+func ShowConversationNotice(g *gocui.Gui, mux *session.Multiplex, peer string, notice string) {
+	ShowConversationLine(g, mux, peer, fmt.Sprintf("%s* %s\n", constants.YELLOW_COLOR, notice))
+}
+
+// Displays the conversations, which have been opened or closed
+func RefreshConversations(g *gocui.Gui, mux *session.Multiplex) {
+	showHistory(g, mux, mux.Switch(0))
+}
+
+// Replaces the chat view with the history of the current conversation
+func showHistory(g *gocui.Gui, mux *session.Multiplex, history []string) {
+	g.Update(func(g *gocui.Gui) error {
+		chatView, err := g.View(constants.CHAT_VIEWNAME)
+		if err != nil {
+			return err
+		}
+		chatView.Clear()
+		for _, line := range history {
+			fmt.Fprint(chatView, line)
+		}
+		return renderConversations(g, mux)
+	})
+}
+
+// Lists the conversations with their unread messages, and titles the chat
+// view with the current one
+func renderConversations(g *gocui.Gui, mux *session.Multiplex) error {
+	sidebarView, err := g.View(constants.CONVERSATIONS_VIEWNAME)
+	if err != nil {
+		return err
+	}
+	chatView, err := g.View(constants.CHAT_VIEWNAME)
+	if err != nil {
+		return err
+	}
+	sidebarView.Clear()
+	chatView.Title = "Chat"
+	for _, conversation := range mux.Conversations() {
+		marker := " "
+		if conversation.Current {
+			marker = ">"
+			chatView.Title = "Chat with " + conversation.Peer
+			if !conversation.Secured {
+				chatView.Title += " [securing]"
+			}
+		}
+		line := marker + " " + conversation.Peer
+		if conversation.Unread > 0 {
+			line += fmt.Sprintf(" (%d)", conversation.Unread)
+		}
+		fmt.Fprintln(sidebarView, line)
+	}
+	return nil
+}
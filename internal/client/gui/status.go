@@ -0,0 +1,79 @@
+package gui
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/jroimartin/gocui"
+)
+
+// Presence of the interlocutor, its typing and the latency of the connection,
+// displayed in the chat title
+type Presence struct {
+	interlocutor string
+	status       string
+	rtt          time.Duration
+	typing       bool
+	// Forgets the typing, whose stop may be lost along with the connection
+	typingExpiry *time.Timer
+	mut          sync.Mutex
+}
+
+func NewPresence(interlocutor string) *Presence {
+	return &Presence{interlocutor: interlocutor, status: constants.STATUS_ONLINE}
+}
+
+func (p *Presence) SetStatus(g *gocui.Gui, status string) {
+	p.mut.Lock()
+	p.status = status
+	p.mut.Unlock()
+	p.render(g)
+}
+
+func (p *Presence) SetRTT(g *gocui.Gui, rtt time.Duration) {
+	p.mut.Lock()
+	p.rtt = rtt
+	p.mut.Unlock()
+	p.render(g)
+}
+
+// SetTyping tells whether the interlocutor is typing. The typing expires,
+// unless it's told again in time.
+func (p *Presence) SetTyping(g *gocui.Gui, typing bool) {
+	p.mut.Lock()
+	if p.typingExpiry != nil {
+		p.typingExpiry.Stop()
+	}
+	p.typing = typing
+	if typing {
+		p.typingExpiry = time.AfterFunc(constants.TYPING_TIMEOUT*time.Second, func() { p.SetTyping(g, false) })
+	}
+	p.mut.Unlock()
+	p.render(g)
+}
+
+func (p *Presence) title() string {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	title := fmt.Sprintf("Chat with %s [%s]", p.interlocutor, p.status)
+	if p.rtt > 0 {
+		title += fmt.Sprintf(" RTT %s", p.rtt.Round(time.Millisecond))
+	}
+	if p.typing {
+		title += fmt.Sprintf(", %s is typing…", p.interlocutor)
+	}
+	return title
+}
+
+func (p *Presence) render(g *gocui.Gui) {
+	g.Update(func(g *gocui.Gui) error {
+		chatView, err := g.View(constants.CHAT_VIEWNAME)
+		if err != nil {
+			return err
+		}
+		chatView.Title = p.title()
+		return nil
+	})
+}
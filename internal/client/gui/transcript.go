@@ -0,0 +1,192 @@
+package gui
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/jroimartin/gocui"
+)
+
+// Receipt of the outgoing message, which only goes forward. The message,
+// which couldn't be sent, never gets the receipts.
+type Receipt int
+
+const (
+	RECEIPT_SENT Receipt = iota
+	RECEIPT_DELIVERED
+	RECEIPT_READ
+	RECEIPT_FAILED
+)
+
+type line struct {
+	text string
+	// ID of the outgoing message, empty for the rest of the lines
+	id      string
+	receipt Receipt
+}
+
+// Transcript is the content of the chat view: the messages, with the receipts
+// next to the outgoing ones, and the notices. The incoming messages are read,
+// once the chat view is focused.
+type Transcript struct {
+	lines []line
+	// Lines of the outgoing messages by their IDs
+	outgoing map[string]int
+	// IDs of the incoming messages, which haven't been read yet
+	unread  []string
+	focused bool
+	// Lines written to the chat view already
+	rendered int
+	// Some of the written lines have changed, so the view is redrawn
+	stale bool
+	mut   sync.Mutex
+}
+
+// The chat view, which the lines are written to
+type canvas interface {
+	io.Writer
+	Clear()
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{outgoing: make(map[string]int)}
+}
+
+// Sent displays the outgoing message, which waits for the receipts
+func (t *Transcript) Sent(g *gocui.Gui, id string, text string) {
+	t.sent(id, text)
+	t.render(g)
+}
+
+func (t *Transcript) sent(id string, text string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.outgoing[id] = len(t.lines)
+	t.lines = append(t.lines, line{text: text, id: id})
+}
+
+// Received displays the incoming message, and reports whether it's read right
+// away. Otherwise, it's read as soon as the chat view is focused.
+func (t *Transcript) Received(g *gocui.Gui, id string, text string) bool {
+	read := t.received(id, text)
+	t.render(g)
+	return read
+}
+
+func (t *Transcript) received(id string, text string) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.lines = append(t.lines, line{text: text})
+	if !t.focused {
+		t.unread = append(t.unread, id)
+	}
+	return t.focused
+}
+
+// Notice displays the notice, which isn't a part of the conversation
+func (t *Transcript) Notice(g *gocui.Gui, notice string) {
+	t.mut.Lock()
+	t.lines = append(t.lines, line{text: constants.YELLOW_COLOR + "* " + notice})
+	t.mut.Unlock()
+	t.render(g)
+}
+
+// Acknowledge marks the outgoing messages with the receipt of the interlocutor.
+// The unknown messages are ignored, as well as the outdated receipts.
+func (t *Transcript) Acknowledge(g *gocui.Gui, ids []string, acknowledged Receipt) {
+	if t.acknowledge(ids, acknowledged) {
+		t.render(g)
+	}
+}
+
+// Failed marks the outgoing message, which couldn't be sent
+func (t *Transcript) Failed(g *gocui.Gui, id string) {
+	if t.acknowledge([]string{id}, RECEIPT_FAILED) {
+		t.render(g)
+	}
+}
+
+// Marks the outgoing messages with the receipt, and reports whether any of
+// them has changed
+func (t *Transcript) acknowledge(ids []string, acknowledged Receipt) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	changed := false
+	for _, id := range ids {
+		if i, ok := t.outgoing[id]; ok && t.lines[i].receipt < acknowledged {
+			t.lines[i].receipt = acknowledged
+			changed = true
+			// The written line is redrawn, the rest is written with the receipt
+			t.stale = t.stale || i < t.rendered
+		}
+	}
+	return changed
+}
+
+// Focus tells whether the chat view is focused, and returns the IDs of the
+// messages, which are read on focusing
+func (t *Transcript) Focus(focused bool) []string {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.focused = focused
+	if !focused {
+		return nil
+	}
+	read := t.unread
+	t.unread = nil
+	return read
+}
+
+// ForgetUnread drops the unread messages of the interlocutor, who has left,
+// so the receipts aren't sent to the next one
+func (t *Transcript) ForgetUnread() {
+	t.mut.Lock()
+	t.unread = nil
+	t.mut.Unlock()
+}
+
+// Draws the chat view with the current lines. The updates of the GUI may be
+// applied in any order, so the lines are taken at the time of drawing.
+func (t *Transcript) render(g *gocui.Gui) {
+	g.Update(func(g *gocui.Gui) error {
+		chatView, err := g.View(constants.CHAT_VIEWNAME)
+		if err != nil {
+			return err
+		}
+		t.draw(chatView)
+		return nil
+	})
+}
+
+// Writes the new lines only, unless the written ones have changed, then the
+// whole view is redrawn
+func (t *Transcript) draw(view canvas) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.stale {
+		view.Clear()
+		t.rendered, t.stale = 0, false
+	}
+	for _, line := range t.lines[t.rendered:] {
+		fmt.Fprintln(view, line.text+line.mark())
+	}
+	t.rendered = len(t.lines)
+}
+
+func (l line) mark() string {
+	if l.id == "" {
+		return ""
+	}
+	switch l.receipt {
+	case RECEIPT_DELIVERED:
+		return " " + constants.MARK_DELIVERED
+	case RECEIPT_READ:
+		return " " + constants.BLUE_COLOR + constants.MARK_DELIVERED
+	case RECEIPT_FAILED:
+		return " " + constants.RED_COLOR + constants.MARK_FAILED
+	default:
+		return " " + constants.MARK_SENT
+	}
+}
@@ -0,0 +1,75 @@
+package gui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+)
+
+// Chat view, which records what's written to it
+type recordingCanvas struct {
+	written strings.Builder
+	clears  int
+}
+
+func (c *recordingCanvas) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *recordingCanvas) Clear() {
+	c.written.Reset()
+	c.clears++
+}
+
+func TestTranscriptAppendsLines(t *testing.T) {
+	transcript := NewTranscript()
+	view := &recordingCanvas{}
+	transcript.sent("1", "hello")
+	transcript.draw(view)
+	transcript.received("1", "hi")
+	transcript.draw(view)
+	// Nothing new, nothing is written
+	transcript.draw(view)
+	if view.clears != 0 {
+		t.Fatalf("view is cleared %d times for the new lines", view.clears)
+	}
+	if want := "hello " + constants.MARK_SENT + "\nhi\n"; view.written.String() != want {
+		t.Fatalf("view is %q", view.written.String())
+	}
+}
+
+func TestTranscriptRedrawsChangedReceipts(t *testing.T) {
+	transcript := NewTranscript()
+	view := &recordingCanvas{}
+	transcript.sent("1", "hello")
+	transcript.draw(view)
+	if !transcript.acknowledge([]string{"1"}, RECEIPT_DELIVERED) {
+		t.Fatal("receipt isn't applied")
+	}
+	// The outdated and the unknown receipts don't change anything
+	if transcript.acknowledge([]string{"1", "2"}, RECEIPT_SENT) {
+		t.Fatal("outdated receipt is applied")
+	}
+	transcript.draw(view)
+	if view.clears != 1 || view.written.String() != "hello "+constants.MARK_DELIVERED+"\n" {
+		t.Fatalf("view is %q after %d clears", view.written.String(), view.clears)
+	}
+}
+
+// The message, which couldn't be sent, is marked so, and no receipt changes it
+func TestTranscriptMarksFailedMessages(t *testing.T) {
+	transcript := NewTranscript()
+	view := &recordingCanvas{}
+	transcript.sent("1", "hello")
+	transcript.acknowledge([]string{"1"}, RECEIPT_FAILED)
+	transcript.acknowledge([]string{"1"}, RECEIPT_READ)
+	transcript.draw(view)
+	if want := "hello " + constants.RED_COLOR + constants.MARK_FAILED + "\n"; view.written.String() != want {
+		t.Fatalf("view is %q", view.written.String())
+	}
+	// The line is written with its mark, so the view isn't redrawn
+	if view.clears != 0 {
+		t.Fatalf("view is cleared %d times", view.clears)
+	}
+}
@@ -0,0 +1,139 @@
+package gui
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/jroimartin/gocui"
+)
+
+// Typing is the editor of the input, which tells the interlocutor, that the
+// user is typing. The start is repeated once per interval at most, and the
+// stop is sent after the interval without the keystrokes.
+type Typing struct {
+	chat *session.Session
+	// Signals are sent apart from the GUI loop, so the stalled connection
+	// doesn't freeze the input
+	signals   chan string
+	typing    bool
+	startedAt time.Time
+	typedAt   time.Time
+	idle      *time.Timer
+	closed    bool
+	mut       sync.Mutex
+}
+
+// NewTyping starts the sender of the typing signals, which runs until Close
+func NewTyping(chat *session.Session) *Typing {
+	t := &Typing{chat: chat, signals: make(chan string, constants.TYPING_QUEUE_SIZE)}
+	go t.sendSignals()
+	return t
+}
+
+// Edit passes the key to the default editor, and announces the typing, if the
+// input is changed. The emptied input isn't typed anymore.
+func (t *Typing) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	before := v.Buffer()
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+	after := v.Buffer()
+	switch {
+	case after == before:
+	case strings.TrimSpace(after) == "":
+		t.stop()
+	default:
+		t.keystroke()
+	}
+}
+
+func (t *Typing) keystroke() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.typedAt = time.Now()
+	if !t.typing || t.typedAt.Sub(t.startedAt) >= constants.TYPING_INTERVAL*time.Second {
+		t.typing, t.startedAt = true, t.typedAt
+		t.send(constants.TYPING_STARTED)
+	}
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	t.idle = time.AfterFunc(constants.TYPING_INTERVAL*time.Second, t.pause)
+}
+
+// Stops the typing, unless a keystroke has come, while the timer was firing
+func (t *Typing) pause() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if time.Since(t.typedAt) >= constants.TYPING_INTERVAL*time.Second {
+		t.stopLocked()
+	}
+}
+
+func (t *Typing) stop() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.stopLocked()
+}
+
+func (t *Typing) stopLocked() {
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	if t.typing {
+		t.typing = false
+		t.send(constants.TYPING_STOPPED)
+	}
+}
+
+// Sent forgets the typing, which the sent message ends for the interlocutor
+func (t *Typing) Sent() {
+	if t == nil {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	t.typing = false
+}
+
+// Close stops the sender of the typing signals, once the chat ends. The
+// queued signals are still sent, and the further ones are dropped.
+func (t *Typing) Close() {
+	if t == nil {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	if !t.closed {
+		t.closed = true
+		close(t.signals)
+	}
+}
+
+// Queues the signal to be sent. The typing is just a hint, which expires on
+// the receiving side anyway, so the signal is dropped, when the queue is full.
+// The caller holds the lock.
+func (t *Typing) send(signal string) {
+	if t.closed {
+		return
+	}
+	select {
+	case t.signals <- signal:
+	default:
+	}
+}
+
+// Sends the queued signals in order. The typing isn't sent without the
+// interlocutor, and the failures are ignored.
+func (t *Typing) sendSignals() {
+	for signal := range t.signals {
+		_ = t.chat.SendControl(signal)
+	}
+}
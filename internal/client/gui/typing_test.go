@@ -0,0 +1,76 @@
+package gui
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// The stalled connection doesn't block the typing, the signals over the
+// queue are dropped, and the queued ones are sent afterwards
+func TestTypingDoesntBlockOnStalledConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	typing := NewTyping(session.New(client, bytes.Repeat([]byte{1}, 32)))
+	const bursts = constants.TYPING_QUEUE_SIZE + 5
+	typed := make(chan struct{})
+	go func() {
+		// Every burst starts and stops the typing, nobody reads them meanwhile
+		for range bursts {
+			typing.keystroke()
+			typing.stop()
+		}
+		close(typed)
+	}()
+	select {
+	case <-typed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("typing is blocked by the connection")
+	}
+
+	// The queue is full, and the sender may hold one more signal
+	sent := 0
+	for {
+		_ = server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		message, err := communication.ReadMessage(server, make([]byte, constants.BUFFER_SIZE))
+		if err != nil {
+			break
+		}
+		if signal, _ := communication.ParseSignal(message, constants.DATA_SEPARATOR); signal != constants.CHAT_CONTROL {
+			t.Fatalf("typing is sent as %s", signal)
+		}
+		sent++
+	}
+	if sent < constants.TYPING_QUEUE_SIZE || sent > constants.TYPING_QUEUE_SIZE+1 {
+		t.Fatalf("%d of %d signals are sent", sent, 2*bursts)
+	}
+}
+
+// The queued signals are sent after the chat ends, and the typing afterwards
+// is dropped instead of being sent to the closed queue
+func TestTypingIsClosedWithChat(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	typing := NewTyping(session.New(client, bytes.Repeat([]byte{1}, 32)))
+	typing.keystroke()
+	typing.Close()
+	typing.Close()
+	typing.keystroke()
+	typing.stop()
+
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := communication.ReadMessage(server, make([]byte, constants.BUFFER_SIZE)); err != nil {
+		t.Fatalf("queued typing isn't sent: %v", err)
+	}
+	_ = server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := communication.ReadMessage(server, make([]byte, constants.BUFFER_SIZE)); err == nil {
+		t.Fatal("typing is sent after the chat ended")
+	}
+}
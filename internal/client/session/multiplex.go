@@ -0,0 +1,205 @@
+package session
+
+import (
+	"net"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// Conversation is one of the chats of the multiplexed session, with its own
+// stream and key
+type Conversation struct {
+	Peer    string
+	stream  net.Conn
+	key     []byte
+	history []string
+	unread  int
+}
+
+// ConversationInfo describes the conversation for the list of conversations
+type ConversationInfo struct {
+	Peer    string
+	Unread  int
+	Current bool
+	Secured bool
+}
+
+// Multiplex is the connection, which carries many conversations at once, and
+// the conversation currently shown. The commands are sent via its control
+// stream.
+type Multiplex struct {
+	link          *communication.Multiplexer
+	control       net.Conn
+	conversations map[string]*Conversation
+	// Conversations in the order they were opened
+	order   []string
+	current string
+	mut     sync.RWMutex
+}
+
+func NewMultiplex(link *communication.Multiplexer, control net.Conn) *Multiplex {
+	return &Multiplex{link: link, control: control, conversations: make(map[string]*Conversation)}
+}
+
+// Conn returns the control stream
+func (m *Multiplex) Conn() net.Conn {
+	return m.control
+}
+
+func (m *Multiplex) Link() *communication.Multiplexer {
+	return m.link
+}
+
+// Open adds the conversation with the peer on its stream, which is secured as
+// soon as its key is set. The first conversation becomes the current one.
+// Reports whether the conversation is new.
+func (m *Multiplex) Open(peer string, stream net.Conn) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.conversations[peer]; ok {
+		return false
+	}
+	m.conversations[peer] = &Conversation{Peer: peer, stream: stream}
+	m.order = append(m.order, peer)
+	if m.current == "" {
+		m.current = peer
+	}
+	return true
+}
+
+// Close closes the stream of the conversation, and forgets it
+func (m *Multiplex) Close(peer string) {
+	m.mut.Lock()
+	conversation, ok := m.conversations[peer]
+	if ok {
+		m.forget(peer)
+	}
+	m.mut.Unlock()
+	if ok {
+		conversation.stream.Close()
+	}
+}
+
+// Ended forgets the conversation, whose stream is over, and reports whether
+// it was still open
+func (m *Multiplex) Ended(peer string, stream net.Conn) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	conversation, ok := m.conversations[peer]
+	if !ok || conversation.stream != stream {
+		return false
+	}
+	m.forget(peer)
+	return true
+}
+
+// Forgets the conversation, the next one becomes the current one
+func (m *Multiplex) forget(peer string) {
+	delete(m.conversations, peer)
+	for i, name := range m.order {
+		if name == peer {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	if m.current == peer {
+		m.current = ""
+		if len(m.order) > 0 {
+			m.current = m.order[0]
+			m.conversations[m.current].unread = 0
+		}
+	}
+}
+
+func (m *Multiplex) SetKey(peer string, key []byte) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if conversation, ok := m.conversations[peer]; ok {
+		conversation.key = key
+	}
+}
+
+// Stream returns the stream of the conversation
+func (m *Multiplex) Stream(peer string) (net.Conn, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	conversation, ok := m.conversations[peer]
+	if !ok {
+		return nil, ErrNoInterlocutor
+	}
+	return conversation.stream, nil
+}
+
+// Key returns the key of the conversation, or an error if it isn't secured yet
+func (m *Multiplex) Key(peer string) ([]byte, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	conversation, ok := m.conversations[peer]
+	if !ok || conversation.key == nil {
+		return nil, ErrNoInterlocutor
+	}
+	return conversation.key, nil
+}
+
+// Record appends the line to the history of the conversation, and reports
+// whether it's the current one. The lines of the others are counted as unread.
+func (m *Multiplex) Record(peer string, line string) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	conversation, ok := m.conversations[peer]
+	if !ok {
+		return false
+	}
+	conversation.history = append(conversation.history, line)
+	if peer != m.current {
+		conversation.unread++
+		return false
+	}
+	return true
+}
+
+func (m *Multiplex) Current() string {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.current
+}
+
+// Switch makes the conversation by the offset from the current one the
+// current one, and returns its history
+func (m *Multiplex) Switch(offset int) []string {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if len(m.order) == 0 {
+		return nil
+	}
+	index := 0
+	for i, name := range m.order {
+		if name == m.current {
+			index = i
+			break
+		}
+	}
+	index = ((index+offset)%len(m.order) + len(m.order)) % len(m.order)
+	m.current = m.order[index]
+	conversation := m.conversations[m.current]
+	conversation.unread = 0
+	return append([]string(nil), conversation.history...)
+}
+
+// Conversations lists the conversations in the order they were opened
+func (m *Multiplex) Conversations() []ConversationInfo {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	infos := make([]ConversationInfo, 0, len(m.order))
+	for _, name := range m.order {
+		conversation := m.conversations[name]
+		infos = append(infos, ConversationInfo{
+			Peer:    name,
+			Unread:  conversation.unread,
+			Current: name == m.current,
+			Secured: conversation.key != nil,
+		})
+	}
+	return infos
+}
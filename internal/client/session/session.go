@@ -0,0 +1,153 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/crypt"
+)
+
+var ErrNoInterlocutor = errors.New("interlocutor isn't in the chat")
+
+// Session is the connection and the key of the current chat. Both are
+// replaced, when the chat is re-established with the returning interlocutor.
+type Session struct {
+	conn net.Conn
+	key  []byte
+	// The key before the rekey, the messages encrypted with it may still be in flight
+	previousKey []byte
+	// Ticket to resume the chat on a new connection, issued by the server
+	ticket string
+	left   bool
+	// Last ID of the sent messages, the receipts refer to them
+	lastID atomic.Uint64
+	mut    sync.RWMutex
+}
+
+func New(conn net.Conn, key []byte) *Session {
+	return &Session{conn: conn, key: key}
+}
+
+func (s *Session) Conn() net.Conn {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.conn
+}
+
+// Key returns the key of the chat, or an error if the interlocutor has left
+func (s *Session) Key() ([]byte, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	if s.key == nil {
+		return nil, ErrNoInterlocutor
+	}
+	return s.key, nil
+}
+
+// Suspend forgets the key of the chat, which the interlocutor has left
+func (s *Session) Suspend() {
+	s.mut.Lock()
+	s.key = nil
+	s.mut.Unlock()
+}
+
+// Resume replaces the connection and the key with the re-established ones
+func (s *Session) Resume(conn net.Conn, key []byte) {
+	s.mut.Lock()
+	s.conn, s.key, s.previousKey = conn, key, nil
+	s.mut.Unlock()
+}
+
+// Reconnect replaces the lost connection. The key is kept until the rekey.
+func (s *Session) Reconnect(conn net.Conn) {
+	s.mut.Lock()
+	s.conn = conn
+	s.mut.Unlock()
+}
+
+// Rekey replaces the key, keeping the previous one for the messages in flight
+func (s *Session) Rekey(key []byte) {
+	s.mut.Lock()
+	s.previousKey, s.key = s.key, key
+	s.mut.Unlock()
+}
+
+// PreviousKey returns the key before the last rekey, if any
+func (s *Session) PreviousKey() []byte {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.previousKey
+}
+
+func (s *Session) Ticket() string {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.ticket
+}
+
+func (s *Session) SetTicket(ticket string) {
+	s.mut.Lock()
+	s.ticket = ticket
+	s.mut.Unlock()
+}
+
+// NextMessageID returns the ID of the next sent message, unique within the session
+func (s *Session) NextMessageID() string {
+	return strconv.FormatUint(s.lastID.Add(1), 10)
+}
+
+// SendEncrypted encrypts the message with the key of the chat, and sends it
+// to be relayed to the interlocutor
+func (s *Session) SendEncrypted(message string) error {
+	encryptedMessage, err := s.encrypt(message)
+	if err != nil {
+		return err
+	}
+	return communication.SendMessage(s.Conn(), constants.CHAT_MESSAGE+constants.DATA_SEPARATOR+encryptedMessage)
+}
+
+// SendControl encrypts the control message, e.g. the receipt, and sends it
+// apart from the conversation. The message over the size limit is sent as
+// the chat message instead.
+func (s *Session) SendControl(message string) error {
+	encryptedMessage, err := s.encrypt(message)
+	if err != nil {
+		return err
+	}
+	control := constants.CHAT_CONTROL + constants.DATA_SEPARATOR + encryptedMessage
+	if len(control) > constants.MAX_CONTROL_SIZE {
+		control = constants.CHAT_MESSAGE + constants.DATA_SEPARATOR + encryptedMessage
+	}
+	return communication.SendMessage(s.Conn(), control)
+}
+
+func (s *Session) encrypt(message string) (string, error) {
+	key, err := s.Key()
+	if err != nil {
+		return "", err
+	}
+	return crypt.EncryptMessage(message, key)
+}
+
+// Leave tells the server the chat is over for good, and closes the connection
+func (s *Session) Leave() error {
+	s.mut.Lock()
+	s.left = true
+	conn := s.conn
+	s.mut.Unlock()
+	err := communication.SendMessage(conn, constants.LEAVE)
+	conn.Close()
+	return err
+}
+
+// Left reports whether the user has left the chat, so its connection isn't resumed
+func (s *Session) Left() bool {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.left
+}
@@ -0,0 +1,35 @@
+package session
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// The receipts go apart from the conversation, unless they are too long
+func TestSendControl(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	chat := New(client, bytes.Repeat([]byte{1}, 32))
+	for _, test := range []struct {
+		message string
+		signal  string
+	}{
+		{constants.MESSAGE_READ + ":1", constants.CHAT_CONTROL},
+		{constants.MESSAGE_READ + ":" + strings.Repeat("1,", constants.MAX_CONTROL_SIZE), constants.CHAT_MESSAGE},
+	} {
+		go chat.SendControl(test.message)
+		message, err := communication.ReadMessage(server, make([]byte, constants.BUFFER_SIZE))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signal, _ := communication.ParseSignal(message, constants.DATA_SEPARATOR); signal != test.signal {
+			t.Fatalf("%d bytes are sent as %s", len(test.message), signal)
+		}
+	}
+}
@@ -2,121 +2,441 @@ package types
 
 import (
 	"bufio"
-	"log"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log/slog"
 	"net"
 	"os"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/dikuropiatnyk/dh-chat/internal/client/actions"
 	"github.com/dikuropiatnyk/dh-chat/internal/client/gui"
+	"github.com/dikuropiatnyk/dh-chat/internal/client/session"
 	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/internal/logging"
 	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
 	"github.com/jroimartin/gocui"
 )
 
+// Config of the client, usually taken from the command line flags
+type Config struct {
+	ServerAddress string
+	// Wait for the interlocutor to return, instead of ending the chat
+	WaitForPeer bool
+	// Resume the chat on a new connection, when the current one is lost
+	Reconnect bool
+	// File of the identity key, which proves the ownership of the name
+	IdentityPath string
+	// Show the presence to the contacts, while waiting in the lobby
+	Visible bool
+	// Chat with many interlocutors at once over one connection
+	Multiplex bool
+	// Chat directly without the server, listening for the peer on the address
+	ListenAddress string
+	// Chat directly without the server, connecting to the peer on the address
+	PeerAddress string
+	// Announce the name and the identity on the local network
+	Discoverable bool
+	// Pick the interlocutor among the peers announced on the local network
+	Discover bool
+	// Tell the interlocutor, while the message is typed
+	Typing bool
+}
+
+func DefaultConfig() Config {
+	return Config{ServerAddress: constants.SERVER_ADDRESS, Reconnect: true, Typing: true, IdentityPath: identity.DefaultPath()}
+}
+
 type DHClient struct {
 	clientAddress net.Addr
 	serverAddress net.Addr
 	key           []byte
+	identity      ed25519.PrivateKey
+	config        Config
+	logger        *slog.Logger
+}
+
+func NewDHClient(config Config, logger *slog.Logger) *DHClient {
+	return &DHClient{config: config, logger: logger}
+}
+
+// Logs the error and terminates the client
+func (c *DHClient) fatal(message string, args ...any) {
+	c.logger.Error(message, args...)
+	os.Exit(1)
 }
 
 func (c *DHClient) Connect() (net.Conn, error) {
-	conn, err := net.Dial(constants.SERVER_CONNECTION_TYPE, constants.SERVER_ADDRESS)
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Info("Connected to the server", "address", c.serverAddress.String())
+	return conn, nil
+}
+
+func (c *DHClient) dial() (net.Conn, error) {
+	// The transport is chosen by the scheme of the address, TCP by default
+	rawConn, err := transport.Dial(c.config.ServerAddress)
 	if err != nil {
 		return nil, err
 	}
+	// Until the chat is established, the server must answer at least once per
+	// the interlocutor waiting time
+	conn := communication.NewTimedConn(rawConn, communication.Timeouts{
+		Handshake: (constants.INTERLOCUTOR_WAIT_TIME + constants.HANDSHAKE_TIMEOUT) * time.Second,
+		Write:     constants.WRITE_TIMEOUT * time.Second,
+	})
 	c.clientAddress = conn.LocalAddr()
 	c.serverAddress = conn.RemoteAddr()
-	log.Println("Connected to", c.serverAddress)
 	return conn, nil
 }
 
+// The server pings the established chat regularly, so the long silence means it's gone
+func established(conn net.Conn) {
+	if timedConn, ok := conn.(*communication.TimedConn); ok {
+		timedConn.SetReadTimeout(constants.HEARTBEAT_TIMEOUT * time.Second)
+	}
+}
+
 // Main function, where client makes all interactions with the server via an established connection
 func (c *DHClient) Interact(conn net.Conn) {
-	defer conn.Close()
-
 	reader := bufio.NewReader(os.Stdin)
 
 	// Read user input and send it to the server
 	clientName, err := communication.GetInput("Enter your name: ", reader)
 	if err != nil {
-		log.Fatalln("Couldn't read the name:", err)
+		c.fatal("Couldn't read the name", "error", err)
+	}
+	if c.config.Multiplex {
+		c.loadIdentity()
+		c.interactMultiplexed(conn, clientName)
+		return
 	}
-	interlocutorName, err := communication.GetInput("Enter interlocutor's name: ", reader)
+	interlocutorName, err := communication.GetInput("Enter interlocutor's name (empty to wait in the lobby): ", reader)
 	if err != nil {
-		log.Fatalln("Couldn't read the interlocutor's name:", err)
+		c.fatal("Couldn't read the interlocutor's name", "error", err)
 	}
-	// Concatenate the user name and the interlocutor's name
-	if err = communication.SendMessage(conn, clientName+constants.DATA_SEPARATOR+interlocutorName); err != nil {
-		log.Fatalln("Couldn't send the user info:", err)
+	c.loadIdentity()
+	if c.config.Discoverable {
+		c.announce(context.Background(), clientName, "")
 	}
+	c.join(conn, clientName, interlocutorName)
+}
 
+// Joins the chat with the interlocutor via the server, or waits in the lobby
+// for one, if the name is empty
+func (c *DHClient) join(conn net.Conn, clientName string, interlocutorName string) {
+	var err error
 	buffer := make([]byte, constants.BUFFER_SIZE)
-	// First reading from the connection to get the user name and the interlocutor
-	serverResponse, err := communication.ReadMessage(conn, buffer)
+	// The interlocutor is agreed in the lobby, then the chat is joined on a new connection
+	if interlocutorName == "" {
+		interlocutorName, err = actions.Lobby(conn, buffer, c.identity, clientName, c.config.Visible, os.Stdin, c.logger.With("client", clientName))
+		conn.Close()
+		if err != nil {
+			c.refused(err, c.logger)
+			return
+		}
+		if conn, err = c.dial(); err != nil {
+			c.fatal("Couldn't connect to the server", "error", err)
+		}
+	}
+	logger := c.logger.With("client", clientName, "interlocutor", interlocutorName)
+
+	derivedKey, err := actions.JoinChat(conn, buffer, c.identity, clientName, interlocutorName, logger)
 	if err != nil {
-		log.Fatalln("Couldn't get a user info:", err)
+		conn.Close()
+		c.refused(err, logger)
+		return
 	}
+	c.key = derivedKey
 
-	switch {
-	case strings.HasPrefix(serverResponse, constants.CLIENT_EXISTS):
-		log.Fatalln("Client already exists! Exiting...")
+	var rejoin actions.Rejoin
+	if c.config.WaitForPeer {
+		rejoin = func() (net.Conn, []byte, error) { return c.rejoin(clientName, interlocutorName, buffer) }
+	}
+	var reconnect actions.Reconnect
+	if c.config.Reconnect {
+		reconnect = func(ticket string) (net.Conn, error) { return c.reconnect(clientName, ticket, buffer) }
+	}
+	c.chat(conn, buffer, clientName, interlocutorName, rejoin, reconnect, false, logger)
+}
+
+// Runs the GUI of the established chat until the user leaves
+func (c *DHClient) chat(conn net.Conn, buffer []byte, clientName string, interlocutorName string, rejoin actions.Rejoin, reconnect actions.Reconnect, direct bool, logger *slog.Logger) {
+	chat := session.New(conn, c.key)
+	// The connection is replaced, if the chat is re-established
+	defer func() { chat.Conn().Close() }()
+
+	logger.Info("Let the chat begin!")
+	established(conn)
+
+	g, err := gocui.NewGui(gocui.OutputNormal)
+	if err != nil {
+		c.fatal("Couldn't initialize the GUI", "error", err)
+	}
+	defer g.Close()
+	g.Cursor = true
+	// The frame of the focused view is highlighted, since focusing the chat reads it
+	g.Highlight = true
+	g.SelFgColor = gocui.ColorGreen
+
+	// The input tells the interlocutor about the typing, unless it's opted out
+	var typing *gui.Typing
+	var editor gocui.Editor = gocui.DefaultEditor
+	if c.config.Typing {
+		typing = gui.NewTyping(chat)
+		defer typing.Close()
+		editor = typing
+	}
+	g.SetManagerFunc(func(g *gocui.Gui) error { return gui.InitLayout(g, editor) })
+
+	transcript := gui.NewTranscript()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	// Set the keybindings
+	if err = gui.SetKeyBindings(g, chat, transcript, typing, &wg, clientName); err != nil {
+		c.fatal("Couldn't set the keybindings", "error", err)
+	}
+
+	presence := gui.NewPresence(interlocutorName)
+	presence.SetStatus(g, constants.STATUS_ONLINE)
+	// The direct peer isn't a server, so it can't send the server's signals
+	if direct {
+		go actions.HandleDirectPeer(chat, buffer, g, interlocutorName, presence, transcript, logger)
+	} else {
+		go actions.HandleServerResponse(chat, buffer, g, interlocutorName, presence, transcript, rejoin, reconnect, logger)
+	}
+	go actions.SendHeartbeats(chat, constants.HEARTBEAT_INTERVAL*time.Second, logger)
+
+	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
+		c.fatal("GUI error", "error", err)
+	}
+	wg.Wait()
+}
 
-	case strings.HasPrefix(serverResponse, constants.INTERLOCUTOR_FOUND):
-		log.Println("Interlocutor found! Start chatting...")
-		derivedKey, err := actions.Handshake(conn, buffer, reader, serverResponse)
+// Chats with the peer directly, without the server. The client either
+// listens for the peer, or dials the listening one.
+func (c *DHClient) InteractDirect() {
+	reader := bufio.NewReader(os.Stdin)
+	clientName, err := communication.GetInput("Enter your name: ", reader)
+	if err != nil {
+		c.fatal("Couldn't read the name", "error", err)
+	}
+	c.loadIdentity()
+	c.direct(clientName, "")
+}
+
+// Establishes the direct chat with the peer. Unless the expected fingerprint
+// is empty, the peer must prove the identity of this fingerprint.
+func (c *DHClient) direct(clientName string, expectedFingerprint string) {
+	logger := c.logger.With("client", clientName)
+
+	var rawConn net.Conn
+	var err error
+	if c.config.ListenAddress != "" {
+		listener, err := transport.Listen(c.config.ListenAddress)
 		if err != nil {
-			log.Fatalln("Couldn't shake hands with the interlocutor:", err)
+			c.fatal("Couldn't listen for the peer", "address", c.config.ListenAddress, "error", err)
 		}
-		c.key = derivedKey
-
-	case strings.HasPrefix(serverResponse, constants.NO_INTERLOCUTOR):
-		log.Println("No interlocutor found! Wait, please...")
-		serverUpdate, err := communication.ReadMessage(conn, buffer)
+		logger.Info("Waiting for the peer to connect...", "address", listener.Addr().String())
+		// The address is announced only while the listener waits for the peer
+		announcing, stopAnnouncing := context.WithCancel(context.Background())
+		if c.config.Discoverable {
+			if address := announcedAddress(c.config.ListenAddress, listener); address != "" {
+				c.announce(announcing, clientName, address)
+			} else {
+				logger.Warn("The listener can't be reached from the network, so it isn't announced")
+			}
+		}
+		// Only one peer is expected, so nobody else may connect afterwards
+		rawConn, err = listener.Accept()
+		stopAnnouncing()
+		listener.Close()
 		if err != nil {
-			log.Fatalln("Couldn't get a user info:", err)
+			c.fatal("Couldn't accept the peer", "error", err)
 		}
+	} else if rawConn, err = transport.Dial(c.config.PeerAddress); err != nil {
+		c.fatal("Couldn't connect to the peer", "address", c.config.PeerAddress, "error", err)
+	}
+	conn := communication.NewTimedConn(rawConn, communication.Timeouts{
+		Handshake: constants.HANDSHAKE_TIMEOUT * time.Second,
+		Write:     constants.WRITE_TIMEOUT * time.Second,
+	})
+	logger.Info("Connected to the peer", "address", conn.RemoteAddr().String())
 
-		switch {
-		case strings.HasPrefix(serverUpdate, constants.INTERLOCUTOR_FOUND):
-			log.Println("Interlocutor found! Start chatting...")
-			derivedKey, err := actions.Handshake(conn, buffer, reader, serverUpdate)
-			if err != nil {
-				log.Fatalln("Couldn't shake hands with the interlocutor:", err)
-			}
-			c.key = derivedKey
-		case strings.HasPrefix(serverUpdate, constants.INTERLOCUTOR_WAIT_TIMEOUT):
-			log.Println("Interlocutor didn't show up! Exiting...")
-			return
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	var peer actions.DirectPeer
+	if c.config.ListenAddress != "" {
+		peer, c.key, err = actions.ListenDirect(conn, buffer, c.identity, clientName, diffiehellman.GenerateBaseSecrets, logger)
+	} else {
+		peer, c.key, err = actions.DialDirect(conn, buffer, c.identity, clientName, logger)
+	}
+	if err != nil {
+		conn.Close()
+		c.fatal("Couldn't establish the direct chat", "error", err)
+	}
+	// The announcement isn't signed, so the handshake is what proves the identity
+	if expectedFingerprint != "" && peer.Fingerprint != expectedFingerprint {
+		conn.Close()
+		c.fatal("The peer's identity doesn't match its announcement", "announced", expectedFingerprint, "fingerprint", peer.Fingerprint)
+	}
+	// Nobody vouches for the name of the peer, so its fingerprint is the proof
+	logger.Info("Compare the peer's fingerprint out of band", "interlocutor", peer.Name, "fingerprint", peer.Fingerprint)
+	// The peer can't be waited for or resumed, since nobody keeps the chat
+	c.chat(conn, buffer, clientName, peer.Name, nil, nil, true, logger.With("interlocutor", peer.Name))
+}
 
-		default:
-			log.Fatalln("Unknown server response! Exiting...")
-		}
+func (c *DHClient) loadIdentity() {
+	var err error
+	if c.identity, err = identity.Load(c.config.IdentityPath); err != nil {
+		c.fatal("Couldn't load the identity", "path", c.config.IdentityPath, "error", err)
 	}
+	c.logger.Info("Identity is loaded", "fingerprint", identity.Fingerprint(c.identity.Public().(ed25519.PublicKey)))
+}
 
-	log.Println("Let the chat begin!")
+// Chats with many interlocutors at once, each conversation is opened from the GUI
+func (c *DHClient) interactMultiplexed(conn net.Conn, clientName string) {
+	logger := c.logger.With("client", clientName)
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	if err := actions.JoinMultiplex(conn, buffer, c.identity, clientName); err != nil {
+		conn.Close()
+		c.refused(err, logger)
+		return
+	}
+	defer conn.Close()
+	established(conn)
+	// The session is multiplexed from now on, the first stream is the control one
+	link := communication.NewMultiplexer(conn, true)
+	defer link.Close()
+	control, err := link.Open()
+	if err != nil {
+		c.fatal("Couldn't open the control stream", "error", err)
+	}
+	mux := session.NewMultiplex(link, control)
+	logger.Info("The multiplexed session is open, type /open <name> to chat")
 
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
-		log.Fatalln(err)
+		c.fatal("Couldn't initialize the GUI", "error", err)
 	}
 	defer g.Close()
 	g.Cursor = true
 
-	g.SetManagerFunc(gui.InitLayout)
+	g.SetManagerFunc(gui.InitMultiplexLayout)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	// Set the keybindings
-	if err = gui.SetKeyBindings(g, conn, &wg, clientName, c.key); err != nil {
-		log.Fatalln(err)
+	if err = gui.SetMultiplexKeyBindings(g, mux, &wg, clientName); err != nil {
+		c.fatal("Couldn't set the keybindings", "error", err)
 	}
-
-	go actions.HandleServerResponse(conn, buffer, g, interlocutorName, c.key)
+	gui.ShowNotice(g, gui.MULTIPLEX_USAGE)
+	go actions.HandleMultiplex(mux, buffer, g, logger)
+	go actions.SendHeartbeats(mux, constants.HEARTBEAT_INTERVAL*time.Second, logger)
 
 	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
-		log.Fatalln(err)
+		c.fatal("GUI error", "error", err)
 	}
 	wg.Wait()
 }
+
+// Explains why the server refused to establish the chat
+func (c *DHClient) refused(err error, logger *slog.Logger) {
+	switch {
+	case errors.Is(err, actions.ErrClientExists):
+		c.fatal("Client already exists! Exiting...")
+	case errors.Is(err, actions.ErrInterlocutorTimeout):
+		logger.Info("Interlocutor didn't show up! Exiting...")
+	case errors.Is(err, actions.ErrServerShutdown):
+		logger.Info("Server is shutting down! Exiting...")
+	case errors.Is(err, actions.ErrServerMaintenance):
+		logger.Info("Server is under maintenance, try again later! Exiting...")
+	case errors.Is(err, actions.ErrTooManyConnections):
+		logger.Info("Server has too many connections, try again later! Exiting...")
+	case errors.Is(err, actions.ErrRateLimited):
+		logger.Info("Too many attempts to connect, try again later! Exiting...")
+	case errors.Is(err, actions.ErrServerUnreachable):
+		logger.Info("Interlocutor's server is unreachable, try again later! Exiting...")
+	case errors.Is(err, actions.ErrClientKicked):
+		logger.Info("You have been disconnected by the server admin! Exiting...")
+	case errors.Is(err, actions.ErrMalformedLogin), errors.Is(err, actions.ErrNameRequired),
+		errors.Is(err, actions.ErrNameTooLong), errors.Is(err, actions.ErrInvalidName),
+		errors.Is(err, actions.ErrReservedName), errors.Is(err, actions.ErrUnknownServer):
+		logger.Info("The server refused the names! Exiting...", "reason", err)
+	case errors.Is(err, actions.ErrAuthFailed), errors.Is(err, actions.ErrUnknownAccount):
+		logger.Info("The server refused the identity! Exiting...", "reason", err)
+	case errors.Is(err, actions.ErrContactRequested):
+		logger.Info("Contact request is sent! The chat is possible once it's accepted. Exiting...")
+	case errors.Is(err, actions.ErrLobbyLeft):
+		logger.Info("You left the lobby! Exiting...")
+	case errors.Is(err, actions.ErrUnknownResponse):
+		c.fatal("Unknown server response! Exiting...")
+	default:
+		c.fatal("Couldn't join the chat", "error", err)
+	}
+}
+
+// Joins the chat again on a new connection, waiting for the interlocutor as
+// long as it takes. The GUI is running, so nothing is logged to the terminal.
+func (c *DHClient) rejoin(clientName string, interlocutorName string, buffer []byte) (net.Conn, []byte, error) {
+	quietLogger := logging.Discard()
+	for {
+		conn, err := c.dial()
+		if err != nil {
+			quietLogger.Debug("Couldn't reach the server", "error", err)
+			time.Sleep(constants.REJOIN_DELAY * time.Second)
+			continue
+		}
+		derivedKey, err := actions.JoinChat(conn, buffer, c.identity, clientName, interlocutorName, quietLogger)
+		if err == nil {
+			c.key = derivedKey
+			established(conn)
+			return conn, derivedKey, nil
+		}
+		conn.Close()
+		switch {
+		// The interlocutor is still away, so the waiting starts over
+		case errors.Is(err, actions.ErrInterlocutorTimeout):
+		// The previous connection may still be in the waiting pool for a moment
+		case errors.Is(err, actions.ErrClientExists), errors.Is(err, actions.ErrRateLimited),
+			errors.Is(err, actions.ErrTooManyConnections):
+			time.Sleep(constants.REJOIN_DELAY * time.Second)
+		default:
+			return nil, nil, err
+		}
+	}
+}
+
+// Resumes the chat with the ticket on a new connection, backing off
+// exponentially between the attempts, until the server forgets the chat.
+// The GUI is running, so nothing is logged to the terminal.
+func (c *DHClient) reconnect(clientName string, ticket string, buffer []byte) (net.Conn, error) {
+	quietLogger := logging.Discard()
+	delay := constants.RECONNECT_MIN_DELAY * time.Second
+	deadline := time.Now().Add(constants.RESUME_WINDOW * time.Second)
+	for {
+		conn, err := c.dial()
+		if err == nil {
+			if err = actions.ResumeChat(conn, buffer, c.identity, clientName, ticket); err == nil {
+				established(conn)
+				return conn, nil
+			}
+			conn.Close()
+			// The server, which has forgotten the chat or the identity, won't recall it on another attempt
+			if errors.Is(err, actions.ErrResumeFailed) || errors.Is(err, actions.ErrUnknownResponse) || errors.Is(err, actions.ErrAuthFailed) {
+				return nil, err
+			}
+		}
+		quietLogger.Debug("Couldn't resume the chat", "error", err, "retry_in", delay)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, constants.RECONNECT_MAX_DELAY*time.Second)
+	}
+}
@@ -0,0 +1,114 @@
+package types
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/discovery"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+// Picks the interlocutor among the peers announced on the local network, then
+// chats with it directly or via the server, as the peer announced
+func (c *DHClient) InteractDiscovered() {
+	reader := bufio.NewReader(os.Stdin)
+	clientName, err := communication.GetInput("Enter your name: ", reader)
+	if err != nil {
+		c.fatal("Couldn't read the name", "error", err)
+	}
+	c.loadIdentity()
+
+	peer := c.pickPeer(reader, identity.Fingerprint(c.identity.Public().(ed25519.PublicKey)))
+	if peer.Address != "" {
+		c.config.PeerAddress = peer.Address
+		c.direct(clientName, peer.Fingerprint)
+		return
+	}
+	if c.config.Discoverable {
+		c.announce(context.Background(), clientName, "")
+	}
+	conn, err := c.Connect()
+	if err != nil {
+		c.fatal("Couldn't connect to the server", "error", err)
+	}
+	c.join(conn, clientName, peer.Name)
+}
+
+// Lists the announced peers, until the user picks one of them
+func (c *DHClient) pickPeer(reader *bufio.Reader, ownFingerprint string) discovery.Peer {
+	for {
+		fmt.Println("Looking for the peers on the local network...")
+		peers, err := discovery.Browse(context.Background(), discovery.DEFAULT_GROUP, constants.DISCOVERY_WAIT*time.Second)
+		if err != nil {
+			c.fatal("Couldn't look for the peers", "error", err)
+		}
+		// The own announcements are heard as well
+		peers = slices.DeleteFunc(peers, func(peer discovery.Peer) bool { return peer.Fingerprint == ownFingerprint })
+		if len(peers) == 0 {
+			fmt.Println("Nobody is announced on the local network")
+		}
+		for i, peer := range peers {
+			via := "via the server"
+			if peer.Address != "" {
+				via = "directly at " + peer.Address
+			}
+			fmt.Printf("%d. %s (%s), %s\n", i+1, peer.Name, peer.Fingerprint, via)
+		}
+		input, err := communication.GetInput("Enter the number of the peer (empty to look again): ", reader)
+		if err != nil {
+			c.fatal("Couldn't read the peer's number", "error", err)
+		}
+		if input == "" {
+			continue
+		}
+		number, err := strconv.Atoi(input)
+		if err != nil || number < 1 || number > len(peers) {
+			fmt.Println("There's no such peer")
+			continue
+		}
+		return peers[number-1]
+	}
+}
+
+// Announces the client on the local network, until the context is done. The
+// empty address means the client chats via the server.
+func (c *DHClient) announce(ctx context.Context, clientName string, address string) {
+	peer := discovery.Peer{
+		Name:        clientName,
+		Fingerprint: identity.Fingerprint(c.identity.Public().(ed25519.PublicKey)),
+		Address:     address,
+	}
+	go func() {
+		if err := discovery.Announce(ctx, discovery.DEFAULT_GROUP, peer, discovery.ANNOUNCE_INTERVAL); err != nil {
+			c.logger.Warn("Couldn't announce the client on the local network", "error", err)
+		}
+	}()
+	c.logger.Info("The client is announced on the local network")
+}
+
+// The address of the listener, which the peers on the network dial. The
+// port is taken from the listener, since it may be chosen by the system.
+// The empty address means the listener can't be reached from the network.
+func announcedAddress(listenAddress string, listener net.Listener) string {
+	_, target, err := transport.Parse(listenAddress)
+	if err != nil || target.Host == "" {
+		return ""
+	}
+	if tcpAddress, ok := listener.Addr().(*net.TCPAddr); ok {
+		target.Host = net.JoinHostPort(target.Hostname(), strconv.Itoa(tcpAddress.Port))
+	}
+	if target.Scheme == transport.DEFAULT_SCHEME {
+		return target.Host
+	}
+	return target.String()
+}
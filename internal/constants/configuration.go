@@ -3,6 +3,58 @@ package constants
 const (
 	SERVER_ADDRESS         = "localhost:8080"
 	SERVER_CONNECTION_TYPE = "tcp"
+	// Path of the WebSocket endpoint, for the clients behind HTTP proxies
+	WEBSOCKET_PATH = "/ws"
 	// Typical time for interlocutor to appear on server
 	INTERLOCUTOR_WAIT_TIME = 30
+	// Time given to in-flight chats to finish after the shutdown is requested
+	SHUTDOWN_TIMEOUT = 10
+	// Longest name of the client, in bytes
+	MAX_NAME_LENGTH = 32
+	// Default connection quotas and rate limits of the server
+	MAX_CONNECTIONS        = 1024
+	MAX_CONNECTIONS_PER_IP = 16
+	// Logins per second from a single IP, so it can't take the names in bulk
+	// or flood the waiting pool
+	HANDSHAKE_RATE  = 0.2
+	HANDSHAKE_BURST = 5
+	// Relayed messages per second of a single connection
+	MESSAGE_RATE  = 10
+	MESSAGE_BURST = 20
+	// Relayed control messages per second of a single connection, e.g. the
+	// receipts, which follow every message
+	CONTROL_RATE  = 20
+	CONTROL_BURST = 40
+	// Longest control message, in bytes, the longer ones are sent as the messages
+	MAX_CONTROL_SIZE = 256
+	// Time given to deliver the rejection to the refused connection
+	REJECTION_WRITE_TIMEOUT = 1
+	// Rejections delivered at once, the connections over it are just closed
+	MAX_PENDING_REJECTIONS = 64
+	// Default deadlines of the connections, in seconds
+	HANDSHAKE_TIMEOUT = 30
+	IDLE_TIMEOUT      = 600
+	WRITE_TIMEOUT     = 10
+	// Both the server and the client ping each other with this interval, in seconds
+	HEARTBEAT_INTERVAL = 10
+	// The peer is away after missing a couple of pings, and dead after a few more
+	HEARTBEAT_AWAY_MISSES = 2
+	HEARTBEAT_DEAD_MISSES = 3
+	HEARTBEAT_TIMEOUT     = HEARTBEAT_DEAD_MISSES * HEARTBEAT_INTERVAL
+	// Delay between the attempts to rejoin the chat, when the server is unavailable
+	REJOIN_DELAY = 2
+	// Time the server keeps the chat of the lost connection, waiting for it to resume
+	RESUME_WINDOW = 60
+	// Bounds of the exponential backoff between the reconnection attempts
+	RECONNECT_MIN_DELAY = 1
+	RECONNECT_MAX_DELAY = 16
+	// Time the client listens for the announcements of the peers, in seconds
+	DISCOVERY_WAIT = 3
+	// The typing is announced once per interval at most, and is over after
+	// the interval without the keystrokes, in seconds
+	TYPING_INTERVAL = 3
+	// The interlocutor, whose typing isn't announced again, has stopped typing
+	TYPING_TIMEOUT = 2 * TYPING_INTERVAL
+	// Typing signals waiting to be sent, the ones over it are dropped
+	TYPING_QUEUE_SIZE = 4
 )
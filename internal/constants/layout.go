@@ -1,6 +1,25 @@
 package constants
 
 const (
-	INPUT_VIEWNAME = "input"
-	CHAT_VIEWNAME  = "chat"
+	INPUT_VIEWNAME         = "input"
+	CHAT_VIEWNAME          = "chat"
+	CONVERSATIONS_VIEWNAME = "conversations"
+	// Width of the list of conversations of the multiplexed session
+	SIDEBAR_WIDTH = 24
+)
+
+// Statuses of the interlocutor, displayed in the chat title
+const (
+	STATUS_ONLINE       = "online"
+	STATUS_AWAY         = "away"
+	STATUS_DISCONNECTED = "disconnected"
+	STATUS_RECONNECTING = "reconnecting"
+)
+
+// Receipts of the outgoing messages, displayed next to them. The read ones
+// are marked as delivered in another color.
+const (
+	MARK_SENT      = "✓"
+	MARK_DELIVERED = "✓✓"
+	MARK_FAILED    = "✗"
 )
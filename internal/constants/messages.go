@@ -2,8 +2,16 @@ package constants
 
 const (
 	DATA_SEPARATOR = ":"
-	BUFFER_SIZE    = 4096
+	// Separates the name of the client from its server, e.g. alice@office
+	SERVER_SEPARATOR = "@"
+	// Separates the IDs of the messages in the receipts
+	ID_SEPARATOR = ","
+	BUFFER_SIZE  = 64 * 1024
+	// Messages queued between the interlocutors' handlers
+	CHAT_QUEUE_SIZE = 32
 	// ASCI color codes
-	GREEN_COLOR = "\033[32m"
-	RED_COLOR   = "\033[31m"
+	GREEN_COLOR  = "\033[32m"
+	RED_COLOR    = "\033[31m"
+	YELLOW_COLOR = "\033[33m"
+	BLUE_COLOR   = "\033[34m"
 )
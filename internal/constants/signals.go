@@ -6,4 +6,93 @@ const (
 	CLIENT_EXISTS             = "CLIENT_EXISTS"
 	CHAT_CONFIRMED            = "CHAT_CONFIRMED"
 	INTERLOCUTOR_WAIT_TIMEOUT = "INTERLOCUTOR_WAIT_TIMEOUT"
+	SERVER_SHUTDOWN           = "SERVER_SHUTDOWN"
+	SERVER_MAINTENANCE        = "SERVER_MAINTENANCE"
+	CLIENT_KICKED             = "CLIENT_KICKED"
+	CHAT_ENDED                = "CHAT_ENDED"
+	TOO_MANY_CONNECTIONS      = "TOO_MANY_CONNECTIONS"
+	RATE_LIMITED              = "RATE_LIMITED"
+	MESSAGE_RATE_LIMITED      = "MESSAGE_RATE_LIMITED"
+	IDLE_TIMEOUT_EXCEEDED     = "IDLE_TIMEOUT_EXCEEDED"
+	INTERLOCUTOR_IDLE         = "INTERLOCUTOR_IDLE"
+	// Refusals of the malformed logins
+	MALFORMED_LOGIN = "MALFORMED_LOGIN"
+	NAME_REQUIRED   = "NAME_REQUIRED"
+	NAME_TOO_LONG   = "NAME_TOO_LONG"
+	INVALID_NAME    = "INVALID_NAME"
+	RESERVED_NAME   = "RESERVED_NAME"
+	UNKNOWN_SERVER  = "UNKNOWN_SERVER"
+	// The federated server of the interlocutor can't be reached
+	SERVER_UNREACHABLE = "SERVER_UNREACHABLE"
+	// Signals of the authentication
+	AUTH_CHALLENGE  = "AUTH_CHALLENGE"
+	AUTH_RESPONSE   = "AUTH_RESPONSE"
+	AUTH_FAILED     = "AUTH_FAILED"
+	UNKNOWN_ACCOUNT = "UNKNOWN_ACCOUNT"
+	// Signals of the contacts
+	CONTACT_REQUESTED = "CONTACT_REQUESTED"
+	CONTACT_REQUEST   = "CONTACT_REQUEST"
+	CONTACTS          = "CONTACTS"
+	CONTACT_ACCEPT    = "CONTACT_ACCEPT"
+	CONTACT_BLOCK     = "CONTACT_BLOCK"
+	CONTACT_LIST      = "CONTACT_LIST"
+	CONTACT_ERROR     = "CONTACT_ERROR"
+	// Signals of the lobby
+	LOBBY           = "LOBBY"
+	LOBBY_JOINED    = "LOBBY_JOINED"
+	WHO             = "WHO"
+	WHO_LIST        = "WHO_LIST"
+	VISIBILITY      = "VISIBILITY"
+	INVITE          = "INVITE"
+	INVITE_SENT     = "INVITE_SENT"
+	INVITE_ERROR    = "INVITE_ERROR"
+	INVITATION      = "INVITATION"
+	INVITE_ACCEPT   = "INVITE_ACCEPT"
+	INVITE_DECLINE  = "INVITE_DECLINE"
+	INVITE_ACCEPTED = "INVITE_ACCEPTED"
+	INVITE_DECLINED = "INVITE_DECLINED"
+	// Visibility of the client in the lobby, hidden unless opted in
+	VISIBLE = "visible"
+	HIDDEN  = "hidden"
+	// Signals of the multiplexed session, which carries many chats at once
+	MULTIPLEX        = "MULTIPLEX"
+	MULTIPLEX_JOINED = "MULTIPLEX_JOINED"
+	OPEN_CHAT        = "OPEN_CHAT"
+	CHAT_OPENED      = "CHAT_OPENED"
+	CHAT_KEY         = "CHAT_KEY"
+	CHAT_ERROR       = "CHAT_ERROR"
+	// Greeting of the peers of the direct chat, which is held without the server
+	DIRECT = "DIRECT"
+	// Signals of the link between the federated servers
+	FEDERATE  = "FEDERATE"
+	FEDERATED = "FEDERATED"
+	// Signals of the broker, shared by the instances of the server
+	BROKER_PAIR     = "BROKER_PAIR"
+	BROKER_PAIRED   = "BROKER_PAIRED"
+	BROKER_ACCOUNTS = "BROKER_ACCOUNTS"
+	BROKER_CONTACTS = "BROKER_CONTACTS"
+	BROKER_REPLY    = "BROKER_REPLY"
+	BROKER_ERROR    = "BROKER_ERROR"
+	// Signals of the established chat
+	CHAT_MESSAGE = "CHAT_MESSAGE"
+	// Encrypted receipts and typing, which aren't a part of the conversation
+	CHAT_CONTROL = "CHAT_CONTROL"
+	PING         = "PING"
+	PONG         = "PONG"
+	PEER_STATUS  = "PEER_STATUS"
+	PEER_LEFT    = "PEER_LEFT"
+	LEAVE        = "LEAVE"
+	// Signals within the encrypted chat messages, which the server can't read
+	MESSAGE           = "MESSAGE"
+	MESSAGE_DELIVERED = "MESSAGE_DELIVERED"
+	MESSAGE_READ      = "MESSAGE_READ"
+	TYPING_STARTED    = "TYPING_STARTED"
+	TYPING_STOPPED    = "TYPING_STOPPED"
+	// Signals of the session resumption
+	SESSION_TICKET = "SESSION_TICKET"
+	RESUME         = "RESUME"
+	RESUMED        = "RESUMED"
+	RESUME_FAILED  = "RESUME_FAILED"
+	REKEY          = "REKEY"
+	REKEY_SALT     = "REKEY_SALT"
 )
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const REDACTED = "[REDACTED]"
+
+// Attribute keys, whose values are never written to the sink, whatever the level is
+var secretKeys = map[string]struct{}{
+	"key":          {},
+	"private_salt": {},
+	"password":     {},
+	"payload":      {},
+}
+
+// Config describes where and how the logs are written
+type Config struct {
+	Level  string
+	Format string
+	File   string
+}
+
+// RegisterFlags binds the logging configuration to the command line flags
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.Level, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&c.Format, "log-format", "text", "log format: text or json")
+	fs.StringVar(&c.File, "log-file", "", "file to write the logs to, stderr by default")
+	return c
+}
+
+// Logger builds the logger described by the configuration. The returned closer
+// releases the log file, if any.
+func (c *Config) Logger() (*slog.Logger, io.Closer, error) {
+	var sink io.WriteCloser = nopCloser{os.Stderr}
+	if c.File != "" {
+		file, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink = file
+	}
+	logger, err := New(sink, c.Level, c.Format)
+	if err != nil {
+		sink.Close()
+		return nil, nil, err
+	}
+	return logger, sink, nil
+}
+
+// New creates a structured logger, which redacts the secret attributes
+func New(sink io.Writer, level string, format string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	if err := slogLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: slogLevel, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(sink, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(sink, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// Discard returns a logger, which drops every record
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+func redact(_ []string, attr slog.Attr) slog.Attr {
+	if _, ok := secretKeys[attr.Key]; ok {
+		return slog.String(attr.Key, REDACTED)
+	}
+	return attr
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
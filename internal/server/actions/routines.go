@@ -1,24 +1,34 @@
 package actions
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net"
 
 	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
 )
 
-func ReadFromConnection(conn net.Conn, buffer []byte, output chan<- string, quit chan<- error) {
+// Reads the messages from the connection until it fails, or until the
+// context is cancelled, so the reader never outlives its consumer
+func ReadFromConnection(ctx context.Context, conn net.Conn, buffer []byte, output chan<- string, quit chan<- error) {
 	for {
 		message, err := communication.ReadMessage(conn, buffer)
 		if err != nil {
-			quit <- err
+			select {
+			case quit <- err:
+			case <-ctx.Done():
+			}
+			return
+		}
+		select {
+		case output <- message:
+		case <-ctx.Done():
 			return
 		}
-		output <- message
 	}
 }
 
-func CloseConnection(conn net.Conn) {
+func CloseConnection(conn net.Conn, logger *slog.Logger) {
 	conn.Close()
-	log.Printf("Closed connection with %s\n", conn.RemoteAddr())
+	logger.Info("Closed connection")
 }
@@ -0,0 +1,139 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+)
+
+var ErrAccountExists = errors.New("account already exists")
+
+// AccountStorage keeps the public keys of the registered names
+type AccountStorage interface {
+	Lookup(name string) (ed25519.PublicKey, bool)
+	// Register fails with ErrAccountExists, if the name is taken
+	Register(name string, key ed25519.PublicKey) error
+	Delete(name string) error
+	Names() []string
+}
+
+type memoryAccounts struct {
+	keys map[string]ed25519.PublicKey
+	mut  sync.RWMutex
+}
+
+func NewMemoryAccounts() AccountStorage {
+	return &memoryAccounts{keys: make(map[string]ed25519.PublicKey)}
+}
+
+func (m *memoryAccounts) Lookup(name string) (ed25519.PublicKey, bool) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	key, ok := m.keys[name]
+	return key, ok
+}
+
+func (m *memoryAccounts) Register(name string, key ed25519.PublicKey) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.keys[name]; ok {
+		return ErrAccountExists
+	}
+	m.keys[name] = key
+	return nil
+}
+
+func (m *memoryAccounts) Delete(name string) error {
+	m.mut.Lock()
+	delete(m.keys, name)
+	m.mut.Unlock()
+	return nil
+}
+
+func (m *memoryAccounts) Names() []string {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	names := make([]string, 0, len(m.keys))
+	for name := range m.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The accounts, which are kept in memory and saved to the JSON file on every change
+type fileAccounts struct {
+	memoryAccounts
+	path string
+}
+
+// NewFileAccounts loads the accounts from the file, which is created on the first change
+func NewFileAccounts(path string) (AccountStorage, error) {
+	f := &fileAccounts{memoryAccounts: memoryAccounts{keys: make(map[string]ed25519.PublicKey)}, path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded := make(map[string]string)
+	if err = json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	for name, encodedKey := range encoded {
+		key, err := identity.DecodePublicKey(encodedKey)
+		if err != nil {
+			return nil, err
+		}
+		f.keys[name] = key
+	}
+	return f, nil
+}
+
+func (f *fileAccounts) Register(name string, key ed25519.PublicKey) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if _, ok := f.keys[name]; ok {
+		return ErrAccountExists
+	}
+	f.keys[name] = key
+	if err := f.save(); err != nil {
+		delete(f.keys, name)
+		return err
+	}
+	return nil
+}
+
+func (f *fileAccounts) Delete(name string) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	key, ok := f.keys[name]
+	if !ok {
+		return nil
+	}
+	delete(f.keys, name)
+	if err := f.save(); err != nil {
+		f.keys[name] = key
+		return err
+	}
+	return nil
+}
+
+// Replaces the file atomically, the caller holds the lock
+func (f *fileAccounts) save() error {
+	encoded := make(map[string]string, len(f.keys))
+	for name, key := range f.keys {
+		encoded[name] = identity.EncodePublicKey(key)
+	}
+	data, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(f.path, data)
+}
@@ -0,0 +1,285 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+)
+
+var ErrAdminNotLoopback = errors.New("admin API must be bound to a loopback address")
+
+// Public view of a connected client. The chat content is never exposed.
+type ClientInfo struct {
+	Name            string  `json:"name"`
+	Interlocutor    string  `json:"interlocutor"`
+	Address         string  `json:"address"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+type ChatInfo struct {
+	ID              string       `json:"id"`
+	Clients         []ClientInfo `json:"clients"`
+	DurationSeconds float64      `json:"duration_seconds"`
+}
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Registered name with the fingerprint of its key
+type AccountInfo struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type accountKey struct {
+	PublicKey string `json:"public_key"`
+}
+
+func (s *DHServer) registerClient(client *DHClient) {
+	s.clientsMut.Lock()
+	client.connectedAt = s.clock.Now()
+	s.clients[client] = struct{}{}
+	s.clientsMut.Unlock()
+}
+
+func (s *DHServer) unregisterClient(client *DHClient) {
+	s.clientsMut.Lock()
+	delete(s.clients, client)
+	s.clientsMut.Unlock()
+}
+
+// Marks the client as a participant of the synchronized chat
+func (s *DHServer) markPaired(client *DHClient) {
+	s.clientsMut.Lock()
+	client.pairedAt = s.clock.Now()
+	s.clientsMut.Unlock()
+}
+
+// WaitingClients lists the clients, which are waiting for their interlocutors
+func (s *DHServer) WaitingClients() []ClientInfo {
+	now := s.clock.Now()
+	s.clientsMut.RLock()
+	defer s.clientsMut.RUnlock()
+	waiting := []ClientInfo{}
+	for client := range s.clients {
+		// The second client is pairing already, rather than waiting
+		if !client.pairedAt.IsZero() || client.side != 0 {
+			continue
+		}
+		waiting = append(waiting, client.info(now.Sub(client.connectedAt)))
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].Name < waiting[j].Name })
+	return waiting
+}
+
+// ActiveChats lists the synchronized chats with their participants
+func (s *DHServer) ActiveChats() []ChatInfo {
+	now := s.clock.Now()
+	s.clientsMut.RLock()
+	defer s.clientsMut.RUnlock()
+	chats := make(map[string]*ChatInfo)
+	for client := range s.clients {
+		if client.pairedAt.IsZero() {
+			continue
+		}
+		chat, ok := chats[client.chat.id]
+		if !ok {
+			chat = &ChatInfo{ID: client.chat.id}
+			chats[client.chat.id] = chat
+		}
+		duration := now.Sub(client.pairedAt)
+		chat.Clients = append(chat.Clients, client.info(duration))
+		chat.DurationSeconds = max(chat.DurationSeconds, duration.Seconds())
+	}
+	result := make([]ChatInfo, 0, len(chats))
+	for _, chat := range chats {
+		sort.Slice(chat.Clients, func(i, j int) bool { return chat.Clients[i].Name < chat.Clients[j].Name })
+		result = append(result, *chat)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// KickClient disconnects every client with the given name. It reports whether
+// any client was found. The chats of the multiplexed session are closed
+// along with the session, so only the session itself is notified.
+func (s *DHServer) KickClient(clientName string) bool {
+	return s.disconnectClients(constants.CLIENT_KICKED, func(c *DHClient) bool {
+		return c.name == clientName && (c.session == nil || c.isMuxSession())
+	})
+}
+
+// EndChat disconnects both participants of the chat. It reports whether the
+// chat was found.
+func (s *DHServer) EndChat(chatID string) bool {
+	return s.disconnectClients(constants.CHAT_ENDED, func(c *DHClient) bool {
+		return !c.pairedAt.IsZero() && c.chat.id == chatID
+	})
+}
+
+// Notifies the matching clients with the signal and closes their connections,
+// which makes their handlers tear the chats down. The clients are notified
+// outside the lock, so a stalled one doesn't hold the logins of the others.
+func (s *DHServer) disconnectClients(signal string, match func(*DHClient) bool) bool {
+	s.clientsMut.RLock()
+	var matched []*DHClient
+	for client := range s.clients {
+		if match(client) {
+			matched = append(matched, client)
+		}
+	}
+	s.clientsMut.RUnlock()
+	// Every client is notified before any is disconnected, since the chat is
+	// torn down for both of its clients, once either is disconnected
+	for _, client := range matched {
+		if err := communication.SendMessage(client.conn, signal); err != nil {
+			client.logger.Warn("Couldn't notify the client", "signal", signal, "error", err)
+		}
+	}
+	for _, client := range matched {
+		client.disconnect()
+		client.logger.Info("Client is disconnected by the admin", "signal", signal)
+	}
+	return len(matched) > 0
+}
+
+// SetMaintenance toggles the maintenance mode, in which new pairings are refused
+func (s *DHServer) SetMaintenance(enabled bool) {
+	s.maintenance.Store(enabled)
+	s.logger.Info("Maintenance mode is toggled", "enabled", enabled)
+}
+
+func (s *DHServer) InMaintenance() bool {
+	return s.maintenance.Load()
+}
+
+// AdminHandler exposes the runtime management of the server
+func (s *DHServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /waiting", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, s.WaitingClients())
+	})
+	mux.HandleFunc("GET /chats", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, s.ActiveChats())
+	})
+	mux.HandleFunc("DELETE /chats/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.EndChat(r.PathValue("id")) {
+			http.Error(w, "chat not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /clients/{name}/kick", func(w http.ResponseWriter, r *http.Request) {
+		if !s.KickClient(r.PathValue("name")) {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /maintenance", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, maintenanceState{Enabled: s.InMaintenance()})
+	})
+	mux.HandleFunc("PUT /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var state maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, "invalid maintenance state", http.StatusBadRequest)
+			return
+		}
+		s.SetMaintenance(state.Enabled)
+		writeJSON(w, http.StatusOK, state)
+	})
+	mux.HandleFunc("GET /accounts", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, s.Accounts())
+	})
+	mux.HandleFunc("PUT /accounts/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := validateName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var body accountKey
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid account", http.StatusBadRequest)
+			return
+		}
+		key, err := identity.DecodePublicKey(body.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = s.accounts.Register(name, key); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrAccountExists) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		s.logger.Info("Account registered by the admin", "client", name, "fingerprint", identity.Fingerprint(key))
+		writeJSON(w, http.StatusCreated, AccountInfo{Name: name, Fingerprint: identity.Fingerprint(key)})
+	})
+	mux.HandleFunc("DELETE /accounts/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.accounts.Delete(r.PathValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// Accounts lists the registered names
+func (s *DHServer) Accounts() []AccountInfo {
+	accounts := []AccountInfo{}
+	for _, name := range s.accounts.Names() {
+		if key, ok := s.accounts.Lookup(name); ok {
+			accounts = append(accounts, AccountInfo{Name: name, Fingerprint: identity.Fingerprint(key)})
+		}
+	}
+	return accounts
+}
+
+// ListenAdmin binds the admin API address, refusing anything but loopback
+func ListenAdmin(address string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	// The wildcard address would expose the API on every interface
+	if host == "" {
+		return nil, ErrAdminNotLoopback
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return nil, ErrAdminNotLoopback
+		}
+	}
+	return net.Listen(constants.SERVER_CONNECTION_TYPE, address)
+}
+
+func (c *DHClient) info(duration time.Duration) ClientInfo {
+	return ClientInfo{
+		Name:            c.name,
+		Interlocutor:    c.interlocutor,
+		Address:         c.clientAddress.String(),
+		DurationSeconds: duration.Seconds(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// The kicked client, which doesn't read, mustn't hold the logins of the others
+func TestStalledClientDoesntBlockKick(t *testing.T) {
+	server, address, _ := startServer(t,
+		WithLimits(Limits{}),
+		WithContacts(mutualContacts(t, "alice", "bob", "carol")),
+		WithTimeouts(communication.Timeouts{Handshake: time.Minute, Idle: time.Minute, Write: 5 * time.Second}))
+	alice := dial(t, address)
+	if response := login(t, alice, identityOf("alice"), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	kicked := make(chan bool, 1)
+	go func() { kicked <- server.KickClient("alice") }()
+	// The kick notice to alice is being written meanwhile
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	bob := dial(t, address)
+	if response := login(t, bob, identityOf("bob"), "bob:carol", "bob"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("bob got %q instead of waiting", response)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("login was blocked for %v", elapsed)
+	}
+	if message := read(t, alice); message != constants.CLIENT_KICKED {
+		t.Fatalf("alice got %q instead of the kick", message)
+	}
+	if !<-kicked {
+		t.Fatal("alice isn't found")
+	}
+}
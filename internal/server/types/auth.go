@@ -0,0 +1,91 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+)
+
+var (
+	ErrAuthFailed     = errors.New("authentication failed")
+	ErrUnknownAccount = errors.New("account isn't registered")
+)
+
+var authRefusals = map[error]string{
+	ErrAuthFailed:     constants.AUTH_FAILED,
+	ErrUnknownAccount: constants.UNKNOWN_ACCOUNT,
+}
+
+// Challenges the client to sign a fresh nonce with the key of the name.
+// Returns the key, which has signed it.
+func challenge(conn net.Conn, buffer []byte, name string) (ed25519.PublicKey, error) {
+	nonce, err := identity.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err = communication.SendMessage(conn, constants.AUTH_CHALLENGE+constants.DATA_SEPARATOR+nonce); err != nil {
+		return nil, err
+	}
+	response, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		return nil, err
+	}
+	// The response is in the format "AUTH_RESPONSE:publicKey:signature"
+	signal, payload := communication.ParseSignal(response, constants.DATA_SEPARATOR)
+	encodedKey, signature, ok := strings.Cut(payload, constants.DATA_SEPARATOR)
+	if signal != constants.AUTH_RESPONSE || !ok {
+		return nil, ErrAuthFailed
+	}
+	key, err := identity.DecodePublicKey(encodedKey)
+	if err != nil || !identity.Verify(key, name, nonce, signature) {
+		return nil, ErrAuthFailed
+	}
+	return key, nil
+}
+
+// Challenges the client to prove the name is its own. The unknown name is
+// registered with the client's key, if the registration is open.
+func (s *DHServer) authenticate(conn net.Conn, buffer []byte, name string, logger *slog.Logger) error {
+	key, err := challenge(conn, buffer, name)
+	if err != nil {
+		return err
+	}
+
+	registered, ok := s.accounts.Lookup(name)
+	if ok {
+		if !registered.Equal(key) {
+			return ErrAuthFailed
+		}
+		return nil
+	}
+	if !s.openRegistration {
+		return ErrUnknownAccount
+	}
+	if err = s.accounts.Register(name, key); err != nil {
+		// Another client has just claimed the name
+		if errors.Is(err, ErrAccountExists) {
+			return ErrAuthFailed
+		}
+		return err
+	}
+	logger.Info("Account registered", "fingerprint", identity.Fingerprint(key))
+	return nil
+}
+
+// Challenges the client to prove the registered name is its own
+func (s *DHServer) authenticateOwner(conn net.Conn, buffer []byte, name string) error {
+	key, err := challenge(conn, buffer, name)
+	if err != nil {
+		return err
+	}
+	if registered, ok := s.accounts.Lookup(name); !ok || !registered.Equal(key) {
+		return ErrAuthFailed
+	}
+	return nil
+}
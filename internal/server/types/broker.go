@@ -0,0 +1,251 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+var (
+	ErrClientExists      = errors.New("client is already waiting")
+	ErrBrokerUnavailable = errors.New("broker is unavailable")
+	ErrBrokerExposed     = errors.New("broker is served on unix:// or mem:// only")
+)
+
+// Broker pairs the clients and carries the messages of their chats, so the
+// interlocutors may be served by different instances of the server
+type Broker interface {
+	// Pair joins the chat of the interlocutor, who waits for the client, or
+	// opens a new chat, where the client waits for the interlocutor until
+	// the chat ends. Returns the chat and the side of the client in it.
+	Pair(clientName string, interlocutor string) (*Chat, int, error)
+}
+
+type waiter struct {
+	interlocutor string
+	chat         *Chat
+}
+
+// Broker of a single process, the interlocutors share the same chat
+type memoryBroker struct {
+	waiting map[string]waiter
+	mut     sync.Mutex
+}
+
+func NewMemoryBroker() Broker {
+	return &memoryBroker{waiting: make(map[string]waiter)}
+}
+
+func (b *memoryBroker) Pair(clientName string, interlocutor string) (*Chat, int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if _, ok := b.waiting[clientName]; ok {
+		return nil, 0, ErrClientExists
+	}
+	// The waiting interlocutor is claimed at once, so nobody else joins its chat
+	if w, ok := b.waiting[interlocutor]; ok && w.interlocutor == clientName {
+		delete(b.waiting, interlocutor)
+		return w.chat, 1, nil
+	}
+	chat := newChat()
+	b.waiting[clientName] = waiter{interlocutor: interlocutor, chat: chat}
+	context.AfterFunc(chat.ctx, func() { b.withdraw(clientName, chat) })
+	return chat, 0, nil
+}
+
+// Forgets the client, unless it has been paired or replaced already
+func (b *memoryBroker) withdraw(clientName string, chat *Chat) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if w, ok := b.waiting[clientName]; ok && w.chat == chat {
+		delete(b.waiting, clientName)
+	}
+}
+
+// ListenBroker listens for the other instances of the server on the local
+// address. The requests aren't authenticated, so the broker is served on the
+// unix:// socket, accessible by its owner only, or in-process on mem://.
+func ListenBroker(address string) (net.Listener, error) {
+	_, target, err := transport.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "unix" && target.Scheme != "mem" {
+		return nil, ErrBrokerExposed
+	}
+	listener, err := transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "unix" {
+		if err = os.Chmod(target.Path, 0o600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// ServeBroker shares the broker, the accounts and the contacts with the other
+// instances of the server, which connect to the listener with NewRemoteBroker,
+// NewRemoteAccounts and NewRemoteContacts, until it's closed. Every pairing
+// takes its own connection, which carries the chat afterwards, and so does
+// every call of the storages. Anyone, who connects, may pair any names and
+// register any keys, so the listener must be local, see ListenBroker.
+func ServeBroker(listener net.Listener, broker Broker, accounts AccountStorage, contacts ContactStorage, logger *slog.Logger) error {
+	if network := listener.Addr().Network(); network != "unix" && network != "mem" {
+		return ErrBrokerExposed
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveBrokerRequest(conn, broker, accounts, contacts, logger.With("remote_addr", conn.RemoteAddr().String()))
+	}
+}
+
+func serveBrokerRequest(conn net.Conn, broker Broker, accounts AccountStorage, contacts ContactStorage, logger *slog.Logger) {
+	_ = conn.SetDeadline(time.Now().Add(constants.HANDSHAKE_TIMEOUT * time.Second))
+	request, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	signal, payload := communication.ParseSignal(request, constants.DATA_SEPARATOR)
+	switch signal {
+	case constants.BROKER_PAIR:
+		serveBrokerPairing(conn, broker, payload, logger)
+	case constants.BROKER_ACCOUNTS, constants.BROKER_CONTACTS:
+		serveStorageCall(conn, signal, payload, accounts, contacts, logger)
+	default:
+		logger.Warn("Invalid broker request", "bytes", len(request))
+		conn.Close()
+	}
+}
+
+// Pairs the client of another instance. The payload is in the format
+// "clientName:interlocutor".
+func serveBrokerPairing(conn net.Conn, broker Broker, payload string, logger *slog.Logger) {
+	clientName, interlocutor, ok := strings.Cut(payload, constants.DATA_SEPARATOR)
+	if !ok {
+		logger.Warn("Invalid pairing request", "bytes", len(payload))
+		conn.Close()
+		return
+	}
+	chat, side, err := broker.Pair(clientName, interlocutor)
+	if err != nil {
+		_ = communication.SendMessage(conn, constants.CLIENT_EXISTS)
+		conn.Close()
+		return
+	}
+	reply := constants.BROKER_PAIRED + constants.DATA_SEPARATOR + strconv.Itoa(side) + constants.DATA_SEPARATOR + chat.id
+	if err = communication.SendMessage(conn, reply); err != nil {
+		chat.End(err)
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	logger.Debug("Paired the client of another instance", "client", clientName, "chat_id", chat.id)
+	bridge(chat, side, conn)
+}
+
+// Broker shared by another instance of the server, see ServeBroker
+type remoteBroker struct {
+	address string
+}
+
+// NewRemoteBroker pairs the clients via the broker, served on the address by
+// another instance, e.g. unix:///run/dh-broker.sock
+func NewRemoteBroker(address string) Broker {
+	return remoteBroker{address: address}
+}
+
+func (b remoteBroker) Pair(clientName string, interlocutor string) (*Chat, int, error) {
+	conn, err := transport.Dial(b.address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(constants.HANDSHAKE_TIMEOUT * time.Second))
+	request := constants.BROKER_PAIR + constants.DATA_SEPARATOR + clientName + constants.DATA_SEPARATOR + interlocutor
+	if err = communication.SendMessage(conn, request); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+	}
+	reply, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+	if err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+	}
+	if reply == constants.CLIENT_EXISTS {
+		conn.Close()
+		return nil, 0, ErrClientExists
+	}
+	// The reply is in the format "BROKER_PAIRED:side:chatID"
+	signal, payload := communication.ParseSignal(reply, constants.DATA_SEPARATOR)
+	sideStr, id, _ := strings.Cut(payload, constants.DATA_SEPARATOR)
+	side, err := strconv.Atoi(sideStr)
+	if signal != constants.BROKER_PAIRED || err != nil || (side != 0 && side != 1) {
+		conn.Close()
+		return nil, 0, ErrBrokerUnavailable
+	}
+	_ = conn.SetDeadline(time.Time{})
+	// The chat of this instance stands for the shared one, whose other side is bridged
+	chat := newChatWithID(id)
+	go bridge(chat, 1-side, conn)
+	return chat, side, nil
+}
+
+// Carries the side of the chat, whose client is served by another instance,
+// over the connection: the messages to the side are sent, and the received
+// ones are passed to the other side. The chat ends with the connection, and
+// the other way round.
+func bridge(chat *Chat, remoteSide int, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, constants.BUFFER_SIZE)
+		for {
+			message, err := communication.ReadMessage(conn, buffer)
+			if err != nil {
+				chat.End(ErrInterlocutorLeft)
+				return
+			}
+			select {
+			case chat.mailboxes[1-remoteSide] <- message:
+			case <-chat.Done():
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case message := <-chat.mailboxes[remoteSide]:
+			if err := communication.SendMessage(conn, message); err != nil {
+				chat.End(ErrInterlocutorLeft)
+				return
+			}
+		case <-chat.Done():
+			// The messages, sent right before the chat ended, are still delivered
+			for len(chat.mailboxes[remoteSide]) > 0 {
+				if err := communication.SendMessage(conn, <-chat.mailboxes[remoteSide]); err != nil {
+					return
+				}
+			}
+			return
+		}
+	}
+}
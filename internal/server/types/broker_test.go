@@ -0,0 +1,166 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+// Anyone, who reaches the broker, pairs any names, so it's never exposed
+func TestBrokerListenerIsLocal(t *testing.T) {
+	if _, err := ListenBroker("tcp://127.0.0.1:0"); !errors.Is(err, ErrBrokerExposed) {
+		t.Fatalf("broker listens on tcp with %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err = ServeBroker(listener, NewMemoryBroker(), NewMemoryAccounts(), NewMemoryContacts(), logger); !errors.Is(err, ErrBrokerExposed) {
+		t.Fatalf("broker is served on tcp with %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	listener, err = ListenBroker("unix://" + path)
+	if err != nil {
+		t.Skip("unix sockets aren't available:", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Fatalf("broker socket is accessible with %o", mode)
+	}
+}
+
+// Starts two instances, which share the broker, the accounts and the contacts
+// of the first one, and returns their addresses
+func startInstances(t *testing.T) []string {
+	t.Helper()
+	name := strings.ReplaceAll(t.Name(), "/", "-")
+	brokerListener, err := ListenBroker("mem://" + name + "-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { brokerListener.Close() })
+	broker, accounts, contacts := NewMemoryBroker(), NewMemoryAccounts(), NewMemoryContacts()
+	go ServeBroker(brokerListener, broker, accounts, contacts, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	instances := [][]Option{
+		{WithBroker(broker), WithAccounts(accounts), WithContacts(contacts)},
+		{
+			WithBroker(NewRemoteBroker("mem://" + name + "-broker")),
+			WithAccounts(NewRemoteAccounts("mem://" + name + "-broker")),
+			WithContacts(NewRemoteContacts("mem://" + name + "-broker")),
+		},
+	}
+	addresses := make([]string, len(instances))
+	for i, options := range instances {
+		addresses[i] = "mem://" + name + "-" + string(rune('a'+i))
+		listener, err := transport.Listen(addresses[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		serve(t, listener, append([]Option{WithLimits(Limits{})}, options...)...)
+	}
+	return addresses
+}
+
+// The contact request, sent on one instance, is accepted on another, and the
+// interlocutors are paired via the broker and chat as usual
+func TestPairingAcrossInstances(t *testing.T) {
+	addresses := startInstances(t)
+	if response := login(t, dial(t, addresses[0]), identityOf("alice"), "alice:bob", "alice"); response != constants.CONTACT_REQUESTED {
+		t.Fatalf("alice got %q instead of the contact request", response)
+	}
+	// The name, registered on one instance, is taken on the other
+	if response := login(t, dial(t, addresses[1]), newIdentity(t), "alice:bob", "alice"); response != constants.AUTH_FAILED {
+		t.Fatalf("mallory got %q instead of the refusal", response)
+	}
+
+	bob := dial(t, addresses[1])
+	if response := login(t, bob, identityOf("bob"), "bob:alice", "bob"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("bob got %q instead of waiting", response)
+	}
+	alice := dial(t, addresses[0])
+	found := login(t, alice, identityOf("alice"), "alice:bob", "alice")
+	if signal, _ := communication.ParseSignal(found, constants.DATA_SEPARATOR); signal != constants.INTERLOCUTOR_FOUND {
+		t.Fatalf("alice got %q instead of the interlocutor", found)
+	}
+	if message := read(t, bob); message != found {
+		t.Fatalf("bob got %q instead of the secrets", message)
+	}
+	for _, conn := range []net.Conn{alice, bob} {
+		go communication.SendMessage(conn, "5")
+	}
+	for _, conn := range []net.Conn{alice, bob} {
+		if message := read(t, conn); message != constants.CHAT_CONFIRMED+constants.DATA_SEPARATOR+"5" {
+			t.Fatalf("got %q instead of the confirmation", message)
+		}
+	}
+	aliceMessages, bobMessages := answerPings(alice), answerPings(bob)
+	go communication.SendMessage(alice, constants.CHAT_MESSAGE+":hello")
+	if message := awaitSignal(t, bobMessages, constants.CHAT_MESSAGE); message != constants.CHAT_MESSAGE+":hello" {
+		t.Fatalf("bob got %q", message)
+	}
+	go communication.SendMessage(bob, constants.CHAT_MESSAGE+":hi")
+	if message := awaitSignal(t, aliceMessages, constants.CHAT_MESSAGE); message != constants.CHAT_MESSAGE+":hi" {
+		t.Fatalf("alice got %q", message)
+	}
+}
+
+// The errors of the storages, shared by the broker, are told apart as usual
+func TestSharedStorageErrors(t *testing.T) {
+	name := strings.ReplaceAll(t.Name(), "/", "-")
+	listener, err := ListenBroker("mem://" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ServeBroker(listener, NewMemoryBroker(), NewMemoryAccounts(), NewMemoryContacts(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	accounts, contacts := NewRemoteAccounts("mem://"+name), NewRemoteContacts("mem://"+name)
+
+	key := identityOf("alice").Public().(ed25519.PublicKey)
+	if err = accounts.Register("alice", key); err != nil {
+		t.Fatal(err)
+	}
+	if err = accounts.Register("alice", identityOf("mallory").Public().(ed25519.PublicKey)); !errors.Is(err, ErrAccountExists) {
+		t.Fatalf("name is registered twice with %v", err)
+	}
+	if registered, ok := accounts.Lookup("alice"); !ok || !registered.Equal(key) {
+		t.Fatal("registered key isn't found")
+	}
+	if _, ok := accounts.Lookup("bob"); ok {
+		t.Fatal("unknown name is found")
+	}
+	if err = contacts.Accept("bob", "alice"); !errors.Is(err, ErrNoContactRequest) {
+		t.Fatalf("missing request is accepted with %v", err)
+	}
+	if accepted, err := contacts.Request("alice", "bob"); accepted || err != nil {
+		t.Fatalf("request is accepted %v with %v", accepted, err)
+	}
+	if list := contacts.List("bob"); len(list.Requests) != 1 || list.Requests[0] != "alice" {
+		t.Fatalf("bob has the requests %v", list.Requests)
+	}
+
+	listener.Close()
+	if _, ok := accounts.Lookup("alice"); ok {
+		t.Fatal("name is found without the broker")
+	}
+	if err = accounts.Register("bob", key); !errors.Is(err, ErrBrokerUnavailable) {
+		t.Fatalf("name is registered without the broker with %v", err)
+	}
+}
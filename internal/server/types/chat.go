@@ -0,0 +1,61 @@
+package types
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+)
+
+var (
+	ErrInterlocutorLeft = errors.New("interlocutor left the chat")
+	ErrInterlocutorBusy = errors.New("interlocutor doesn't take the messages")
+)
+
+// Chat is the conversation of two clients, from the pairing until either of
+// them leaves. The messages are passed via the mailboxes, which are never
+// closed, so no sender can panic. The chat is over once its context is cancelled.
+type Chat struct {
+	id  string
+	ctx context.Context
+	end context.CancelCauseFunc
+	// Mailboxes of the first and the second client
+	mailboxes [2]chan string
+}
+
+func newChat() *Chat {
+	return newChatWithID(newChatID())
+}
+
+// The chat, shared by the instances of the server, has the same identifier in each of them
+func newChatWithID(id string) *Chat {
+	ctx, end := context.WithCancelCause(context.Background())
+	return &Chat{
+		id:  id,
+		ctx: ctx,
+		end: end,
+		mailboxes: [2]chan string{
+			make(chan string, constants.CHAT_QUEUE_SIZE),
+			make(chan string, constants.CHAT_QUEUE_SIZE),
+		},
+	}
+}
+
+func newChatID() string {
+	id := make([]byte, 8)
+	// The identifier is used only for logs correlation, so a failure isn't critical
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Done is closed as soon as the chat is over
+func (c *Chat) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// End finishes the chat for both clients. Only the first cause is kept.
+func (c *Chat) End(cause error) {
+	c.end(cause)
+}
@@ -0,0 +1,96 @@
+package types
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// Every ordering of the teardown releases both handlers, and leaves the
+// waiting room free for the next chat of the same names
+func TestChatTeardown(t *testing.T) {
+	tests := []struct {
+		name  string
+		leave func(t *testing.T, address string)
+	}{
+		{
+			name: "leave before pairing",
+			leave: func(t *testing.T, address string) {
+				alice := dial(t, address)
+				if response := login(t, alice, identityOf("alice"), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+					t.Fatalf("alice got %q instead of waiting", response)
+				}
+				alice.Close()
+			},
+		},
+		{
+			name: "both leave after pairing",
+			leave: func(t *testing.T, address string) {
+				alice, bob := pair(t, address)
+				done := make(chan struct{})
+				for _, conn := range []net.Conn{alice, bob} {
+					go func(conn net.Conn) {
+						defer func() { done <- struct{}{} }()
+						_ = communication.SendMessage(conn, constants.LEAVE)
+						conn.Close()
+					}(conn)
+				}
+				<-done
+				<-done
+			},
+		},
+		{
+			name: "one leaves after pairing",
+			leave: func(t *testing.T, address string) {
+				alice, bob := pair(t, address)
+				if err := communication.SendMessage(alice, constants.LEAVE); err != nil {
+					t.Fatal(err)
+				}
+				alice.Close()
+				readUntil(t, bob, constants.PEER_LEFT)
+				bob.Close()
+			},
+		},
+		{
+			name: "leave during handshake",
+			leave: func(t *testing.T, address string) {
+				alice, bob := dial(t, address), dial(t, address)
+				if response := login(t, alice, identityOf("alice"), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+					t.Fatalf("alice got %q instead of waiting", response)
+				}
+				login(t, bob, identityOf("bob"), "bob:alice", "bob")
+				read(t, alice)
+				// Bob leaves before sending its public salt
+				bob.Close()
+				go communication.SendMessage(alice, "5")
+				if _, err := communication.ReadMessage(alice, make([]byte, constants.BUFFER_SIZE)); err == nil {
+					t.Fatal("alice's chat goes on without bob")
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, address, _ := startServer(t)
+			test.leave(t, address)
+			waitReleased(t, server)
+			server.clientsMut.RLock()
+			clients := len(server.clients)
+			server.clientsMut.RUnlock()
+			if clients != 0 {
+				t.Fatalf("%d clients are still registered", clients)
+			}
+			// The names are free to chat again
+			alice, bob := pair(t, address)
+			for _, conn := range []net.Conn{alice, bob} {
+				if err := communication.SendMessage(conn, constants.LEAVE); err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			}
+			waitReleased(t, server)
+		})
+	}
+}
@@ -2,35 +2,125 @@ package types
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dikuropiatnyk/dh-chat/internal/constants"
 	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
-	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
 )
 
-// New error type for closed read channel
-var ErrReadChannelClosed = errors.New("read channel is closed")
 var ErrWaitingTimeoutExceeded = errors.New("waiting timeout exceeded")
+var ErrServerShutdown = errors.New("server is shutting down")
+var ErrClientDisconnected = errors.New("client is disconnected by the admin")
+var ErrClientLeft = errors.New("client left before the interlocutor came")
 
 type DHClient struct {
+	conn          net.Conn
 	clientAddress net.Addr
 	name          string
 	interlocutor  string
-	readChannel   chan string
-	writeChannel  chan string
+	// Chat shared by both interlocutors, and the client's side of it
+	chat   *Chat
+	side   int
+	logger *slog.Logger
+	// Guarded by the server, since they are exposed via the admin API
+	connectedAt time.Time
+	pairedAt    time.Time
+	// Closed when the admin disconnects the client
+	disconnected   chan struct{}
+	disconnectOnce sync.Once
+	// Ticket to resume the chat, guarded by the server
+	ticket string
+	// Receives the connection, which resumes the chat of the lost one
+	resumed chan *resumeRequest
+	// Interlocutor's messages, received while the connection was lost
+	pending []string
+	// Forwarded by the federated server, so the chat can't be resumed
+	forwarded bool
+	// Multiplexed session of the client, whose control stream or chat stream
+	// is the connection, nil for the plain one
+	session *muxSession
 }
 
-func NewDHClient(clientAddress net.Addr, name string, interlocutorName string) *DHClient {
-	log.Printf("New client %s connected. Address: %s Interlocutor: %s\n", name, clientAddress.String(), interlocutorName)
-	return &DHClient{clientAddress: clientAddress, name: name, interlocutor: interlocutorName}
+func NewDHClient(conn net.Conn, name string, interlocutorName string, logger *slog.Logger) *DHClient {
+	logger.Info("New client connected")
+	return newDHClient(conn, name, interlocutorName, logger)
 }
 
+func newDHClient(conn net.Conn, name string, interlocutorName string, logger *slog.Logger) *DHClient {
+	return &DHClient{
+		conn:          conn,
+		clientAddress: conn.RemoteAddr(),
+		name:          name,
+		interlocutor:  interlocutorName,
+		logger:        logger,
+		disconnected:  make(chan struct{}),
+		resumed:       make(chan *resumeRequest),
+	}
+}
+
+// Closes the client connection and releases the client, if it's still waiting.
+// The multiplexed session is closed with every chat of it.
+func (c *DHClient) disconnect() {
+	c.disconnectOnce.Do(func() {
+		close(c.disconnected)
+		if c.isMuxSession() {
+			c.session.link.Close()
+			return
+		}
+		c.conn.Close()
+	})
+}
+
+// The client is the multiplexed session itself, rather than one of its chats
+func (c *DHClient) isMuxSession() bool {
+	return c.session != nil && c.chat == nil
+}
+
+// Joins the chat on the given side, and adds its identifier to every further log record of the client
+func (c *DHClient) joinChat(chat *Chat, side int) {
+	c.chat, c.side = chat, side
+	c.logger = c.logger.With("chat_id", chat.id)
+}
+
+// Mailbox of the interlocutor's messages to the client
+func (c *DHClient) inbox() <-chan string {
+	return c.chat.mailboxes[c.side]
+}
+
+// Passes the message to the interlocutor, unless the chat is over
+func (c *DHClient) send(message string) error {
+	select {
+	case c.chat.mailboxes[1-c.side] <- message:
+		return nil
+	case <-c.chat.Done():
+		return ErrInterlocutorLeft
+	}
+}
+
+// Waits for the interlocutor's message, unless the chat is over
+func (c *DHClient) receive() (string, error) {
+	select {
+	case message := <-c.inbox():
+		return message, nil
+	case <-c.chat.Done():
+		// The message, sent right before the interlocutor left, is still delivered
+		select {
+		case message := <-c.inbox():
+			return message, nil
+		default:
+			return "", ErrInterlocutorLeft
+		}
+	}
+}
+
+// Leaves the chat, which releases the interlocutor's handler
 func (c *DHClient) Close() {
-	if c.writeChannel != nil {
-		close(c.writeChannel)
+	if c.chat != nil {
+		c.chat.End(ErrInterlocutorLeft)
 	}
 }
 
@@ -40,14 +130,16 @@ func (c *DHClient) SyncWithInterlocutor(clientConnection net.Conn, buffer []byte
 	if err != nil {
 		return err
 	}
-	log.Printf("Received a public salt from %s!\n%s", c.name, clientPublicSalt)
+	c.logger.Debug("Received a public salt", "bytes", len(clientPublicSalt))
 	// Send the client confirmation to the interlocutor
-	c.writeChannel <- clientPublicSalt
+	if err = c.send(clientPublicSalt); err != nil {
+		return err
+	}
 
 	// Wait for the interlocutor to provide the public salt
-	interlocutorPublicSalt, ok := <-c.readChannel
-	if !ok {
-		return ErrReadChannelClosed
+	interlocutorPublicSalt, err := c.receive()
+	if err != nil {
+		return err
 	}
 
 	sharedMessage := constants.CHAT_CONFIRMED + constants.DATA_SEPARATOR + interlocutorPublicSalt
@@ -55,22 +147,21 @@ func (c *DHClient) SyncWithInterlocutor(clientConnection net.Conn, buffer []byte
 		return err
 	}
 
-	log.Printf("Successful chat synchronization for %s!", c.name)
+	c.logger.Info("Successful chat synchronization")
 
 	return nil
 }
 
-func (c *DHClient) HandleFirstClient(conn net.Conn, buffer []byte) error {
+func (c *DHClient) HandleFirstClient(conn net.Conn, buffer []byte, timeout <-chan time.Time, quit <-chan struct{}) error {
 	if err := communication.SendMessage(conn, constants.NO_INTERLOCUTOR); err != nil {
 		return err
 	}
+	left, stopWatching := watchConnection(conn)
 	// Set up a blocking waiter until the interlocutor is found, which is unblocked
 	// by the interlocutor goroutine
 	select {
-	case chatSecrets, ok := <-c.readChannel:
-		if !ok {
-			return ErrReadChannelClosed
-		}
+	case chatSecrets := <-c.inbox():
+		stopWatching()
 		if err := communication.SendMessage(conn, chatSecrets); err != nil {
 			return err
 		}
@@ -78,26 +169,73 @@ func (c *DHClient) HandleFirstClient(conn net.Conn, buffer []byte) error {
 			return err
 		}
 	// If the interlocutor doesn't show up in time, remove the client from the waiting pool
-	case <-time.After(constants.INTERLOCUTOR_WAIT_TIME * time.Second):
+	case <-timeout:
 		if err := communication.SendMessage(conn, constants.INTERLOCUTOR_WAIT_TIMEOUT); err != nil {
 			return err
 		}
 		return ErrWaitingTimeoutExceeded
+	// The server is shutting down, the client has been already notified
+	case <-quit:
+		return ErrServerShutdown
+	case <-c.disconnected:
+		return ErrClientDisconnected
+	case <-left:
+		return ErrClientLeft
 	}
 
 	return nil
 }
 
+// Watches the connection of the waiting client, which sends nothing until
+// it's paired, so its leaving is noticed right away. The returned stop
+// releases the connection, once the interlocutor comes.
+func watchConnection(conn net.Conn) (<-chan struct{}, func()) {
+	left := make(chan struct{})
+	stopped := make(chan struct{})
+	var stopping atomic.Bool
+	go func() {
+		defer close(stopped)
+		buffer := make([]byte, 1)
+		for {
+			_, err := conn.Read(buffer)
+			if stopping.Load() {
+				return
+			}
+			if communication.IsTimeout(err) {
+				continue
+			}
+			// The connection is closed, or the client doesn't follow the protocol
+			close(left)
+			return
+		}
+	}()
+	stop := func() {
+		stopping.Store(true)
+		// The timed connection renews the deadline on every read, so it's
+		// expired until the reader gives up
+		for {
+			_ = conn.SetReadDeadline(time.Now())
+			select {
+			case <-stopped:
+				_ = conn.SetReadDeadline(time.Time{})
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	return left, stop
+}
+
 // By second client it's implied the client that is connected after its
 // interlocutor, and so it's the moment to exchange the base secrets
 // and start the chat
-func (c *DHClient) HandleSecondClient(conn net.Conn, buffer []byte) error {
-	p, g, err := diffiehellman.GenerateBaseSecrets()
+func (c *DHClient) HandleSecondClient(conn net.Conn, buffer []byte, generateSecrets ParameterSource) error {
+	p, g, err := generateSecrets()
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Generated base secrets for chat %s <=> %s!\np=%s, g=%s\n", c.name, c.interlocutor, p.String(), g.String())
+	c.logger.Debug("Generated base secrets", "p_bits", p.BitLen(), "g", g.String())
 
 	// Prepare the message with base secrets to send to both clients
 	sharedMessage := constants.INTERLOCUTOR_FOUND + constants.DATA_SEPARATOR + p.String() + constants.DATA_SEPARATOR + g.String()
@@ -105,12 +243,14 @@ func (c *DHClient) HandleSecondClient(conn net.Conn, buffer []byte) error {
 	if err = communication.SendMessage(conn, sharedMessage); err != nil {
 		return err
 	}
-	// Send the message to the interlocutor via the write channel
-	c.writeChannel <- sharedMessage
+	// Send the message to the interlocutor via the chat
+	if err = c.send(sharedMessage); err != nil {
+		return err
+	}
 
 	// Synchronize the chat between the current client and the interlocutor
 	if err = c.SyncWithInterlocutor(conn, buffer); err != nil {
-		log.Println("Chat synchronization error:", err)
+		c.logger.Warn("Chat synchronization error", "error", err)
 		return err
 	}
 	return nil
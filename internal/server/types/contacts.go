@@ -0,0 +1,221 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+var ErrNoContactRequest = errors.New("there's no contact request from this name")
+
+// ContactList is the view of the contacts of a single name
+type ContactList struct {
+	Contacts []string `json:"contacts"`
+	// Names, which asked to become a contact
+	Requests []string `json:"requests"`
+	Blocked  []string `json:"blocked"`
+}
+
+// ContactStorage keeps the contacts of the names. Only the mutual contacts may chat.
+type ContactStorage interface {
+	// Request asks the recipient to become a contact. The pending request in the
+	// opposite direction is accepted instead, which is reported as true.
+	// The request to the name, which blocked the sender, is silently dropped.
+	Request(from string, to string) (bool, error)
+	// Accept fails with ErrNoContactRequest, unless the name has asked for it
+	Accept(owner string, from string) error
+	// Block removes the contact and its requests, and drops the further ones
+	Block(owner string, other string) error
+	AreContacts(first string, second string) bool
+	List(owner string) ContactList
+}
+
+type relations map[string]map[string]bool
+
+func (r relations) add(owner string, other string) {
+	if r[owner] == nil {
+		r[owner] = make(map[string]bool)
+	}
+	r[owner][other] = true
+}
+
+func (r relations) remove(owner string, other string) {
+	delete(r[owner], other)
+	if len(r[owner]) == 0 {
+		delete(r, owner)
+	}
+}
+
+func (r relations) list(owner string) []string {
+	names := []string{}
+	for name := range r[owner] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The contacts, which are kept in memory, and saved to the JSON file on every
+// change, if the path is set
+type contactBook struct {
+	Contacts relations `json:"contacts"`
+	// Pending requests by their recipient
+	Requests relations `json:"requests"`
+	Blocked  relations `json:"blocked"`
+	path     string
+	mut      sync.RWMutex
+}
+
+func newContactBook(path string) *contactBook {
+	return &contactBook{Contacts: relations{}, Requests: relations{}, Blocked: relations{}, path: path}
+}
+
+func NewMemoryContacts() ContactStorage {
+	return newContactBook("")
+}
+
+// NewFileContacts loads the contacts from the file, which is created on the first change
+func NewFileContacts(path string) (ContactStorage, error) {
+	book := newContactBook(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, book); err != nil {
+		return nil, err
+	}
+	for _, r := range []*relations{&book.Contacts, &book.Requests, &book.Blocked} {
+		if *r == nil {
+			*r = relations{}
+		}
+	}
+	return book, nil
+}
+
+func (b *contactBook) Request(from string, to string) (bool, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.Blocked[to][from] {
+		return false, nil
+	}
+	// Asking the blocked name is the way to unblock it
+	b.Blocked.remove(from, to)
+	if b.Requests[from][to] {
+		b.Requests.remove(from, to)
+		b.Contacts.add(from, to)
+		b.Contacts.add(to, from)
+		return true, b.save()
+	}
+	b.Requests.add(to, from)
+	return false, b.save()
+}
+
+func (b *contactBook) Accept(owner string, from string) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if !b.Requests[owner][from] {
+		return ErrNoContactRequest
+	}
+	b.Requests.remove(owner, from)
+	b.Contacts.add(owner, from)
+	b.Contacts.add(from, owner)
+	return b.save()
+}
+
+func (b *contactBook) Block(owner string, other string) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.Contacts.remove(owner, other)
+	b.Contacts.remove(other, owner)
+	b.Requests.remove(owner, other)
+	b.Requests.remove(other, owner)
+	b.Blocked.add(owner, other)
+	return b.save()
+}
+
+func (b *contactBook) AreContacts(first string, second string) bool {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return b.Contacts[first][second]
+}
+
+func (b *contactBook) List(owner string) ContactList {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return ContactList{
+		Contacts: b.Contacts.list(owner),
+		Requests: b.Requests.list(owner),
+		Blocked:  b.Blocked.list(owner),
+	}
+}
+
+// Replaces the file atomically, the caller holds the lock
+func (b *contactBook) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(b.path, data)
+}
+
+// Sends the contact request to every chat and multiplexed session of the
+// recipient. The waiting clients aren't notified, since they expect nothing
+// but their interlocutor.
+// The slow connections mustn't hold the lock, so they are collected first.
+func (s *DHServer) notifyContactRequest(to string, from string) {
+	var recipients []*DHClient
+	var conns []net.Conn
+	s.clientsMut.RLock()
+	for client := range s.clients {
+		// The multiplexed session gets it via the control stream, not via the chats
+		if client.name == to && (client.isMuxSession() || !client.pairedAt.IsZero() && client.session == nil) {
+			recipients = append(recipients, client)
+			conns = append(conns, client.conn)
+		}
+	}
+	s.clientsMut.RUnlock()
+	for i, client := range recipients {
+		if err := communication.SendMessage(conns[i], constants.CONTACT_REQUEST+constants.DATA_SEPARATOR+from); err != nil {
+			client.logger.Debug("Couldn't send the contact request", "error", err)
+		}
+	}
+}
+
+// Handles the contact commands of the client, replying with the updated list
+// of its contacts, or with the error
+func (s *DHServer) handleContactCommand(conn net.Conn, clientName string, logger *slog.Logger, signal string, name string) error {
+	var err error
+	switch signal {
+	case constants.CONTACT_ACCEPT:
+		err = s.contacts.Accept(clientName, name)
+	case constants.CONTACT_BLOCK:
+		if err = validateAddress(name); err == nil {
+			err = s.contacts.Block(clientName, name)
+		}
+	}
+	if err != nil {
+		logger.Info("Contact command failed", "command", signal, "error", err)
+		return communication.SendMessage(conn, constants.CONTACT_ERROR+constants.DATA_SEPARATOR+err.Error())
+	}
+	if signal != constants.CONTACTS {
+		logger.Info("Contacts changed", "command", signal, "contact", name)
+	}
+	list, err := json.Marshal(s.contacts.List(clientName))
+	if err != nil {
+		return err
+	}
+	return communication.SendMessage(conn, constants.CONTACT_LIST+constants.DATA_SEPARATOR+string(list))
+}
@@ -0,0 +1,36 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+)
+
+func TestContactRequestReachesOnlyChats(t *testing.T) {
+	_, address, _ := startServer(t, WithLimits(Limits{}))
+	// The waiting alice expects nothing but bob, so carol's request would break its login
+	waiting := dial(t, address)
+	if response := login(t, waiting, identityOf("alice"), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	if response := login(t, dial(t, address), identityOf("carol"), "carol:alice", "carol"); response != constants.CONTACT_REQUESTED {
+		t.Fatalf("carol got %q", response)
+	}
+	bob := dial(t, address)
+	found := login(t, bob, identityOf("bob"), "bob:alice", "bob")
+	if message := read(t, waiting); message != found {
+		t.Fatalf("alice got %q instead of the secrets", message)
+	}
+	waiting.Close()
+	bob.Close()
+
+	// Once chatting, alice learns about dave's request
+	alice, _ := pair(t, address)
+	aliceMessages := answerPings(alice)
+	if response := login(t, dial(t, address), identityOf("dave"), "dave:alice", "dave"); response != constants.CONTACT_REQUESTED {
+		t.Fatalf("dave got %q", response)
+	}
+	if message := awaitSignal(t, aliceMessages, constants.CONTACT_REQUEST); message != constants.CONTACT_REQUEST+constants.DATA_SEPARATOR+"dave" {
+		t.Fatalf("alice got %q", message)
+	}
+}
@@ -0,0 +1,314 @@
+package types
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/internal/server/actions"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+var ErrLinkRefused = errors.New("federated server refused the link")
+
+// Federation links the server with the servers of other offices, so their
+// clients chat with each other by the addresses "name@server". The chat of
+// two servers is hosted by the one, whose name goes first, and the other one
+// forwards the chat of its client to the host over the link.
+type Federation struct {
+	// Name of the server in the addresses of its clients
+	Name string
+	// Address of the listener of the links, e.g. :9443, disabled if empty
+	Address string
+	// Addresses of the federated servers by their names
+	Peers map[string]string
+	// Mutual TLS of the links, every server presents the certificate for the
+	// host it's dialed at
+	TLS transport.TLS
+}
+
+type federation struct {
+	Federation
+	// Links dialed by the server, the streams of the chats are opened on them
+	links map[string]*communication.Multiplexer
+	mut   sync.Mutex
+}
+
+func newFederation(config Federation) *federation {
+	return &federation{Federation: config, links: make(map[string]*communication.Multiplexer)}
+}
+
+// Finds the server, which hosts the chat with the interlocutor, and the name
+// of the interlocutor there. The empty server means the chat is hosted locally.
+func (s *DHServer) hostOf(interlocutor string) (string, string, error) {
+	name, home, federated := strings.Cut(interlocutor, constants.SERVER_SEPARATOR)
+	if !federated {
+		return "", interlocutor, nil
+	}
+	if s.federation == nil {
+		return "", "", ErrUnknownServer
+	}
+	if home == s.federation.Name {
+		return "", name, nil
+	}
+	if _, ok := s.federation.Peers[home]; !ok {
+		return "", "", ErrUnknownServer
+	}
+	// Both servers agree on the host without asking each other
+	if s.federation.Name < home {
+		return "", interlocutor, nil
+	}
+	return home, name, nil
+}
+
+// Returns the link to the federated server, dialing it if there is none yet
+func (s *DHServer) link(server string) (*communication.Multiplexer, error) {
+	f := s.federation
+	f.mut.Lock()
+	link, ok := f.links[server]
+	f.mut.Unlock()
+	if ok && link.Err() == nil {
+		return link, nil
+	}
+	// The dial isn't locked, so the unreachable server doesn't hold up the others
+	dialed, err := s.dialLink(server)
+	if err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	// The link dialed meanwhile is kept, so the chats share the same one
+	if link, ok := f.links[server]; ok && link.Err() == nil {
+		dialed.Close()
+		return link, nil
+	}
+	f.links[server] = dialed
+	go s.closeOnQuit(dialed)
+	s.logger.Info("Linked to the federated server", "server", server)
+	return dialed, nil
+}
+
+// Dials the federated server and introduces this one, the dial is limited
+// with the handshake timeout
+func (s *DHServer) dialLink(server string) (*communication.Multiplexer, error) {
+	f := s.federation
+	dialer := f.TLS
+	dialer.Timeout = s.timeouts.Handshake
+	conn, err := dialer.Dial(&url.URL{Scheme: "tls", Host: f.Peers[server]})
+	if err != nil {
+		return nil, err
+	}
+	// The server introduces itself, and its certificate proves the name
+	_ = conn.SetDeadline(s.clock.Now().Add(s.timeouts.Handshake))
+	if err = communication.SendMessage(conn, constants.FEDERATE+constants.DATA_SEPARATOR+f.Name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+	if err != nil || reply != constants.FEDERATED {
+		conn.Close()
+		return nil, errors.Join(ErrLinkRefused, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return communication.NewMultiplexer(conn, true), nil
+}
+
+// The links are closed after the clients are notified about the shutdown
+func (s *DHServer) closeOnQuit(link *communication.Multiplexer) {
+	select {
+	case <-s.quit:
+	case <-link.Done():
+	}
+	link.Close()
+}
+
+// Carries the chat of the client to the server, which hosts it. The host
+// drives the chat, so the messages are copied as they are.
+func (s *DHServer) forwardChat(conn net.Conn, clientName string, interlocutor string, server string, logger *slog.Logger) {
+	logger = logger.With("server", server)
+	link, err := s.link(server)
+	var stream net.Conn
+	if err == nil {
+		stream, err = link.Open()
+	}
+	if err != nil {
+		logger.Warn("Federated server is unreachable", "error", err)
+		s.metrics.errors.Inc(ERROR_FEDERATION)
+		if err = communication.SendMessage(conn, constants.SERVER_UNREACHABLE); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	defer stream.Close()
+	// The host knows the client by its name only, the server is added by the host
+	if err = communication.SendMessage(stream, clientName+constants.DATA_SEPARATOR+interlocutor); err != nil {
+		logger.Warn("Couldn't forward the login", "error", err)
+		return
+	}
+	logger.Info("Chat is forwarded to the federated server")
+	// The admin lists and kicks the client, while the host drives its chat
+	client := newDHClient(conn, clientName, interlocutor+constants.SERVER_SEPARATOR+server, logger)
+	client.joinChat(newChat(), 0)
+	s.registerClient(client)
+	s.markPaired(client)
+	defer s.unregisterClient(client)
+	// The host pings the client, so the silence is limited with the idle timeout only
+	establish(conn)
+	splice(conn, stream)
+	logger.Info("Forwarded chat is over")
+}
+
+// Copies the messages both ways, until either side is closed. Every message
+// is written whole, so the notices of the admin can't split them.
+func splice(first net.Conn, second net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		buffer := make([]byte, constants.BUFFER_SIZE)
+		for {
+			message, err := communication.ReadMessage(src, buffer)
+			if err != nil || communication.SendMessage(dst, message) != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(first, second)
+	go copyHalf(second, first)
+	<-done
+	first.Close()
+	second.Close()
+	<-done
+}
+
+// Accepts the links of the federated servers until the listener is closed
+func (s *DHServer) acceptLinks(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Federation listener error", "error", err)
+			}
+			return
+		}
+		go s.serveLink(conn)
+	}
+}
+
+// Verifies the federated server of the link and serves the chats, which it forwards
+func (s *DHServer) serveLink(conn net.Conn) {
+	logger := s.logger.With("remote_addr", conn.RemoteAddr().String())
+	_ = conn.SetDeadline(s.clock.Now().Add(s.timeouts.Handshake))
+	server, err := s.verifyLink(conn)
+	if err != nil {
+		logger.Warn("Federated link is refused", "error", err)
+		s.metrics.errors.Inc(ERROR_FEDERATION)
+		conn.Close()
+		return
+	}
+	if err = communication.SendMessage(conn, constants.FEDERATED); err != nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	logger = logger.With("server", server)
+	logger.Info("Federated server is linked")
+
+	link := communication.NewMultiplexer(conn, false)
+	go s.closeOnQuit(link)
+	for {
+		stream, err := link.Accept()
+		if err != nil {
+			logger.Info("Federated link is closed", "error", err)
+			return
+		}
+		s.serveForwarded(stream, server)
+	}
+}
+
+// The server names itself in the first message, and its certificate must be
+// valid for the host it's dialed at
+func (s *DHServer) verifyLink(conn net.Conn) (string, error) {
+	hello, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+	if err != nil {
+		return "", err
+	}
+	signal, server := communication.ParseSignal(hello, constants.DATA_SEPARATOR)
+	address, ok := s.federation.Peers[server]
+	if signal != constants.FEDERATE || !ok {
+		return "", ErrUnknownServer
+	}
+	tlsConn, ok := transport.Raw(conn).(*tls.Conn)
+	if !ok {
+		return "", ErrLinkRefused
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return "", ErrLinkRefused
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if err = certificates[0].VerifyHostname(host); err != nil {
+		return "", err
+	}
+	return server, nil
+}
+
+// Spawns the handler of the chat, forwarded by the federated server. The
+// clients of the server share its address, so they are limited by the server
+// itself, rather than by the quotas.
+func (s *DHServer) serveForwarded(stream net.Conn, server string) {
+	conn := communication.NewTimedConn(stream, s.timeouts)
+	s.trackConnection(conn)
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		defer s.recoverHandler(conn)
+		s.handleForwarded(conn, server)
+	}()
+}
+
+// Pairs the client of the federated server, which is already authenticated
+// there, as if it was connected directly
+func (s *DHServer) handleForwarded(conn net.Conn, server string) {
+	logger := s.logger.With("server", server)
+	defer s.untrackConnection(conn)
+	defer func() { actions.CloseConnection(conn, logger) }()
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	login, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		s.metrics.errors.Inc(ERROR_READ)
+		return
+	}
+	clientName, interlocutor, err := ParseLogin(login)
+	// The server forwards the chats with the local clients only
+	if err == nil {
+		err = validateName(interlocutor)
+	}
+	if err != nil {
+		logger.Warn("Invalid forwarded login", "error", err, "bytes", len(login))
+		s.metrics.errors.Inc(ERROR_LOGIN)
+		if err = communication.SendMessage(conn, loginRefusals[err]); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	clientName += constants.SERVER_SEPARATOR + server
+	logger = logger.With("client", clientName, "interlocutor", interlocutor)
+	if s.InMaintenance() {
+		logger.Info("Client is refused due to the maintenance")
+		if err = communication.SendMessage(conn, constants.SERVER_MAINTENANCE); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	s.pairClient(conn, buffer, clientName, interlocutor, true, logger)
+}
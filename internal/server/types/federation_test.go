@@ -0,0 +1,198 @@
+package types
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// Listens for the links, but never answers them
+func silentServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// The connection is kept until the dialer gives up
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// The address, which refuses the connections
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+// The unresponsive server fails its link in time, and doesn't hold up the
+// links of the other servers meanwhile
+func TestUnresponsiveFederatedServer(t *testing.T) {
+	const handshake = time.Second
+	server := NewDHServer(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithTimeouts(communication.Timeouts{Handshake: handshake}),
+		WithFederation(Federation{Name: "hq", Peers: map[string]string{"branch": silentServer(t), "closed": closedAddress(t)}}),
+	)
+	linked := make(chan error, 1)
+	started := time.Now()
+	go func() {
+		_, err := server.link("branch")
+		linked <- err
+	}()
+	// The other link is refused right away, while the first one is dialed
+	time.Sleep(100 * time.Millisecond)
+	refused := make(chan error, 1)
+	go func() {
+		_, err := server.link("closed")
+		refused <- err
+	}()
+	select {
+	case err := <-refused:
+		if err == nil {
+			t.Fatal("closed server is linked")
+		}
+	case <-time.After(handshake / 2):
+		t.Fatal("link waits for the other server")
+	}
+	select {
+	case err := <-linked:
+		if err == nil {
+			t.Fatal("silent server is linked")
+		}
+		if elapsed := time.Since(started); elapsed < handshake/2 {
+			t.Fatalf("link failed after %s only", elapsed)
+		}
+	case <-time.After(5 * handshake):
+		t.Fatal("dial of the silent server isn't limited")
+	}
+}
+
+// The forwarded client resumes via its own server, which doesn't know the
+// tickets of the host, so it gets none, and its interlocutor isn't held
+// waiting for it
+func TestForwardedChatIsntResumable(t *testing.T) {
+	server, address, _ := startServer(t,
+		WithLimits(Limits{}),
+		WithContacts(mutualContacts(t, "alice@branch", "bob")),
+		WithFederation(Federation{Name: "alpha", Peers: map[string]string{"branch": closedAddress(t)}}))
+	forwarded, branch := net.Pipe()
+	t.Cleanup(func() { branch.Close() })
+	server.serveForwarded(forwarded, "branch")
+	if err := communication.SendMessage(branch, "alice:bob"); err != nil {
+		t.Fatal(err)
+	}
+	if response := read(t, branch); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	bob := dial(t, address)
+	found := login(t, bob, identityOf("bob"), "bob:alice@branch", "bob")
+	if message := read(t, branch); message != found {
+		t.Fatalf("alice got %q instead of the secrets", message)
+	}
+	for _, conn := range []net.Conn{branch, bob} {
+		go communication.SendMessage(conn, "5")
+	}
+	for _, conn := range []net.Conn{branch, bob} {
+		if message := read(t, conn); message != constants.CHAT_CONFIRMED+constants.DATA_SEPARATOR+"5" {
+			t.Fatalf("got %q instead of the confirmation", message)
+		}
+	}
+	readUntil(t, bob, constants.SESSION_TICKET)
+	aliceMessages, bobMessages := answerPings(branch), answerPings(bob)
+	if err := communication.SendMessage(bob, constants.CHAT_MESSAGE+constants.DATA_SEPARATOR+"hi"); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-aliceMessages; message != constants.CHAT_MESSAGE+constants.DATA_SEPARATOR+"hi" {
+		t.Fatalf("alice got %q instead of the message", message)
+	}
+
+	// Bob learns right away that alice is gone for good
+	branch.Close()
+	if message := awaitSignal(t, bobMessages, constants.PEER_LEFT); message != constants.PEER_LEFT {
+		t.Fatalf("bob got %q", message)
+	}
+}
+
+// The client, whose chat is forwarded to the host, is listed and kicked by
+// the admin of its own server
+func TestForwardedClientIsKicked(t *testing.T) {
+	server, address, _ := startServer(t,
+		WithLimits(Limits{}),
+		WithFederation(Federation{Name: "zulu", Peers: map[string]string{"branch": closedAddress(t)}}))
+	// The host of the chats is played by the test over the link
+	home, host := net.Pipe()
+	link := communication.NewMultiplexer(home, true)
+	hostLink := communication.NewMultiplexer(host, false)
+	t.Cleanup(func() {
+		link.Close()
+		hostLink.Close()
+	})
+	server.federation.links["branch"] = link
+
+	// The host answers the forwarded login, so the client learns it's waiting
+	forwarded := make(chan net.Conn, 1)
+	go func() {
+		stream, err := hostLink.Accept()
+		if err != nil {
+			close(forwarded)
+			return
+		}
+		if message, err := communication.ReadMessage(stream, make([]byte, constants.BUFFER_SIZE)); err != nil || message != "alice:bob" {
+			close(forwarded)
+			return
+		}
+		_ = communication.SendMessage(stream, constants.NO_INTERLOCUTOR)
+		forwarded <- stream
+	}()
+	alice := dial(t, address)
+	if response := login(t, alice, identityOf("alice"), "alice:bob@branch", "alice"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	stream, ok := <-forwarded
+	if !ok {
+		t.Fatal("login isn't forwarded")
+	}
+
+	chats := server.ActiveChats()
+	if len(chats) != 1 || len(chats[0].Clients) != 1 || chats[0].Clients[0].Name != "alice" || chats[0].Clients[0].Interlocutor != "bob@branch" {
+		t.Fatalf("chats are %+v", chats)
+	}
+	// The pipe is synchronous, so the notice is written, while alice reads it
+	kicked := make(chan bool, 1)
+	go func() { kicked <- server.KickClient("alice") }()
+	if message := read(t, alice); message != constants.CLIENT_KICKED {
+		t.Fatalf("alice got %q instead of the kick", message)
+	}
+	if !<-kicked {
+		t.Fatal("alice isn't found")
+	}
+	// The host learns the client is gone from its stream
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := communication.ReadMessage(stream, make([]byte, constants.BUFFER_SIZE)); !errors.Is(err, io.EOF) {
+		t.Fatalf("forwarded stream ended with %v", err)
+	}
+}
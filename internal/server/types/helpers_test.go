@@ -0,0 +1,282 @@
+package types
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+var errServerRunning = errors.New("server didn't stop in time")
+
+func testParameters() (*big.Int, *big.Int, error) {
+	p, _ := new(big.Int).SetString(diffiehellman.MODP_2048_PRIME, 16)
+	return p, big.NewInt(2), nil
+}
+
+// Serves the server on a fresh in-memory address. The returned stop cancels
+// the serving, and returns the result of Serve.
+func startServer(t *testing.T, options ...Option) (*DHServer, string, func() error) {
+	t.Helper()
+	address := "mem://" + strings.ReplaceAll(t.Name(), "/", "-")
+	listener, err := transport.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serve(t, listener, options...)
+	return server, address, stop
+}
+
+// Serves the server on the listener until the returned stop is called
+func serve(t *testing.T, listener net.Listener, options ...Option) (*DHServer, func() error) {
+	t.Helper()
+	options = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))), WithParameterSource(testParameters), WithContacts(mutualContacts(t, "alice", "bob"))}, options...)
+	server := NewDHServer(options...)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, listener) }()
+	stopped := false
+	stop := func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		cancel()
+		select {
+		case err := <-served:
+			return err
+		case <-time.After(10 * time.Second):
+			return errServerRunning
+		}
+	}
+	t.Cleanup(func() { _ = stop() })
+	return server, stop
+}
+
+func dial(t *testing.T, address string) net.Conn {
+	t.Helper()
+	conn, err := transport.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Identity of the name, the same in every login
+func identityOf(name string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte(name))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+func newIdentity(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Makes every pair of the names the contacts of each other
+func mutualContacts(t *testing.T, names ...string) ContactStorage {
+	t.Helper()
+	contacts := NewMemoryContacts()
+	for i, first := range names {
+		for _, second := range names[i+1:] {
+			if _, err := contacts.Request(first, second); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := contacts.Request(second, first); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return contacts
+}
+
+// Sends the login, answers the challenge with the key, and returns the next
+// message of the server
+func login(t *testing.T, conn net.Conn, key ed25519.PrivateKey, clientData string, name string) string {
+	t.Helper()
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	if err := communication.SendMessage(conn, clientData); err != nil {
+		t.Fatal(err)
+	}
+	challenge := read(t, conn)
+	signal, nonce := communication.ParseSignal(challenge, constants.DATA_SEPARATOR)
+	if signal != constants.AUTH_CHALLENGE {
+		return challenge
+	}
+	response := constants.AUTH_RESPONSE + constants.DATA_SEPARATOR +
+		identity.EncodePublicKey(key.Public().(ed25519.PublicKey)) + constants.DATA_SEPARATOR + identity.Sign(key, name, nonce)
+	if err := communication.SendMessage(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	message, err := communication.ReadMessage(conn, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func read(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	message, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// Reads the messages until the one of the signal, skipping the rest
+func readUntil(t *testing.T, conn net.Conn, signal string) string {
+	t.Helper()
+	for {
+		message := read(t, conn)
+		if received, _ := communication.ParseSignal(message, constants.DATA_SEPARATOR); received == signal {
+			return message
+		}
+	}
+}
+
+// Pairs alice and bob, and returns their connections of the established chat.
+// The session tickets are read already.
+func pair(t *testing.T, address string) (net.Conn, net.Conn) {
+	t.Helper()
+	alice, bob, _, _ := pairWithTickets(t, address)
+	return alice, bob
+}
+
+// Pairs alice and bob, and returns their connections and session tickets.
+// The server only relays the salts, so any will do.
+func pairWithTickets(t *testing.T, address string) (net.Conn, net.Conn, string, string) {
+	t.Helper()
+	alice, bob := dial(t, address), dial(t, address)
+	if response := login(t, alice, identityOf("alice"), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	found := login(t, bob, identityOf("bob"), "bob:alice", "bob")
+	if signal, _ := communication.ParseSignal(found, constants.DATA_SEPARATOR); signal != constants.INTERLOCUTOR_FOUND {
+		t.Fatalf("bob got %q instead of the interlocutor", found)
+	}
+	if message := read(t, alice); message != found {
+		t.Fatalf("alice got %q instead of the secrets", message)
+	}
+	for _, conn := range []net.Conn{alice, bob} {
+		go communication.SendMessage(conn, "5")
+	}
+	for _, conn := range []net.Conn{alice, bob} {
+		if message := read(t, conn); message != constants.CHAT_CONFIRMED+constants.DATA_SEPARATOR+"5" {
+			t.Fatalf("got %q instead of the confirmation", message)
+		}
+	}
+	// The pipes are synchronous, so the tickets are taken before the chat goes on
+	_, aliceTicket := communication.ParseSignal(readUntil(t, alice, constants.SESSION_TICKET), constants.DATA_SEPARATOR)
+	_, bobTicket := communication.ParseSignal(readUntil(t, bob, constants.SESSION_TICKET), constants.DATA_SEPARATOR)
+	return alice, bob, aliceTicket, bobTicket
+}
+
+// Answers the pings of the server in the background, like the real client
+// does, and passes the rest of the messages on. The channel is closed along
+// with the connection.
+func answerPings(conn net.Conn) <-chan string {
+	messages := make(chan string, constants.CHAT_QUEUE_SIZE)
+	go func() {
+		defer close(messages)
+		buffer := make([]byte, constants.BUFFER_SIZE)
+		for {
+			message, err := communication.ReadMessage(conn, buffer)
+			if err != nil {
+				return
+			}
+			if signal, payload := communication.ParseSignal(message, constants.DATA_SEPARATOR); signal == constants.PING {
+				go communication.SendMessage(conn, constants.PONG+constants.DATA_SEPARATOR+payload)
+				continue
+			}
+			messages <- message
+		}
+	}()
+	return messages
+}
+
+// Waits for the message of the signal, skipping the rest
+func awaitSignal(t *testing.T, messages <-chan string, signal string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				t.Fatalf("connection is closed before %s", signal)
+			}
+			if received, _ := communication.ParseSignal(message, constants.DATA_SEPARATOR); received == signal {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("no %s in time", signal)
+		}
+	}
+}
+
+// Waits for the end of the idle chat. The handler, which notices it first,
+// sends IDLE_TIMEOUT_EXCEEDED, while the interlocutor may learn it's over from
+// INTERLOCUTOR_IDLE instead.
+func awaitIdleEnd(t *testing.T, messages <-chan string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				t.Fatal("connection is closed before the chat is idle")
+			}
+			if signal, _ := communication.ParseSignal(message, constants.DATA_SEPARATOR); signal == constants.IDLE_TIMEOUT_EXCEEDED || signal == constants.INTERLOCUTOR_IDLE {
+				return signal
+			}
+		case <-timeout:
+			t.Fatal("chat isn't idle in time")
+		}
+	}
+}
+
+// Both sides learn the chat is idle, and at least one of them from its own handler
+func awaitIdleChat(t *testing.T, first <-chan string, second <-chan string) {
+	t.Helper()
+	firstSignal, secondSignal := awaitIdleEnd(t, first), awaitIdleEnd(t, second)
+	if firstSignal != constants.IDLE_TIMEOUT_EXCEEDED && secondSignal != constants.IDLE_TIMEOUT_EXCEEDED {
+		t.Fatal("neither side got IDLE_TIMEOUT_EXCEEDED")
+	}
+}
+
+// Waits until every connection of the server is released by its handler
+func waitReleased(t *testing.T, server *DHServer) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		server.connMut.Lock()
+		connections := len(server.connections)
+		server.connMut.Unlock()
+		if connections == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections are still handled", connections)
+		}
+	}
+}
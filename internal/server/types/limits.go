@@ -0,0 +1,140 @@
+package types
+
+import (
+	"net"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/ratelimit"
+)
+
+// Limits protects the server from the connection and message floods.
+// Zero values disable the corresponding limit.
+type Limits struct {
+	// Maximum number of simultaneous connections
+	MaxConnections int
+	// Maximum number of simultaneous connections from a single IP
+	MaxConnectionsPerIP int
+	// Rate of the logins from a single IP, per second. Every login costs an
+	// identity check and may register a name, so it must be kept low.
+	HandshakeRate  float64
+	HandshakeBurst int
+	// Rate of the relayed messages of a single connection, per second
+	MessageRate  float64
+	MessageBurst int
+	// Rate of the relayed control messages of a single connection, per second
+	ControlRate  float64
+	ControlBurst int
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxConnections:      constants.MAX_CONNECTIONS,
+		MaxConnectionsPerIP: constants.MAX_CONNECTIONS_PER_IP,
+		HandshakeRate:       constants.HANDSHAKE_RATE,
+		HandshakeBurst:      constants.HANDSHAKE_BURST,
+		MessageRate:         constants.MESSAGE_RATE,
+		MessageBurst:        constants.MESSAGE_BURST,
+		ControlRate:         constants.CONTROL_RATE,
+		ControlBurst:        constants.CONTROL_BURST,
+	}
+}
+
+// WithLimits replaces the default connection and rate limits
+func WithLimits(limits Limits) Option {
+	return func(s *DHServer) { s.limits = limits }
+}
+
+// State of a single remote IP
+type peerQuota struct {
+	connections int
+	handshakes  *ratelimit.Bucket
+}
+
+type quotas struct {
+	connections int
+	peers       map[string]*peerQuota
+	mut         sync.Mutex
+}
+
+func newQuotas() *quotas {
+	return &quotas{peers: make(map[string]*peerQuota)}
+}
+
+// Returns the IP of the remote address, or an empty string, if the transport
+// has none, e.g. unix:// or mem://. Such clients don't share a quota, since
+// they can't be told apart.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// Reserves a connection slot for the IP, if the limits allow it. The
+// connections without the IP are limited by the total number only.
+func (s *DHServer) acquireConnection(ip string) bool {
+	s.quotas.mut.Lock()
+	defer s.quotas.mut.Unlock()
+	if s.limits.MaxConnections > 0 && s.quotas.connections >= s.limits.MaxConnections {
+		return false
+	}
+	if ip == "" {
+		s.quotas.connections++
+		return true
+	}
+	peer := s.peerQuota(ip)
+	if s.limits.MaxConnectionsPerIP > 0 && peer.connections >= s.limits.MaxConnectionsPerIP {
+		return false
+	}
+	s.quotas.connections++
+	peer.connections++
+	return true
+}
+
+func (s *DHServer) releaseConnection(ip string) {
+	s.quotas.mut.Lock()
+	defer s.quotas.mut.Unlock()
+	s.quotas.connections--
+	if peer, ok := s.quotas.peers[ip]; ok {
+		peer.connections--
+	}
+	// Idle peers are forgotten only when their buckets are refilled,
+	// otherwise reconnecting would reset the limit
+	now := s.clock.Now()
+	for peerIP, peer := range s.quotas.peers {
+		if peer.connections <= 0 && peer.handshakes.Full(now) {
+			delete(s.quotas.peers, peerIP)
+		}
+	}
+}
+
+// Takes a handshake token of the IP, the handshakes without the IP aren't limited
+func (s *DHServer) allowHandshake(ip string) bool {
+	if ip == "" {
+		return true
+	}
+	s.quotas.mut.Lock()
+	peer := s.peerQuota(ip)
+	s.quotas.mut.Unlock()
+	return peer.handshakes.Allow(s.clock.Now())
+}
+
+// Must be called with the quotas lock held
+func (s *DHServer) peerQuota(ip string) *peerQuota {
+	peer, ok := s.quotas.peers[ip]
+	if !ok {
+		peer = &peerQuota{handshakes: ratelimit.NewBucket(s.limits.HandshakeRate, s.limits.HandshakeBurst, s.clock.Now())}
+		s.quotas.peers[ip] = peer
+	}
+	return peer
+}
+
+func (s *DHServer) newMessageBucket() *ratelimit.Bucket {
+	return ratelimit.NewBucket(s.limits.MessageRate, s.limits.MessageBurst, s.clock.Now())
+}
+
+func (s *DHServer) newControlBucket() *ratelimit.Bucket {
+	return ratelimit.NewBucket(s.limits.ControlRate, s.limits.ControlBurst, s.clock.Now())
+}
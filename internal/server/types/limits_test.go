@@ -0,0 +1,182 @@
+package types
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+// Pretends the in-memory connections come over TCP from the same IP, so the
+// per-IP quotas apply to them
+type tcpListener struct {
+	net.Listener
+}
+
+func (l tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tcpConn{conn, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1024 + rand.Intn(60000)}}, nil
+}
+
+type tcpConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c tcpConn) RemoteAddr() net.Addr { return c.remote }
+
+func startTCPServer(t *testing.T, limits Limits, options ...Option) string {
+	t.Helper()
+	address := "mem://" + strings.ReplaceAll(t.Name(), "/", "-")
+	listener, err := transport.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, tcpListener{listener}, append(options, WithLimits(limits))...)
+	return address
+}
+
+func TestConnectionFlood(t *testing.T) {
+	address := startTCPServer(t, Limits{MaxConnections: 2})
+	dial(t, address)
+	dial(t, address)
+	if message := read(t, dial(t, address)); message != constants.TOO_MANY_CONNECTIONS {
+		t.Fatalf("got %q instead of the rejection", message)
+	}
+
+	// The refused clients, which never read, mustn't stall the accept loop
+	start := time.Now()
+	var flood sync.WaitGroup
+	for i := 0; i < 4*constants.MAX_PENDING_REJECTIONS; i++ {
+		flood.Add(1)
+		go func() {
+			defer flood.Done()
+			if conn, err := transport.Dial(address); err == nil {
+				t.Cleanup(func() { conn.Close() })
+			}
+		}()
+	}
+	flood.Wait()
+	if elapsed := time.Since(start); elapsed >= constants.REJECTION_WRITE_TIMEOUT*time.Second {
+		t.Fatalf("flood stalled the accept loop for %v", elapsed)
+	}
+}
+
+func TestConnectionsPerIP(t *testing.T) {
+	address := startTCPServer(t, Limits{MaxConnectionsPerIP: 1})
+	first := dial(t, address)
+	if message := read(t, dial(t, address)); message != constants.TOO_MANY_CONNECTIONS {
+		t.Fatalf("got %q instead of the rejection", message)
+	}
+	// The slot is released with the connection, so the next one waits for
+	// the login instead of the rejection
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn := dial(t, address)
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		message, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+		if communication.IsTimeout(err) {
+			break
+		}
+		if message != constants.TOO_MANY_CONNECTIONS || time.Now().After(deadline) {
+			t.Fatalf("got %q, %v after the slot is released", message, err)
+		}
+	}
+}
+
+// The clients without the IP, e.g. the local ones, don't share a per-IP
+// quota, but the global limit still applies to them
+func TestConnectionsWithoutIP(t *testing.T) {
+	server, address, _ := startServer(t, WithLimits(Limits{MaxConnections: 3, MaxConnectionsPerIP: 1, HandshakeRate: 0.001, HandshakeBurst: 1}))
+	carol := newIdentity(t)
+	for i := 0; i < 2; i++ {
+		if message := login(t, dial(t, address), carol, "carol:dave", "carol"); message != constants.CONTACT_REQUESTED {
+			t.Fatalf("login %d got %q", i, message)
+		}
+	}
+	waitReleased(t, server)
+	for i := 0; i < 3; i++ {
+		dial(t, address)
+	}
+	if message := read(t, dial(t, address)); message != constants.TOO_MANY_CONNECTIONS {
+		t.Fatalf("got %q instead of the rejection", message)
+	}
+}
+
+func TestHandshakeFlood(t *testing.T) {
+	address := startTCPServer(t, Limits{HandshakeRate: 0.001, HandshakeBurst: 2})
+	carol := newIdentity(t)
+	for i := 0; i < 2; i++ {
+		if message := login(t, dial(t, address), carol, "carol:dave", "carol"); message != constants.CONTACT_REQUESTED {
+			t.Fatalf("login %d got %q", i, message)
+		}
+	}
+	if message := login(t, dial(t, address), carol, "carol:dave", "carol"); message != constants.RATE_LIMITED {
+		t.Fatalf("got %q instead of the rate limit", message)
+	}
+}
+
+func TestMessageFlood(t *testing.T) {
+	_, address, _ := startServer(t, WithLimits(Limits{MessageRate: 0.001, MessageBurst: 2}))
+	alice, bob := pair(t, address)
+	for i := 0; i < 3; i++ {
+		message := fmt.Sprintf("%s%s%d", constants.CHAT_MESSAGE, constants.DATA_SEPARATOR, i)
+		if err := communication.SendMessage(alice, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readUntil(t, alice, constants.MESSAGE_RATE_LIMITED)
+	for i := 0; i < 2; i++ {
+		if message := readUntil(t, bob, constants.CHAT_MESSAGE); message != fmt.Sprintf("%s%s%d", constants.CHAT_MESSAGE, constants.DATA_SEPARATOR, i) {
+			t.Fatalf("bob got %q", message)
+		}
+	}
+}
+
+// The receipts don't use up the messages, and have the limits of their own
+func TestControlFlood(t *testing.T) {
+	_, address, _ := startServer(t, WithLimits(Limits{MessageRate: 0.001, MessageBurst: 1, ControlRate: 0.001, ControlBurst: 2}))
+	alice, bob := pair(t, address)
+	messages := []string{
+		constants.CHAT_CONTROL + ":0",
+		constants.CHAT_CONTROL + ":1",
+		constants.CHAT_MESSAGE + ":hello",
+		// Over the size and over the rate, both are dropped quietly
+		constants.CHAT_CONTROL + constants.DATA_SEPARATOR + strings.Repeat("x", constants.MAX_CONTROL_SIZE),
+		constants.CHAT_CONTROL + ":2",
+	}
+	for _, message := range messages {
+		if err := communication.SendMessage(alice, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range messages[:3] {
+		if message := read(t, bob); message != want {
+			t.Fatalf("bob got %q instead of %q", message, want)
+		}
+	}
+	// The pong follows the handling of the rest, and nothing is relayed after them
+	if err := communication.SendMessage(alice, constants.PING+":1"); err != nil {
+		t.Fatal(err)
+	}
+	for message := read(t, alice); message != constants.PONG+":1"; message = read(t, alice) {
+		// The controls didn't use up the message
+		if message == constants.MESSAGE_RATE_LIMITED {
+			t.Fatal("message is limited after the controls")
+		}
+	}
+	_ = bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if message, err := communication.ReadMessage(bob, make([]byte, constants.BUFFER_SIZE)); err == nil {
+		t.Fatalf("bob got %q over the limits", message)
+	}
+}
@@ -0,0 +1,104 @@
+package types
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+)
+
+// Refusals of the malformed logins, each one is replied with its own signal
+var (
+	ErrMalformedLogin = errors.New("login must be in the format name:interlocutor")
+	ErrNameRequired   = errors.New("both names are required")
+	ErrNameTooLong    = errors.New("name is too long")
+	ErrInvalidName    = errors.New("name contains disallowed characters")
+	ErrReservedName   = errors.New("name is reserved")
+	ErrUnknownServer  = errors.New("server of the name isn't federated")
+)
+
+var loginRefusals = map[error]string{
+	ErrMalformedLogin: constants.MALFORMED_LOGIN,
+	ErrNameRequired:   constants.NAME_REQUIRED,
+	ErrNameTooLong:    constants.NAME_TOO_LONG,
+	ErrInvalidName:    constants.INVALID_NAME,
+	ErrReservedName:   constants.RESERVED_NAME,
+	ErrUnknownServer:  constants.UNKNOWN_SERVER,
+}
+
+// Names, which could be mistaken for the server itself, compared case-insensitively
+var reservedNames = map[string]struct{}{
+	"admin":     {},
+	"server":    {},
+	"system":    {},
+	"resume":    {},
+	"lobby":     {},
+	"multiplex": {},
+}
+
+// Parses the first message of the client, which is in the format
+// "name:interlocutor". The interlocutor of another server is addressed as
+// "name@server".
+func ParseLogin(message string) (string, string, error) {
+	parts := strings.Split(message, constants.DATA_SEPARATOR)
+	if len(parts) != 2 {
+		return "", "", ErrMalformedLogin
+	}
+	if err := validateName(parts[0]); err != nil {
+		return "", "", err
+	}
+	if err := validateAddress(parts[1]); err != nil {
+		return "", "", err
+	}
+	return parts[0], parts[1], nil
+}
+
+// The address is the name, optionally followed by its server
+func validateAddress(address string) error {
+	name, server, federated := strings.Cut(address, constants.SERVER_SEPARATOR)
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if !federated {
+		return nil
+	}
+	if server == "" || len(server) > constants.MAX_NAME_LENGTH {
+		return ErrUnknownServer
+	}
+	for _, r := range server {
+		if !isNameRune(r) {
+			return ErrInvalidName
+		}
+	}
+	return nil
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return ErrNameRequired
+	}
+	if len(name) > constants.MAX_NAME_LENGTH {
+		return ErrNameTooLong
+	}
+	for _, r := range name {
+		if !isNameRune(r) {
+			return ErrInvalidName
+		}
+	}
+	if _, ok := reservedNames[strings.ToLower(name)]; ok {
+		return ErrReservedName
+	}
+	return nil
+}
+
+// Names are limited to ASCII letters, digits, and a few punctuation marks,
+// so they are safe to display and to log
+func isNameRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r == '_', r == '-', r == '.':
+		return true
+	}
+	return false
+}
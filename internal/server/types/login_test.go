@@ -0,0 +1,64 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+)
+
+func TestParseLogin(t *testing.T) {
+	tests := []struct {
+		login        string
+		name         string
+		interlocutor string
+		err          error
+	}{
+		{login: "alice:bob", name: "alice", interlocutor: "bob"},
+		{login: "alice:bob@kyiv", name: "alice", interlocutor: "bob@kyiv"},
+		{login: "alice", err: ErrMalformedLogin},
+		{login: "alice:bob:carol", err: ErrMalformedLogin},
+		{login: ":bob", err: ErrNameRequired},
+		{login: "alice:", err: ErrNameRequired},
+		{login: strings.Repeat("a", constants.MAX_NAME_LENGTH+1) + ":bob", err: ErrNameTooLong},
+		{login: "al ice:bob", err: ErrInvalidName},
+		{login: "alice:Admin", err: ErrReservedName},
+		{login: "alice:bob@", err: ErrUnknownServer},
+		{login: "alice:bob@ky iv", err: ErrInvalidName},
+	}
+	for _, test := range tests {
+		name, interlocutor, err := ParseLogin(test.login)
+		if !errors.Is(err, test.err) || name != test.name || interlocutor != test.interlocutor {
+			t.Errorf("ParseLogin(%q) = %q, %q, %v", test.login, name, interlocutor, err)
+		}
+		if _, ok := loginRefusals[err]; err != nil && !ok {
+			t.Errorf("refusal of %q has no signal: %v", test.login, err)
+		}
+	}
+}
+
+func FuzzParseLogin(f *testing.F) {
+	for _, login := range []string{"alice:bob", "alice:bob@kyiv", "alice", ":", "a:b:c", "alice:bob@", "admin:bob", "alice:bob@@kyiv", "ä:ö"} {
+		f.Add(login)
+	}
+	f.Fuzz(func(t *testing.T, login string) {
+		name, interlocutor, err := ParseLogin(login)
+		if err != nil {
+			if _, ok := loginRefusals[err]; !ok {
+				t.Fatalf("refusal of %q has no signal: %v", login, err)
+			}
+			return
+		}
+		// The accepted names are valid on their own, and make up the login
+		if err = validateName(name); err != nil {
+			t.Fatalf("accepted name %q is invalid: %v", name, err)
+		}
+		if err = validateAddress(interlocutor); err != nil {
+			t.Fatalf("accepted address %q is invalid: %v", interlocutor, err)
+		}
+		if name+constants.DATA_SEPARATOR+interlocutor != login {
+			t.Fatalf("%q is parsed as %q and %q", login, name, interlocutor)
+		}
+	})
+}
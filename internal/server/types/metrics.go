@@ -0,0 +1,82 @@
+package types
+
+import (
+	"math/big"
+	"net/http"
+
+	"github.com/dikuropiatnyk/dh-chat/pkg/metrics"
+)
+
+// Types of the errors, counted by the server
+const (
+	ERROR_ACCEPT        = "accept"
+	ERROR_READ          = "read"
+	ERROR_WRITE         = "write"
+	ERROR_CLIENT_EXISTS = "client_exists"
+	ERROR_WAIT_TIMEOUT  = "wait_timeout"
+	ERROR_HANDSHAKE     = "handshake"
+	ERROR_LOGIN         = "login"
+	ERROR_AUTH          = "auth"
+	ERROR_PARAMETERS    = "parameters"
+	// Rejections by the quotas and rate limits
+	ERROR_CONNECTION_LIMIT  = "connection_limit"
+	ERROR_HANDSHAKE_LIMIT   = "handshake_limit"
+	ERROR_MESSAGE_LIMIT     = "message_limit"
+	ERROR_CONTROL_LIMIT     = "control_limit"
+	ERROR_IDLE_TIMEOUT      = "idle_timeout"
+	ERROR_HEARTBEAT_TIMEOUT = "heartbeat_timeout"
+	ERROR_RESUME            = "resume"
+	ERROR_PANIC             = "panic"
+	ERROR_FEDERATION        = "federation"
+	ERROR_BROKER            = "broker"
+)
+
+type serverMetrics struct {
+	registry         *metrics.Registry
+	connections      *metrics.Gauge
+	waitingClients   *metrics.Gauge
+	activeChats      *metrics.Gauge
+	relayedMessages  *metrics.Counter
+	relayedBytes     *metrics.Counter
+	handshakeLatency *metrics.Histogram
+	baseSecrets      *metrics.Histogram
+	heartbeatRTT     *metrics.Histogram
+	resumedSessions  *metrics.Counter
+	errors           *metrics.CounterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	registry := metrics.NewRegistry()
+	return &serverMetrics{
+		registry:         registry,
+		connections:      registry.NewGauge("dhchat_connections", "Number of open client connections."),
+		waitingClients:   registry.NewGauge("dhchat_waiting_clients", "Number of clients in the waiting pool."),
+		activeChats:      registry.NewGauge("dhchat_active_chats", "Number of synchronized chats."),
+		relayedMessages:  registry.NewCounter("dhchat_relayed_messages_total", "Number of messages relayed between interlocutors."),
+		relayedBytes:     registry.NewCounter("dhchat_relayed_bytes_total", "Number of bytes relayed between interlocutors."),
+		handshakeLatency: registry.NewHistogram("dhchat_handshake_duration_seconds", "Time from pairing to the chat confirmation.", metrics.DefaultBuckets),
+		baseSecrets:      registry.NewHistogram("dhchat_base_secrets_duration_seconds", "Time spent on getting the base secrets of a chat.", metrics.DefaultBuckets),
+		heartbeatRTT:     registry.NewHistogram("dhchat_heartbeat_rtt_seconds", "Round-trip time of the heartbeats.", metrics.DefaultBuckets),
+		resumedSessions:  registry.NewCounter("dhchat_resumed_sessions_total", "Number of chats resumed after a lost connection."),
+		errors:           registry.NewCounterVec("dhchat_errors_total", "Number of errors by type.", "type"),
+	}
+}
+
+// Wraps the parameter source to measure how long getting the base secrets takes
+func (m *serverMetrics) timeParameters(source ParameterSource, clock Clock) ParameterSource {
+	return func() (*big.Int, *big.Int, error) {
+		start := clock.Now()
+		p, g, err := source()
+		if err != nil {
+			m.errors.Inc(ERROR_PARAMETERS)
+			return p, g, err
+		}
+		m.baseSecrets.Observe(clock.Now().Sub(start).Seconds())
+		return p, g, nil
+	}
+}
+
+// MetricsHandler exposes the server metrics in the Prometheus text format
+func (s *DHServer) MetricsHandler() http.Handler {
+	return s.metrics.registry.Handler()
+}
@@ -0,0 +1,322 @@
+package types
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/ratelimit"
+)
+
+var (
+	ErrChatExists  = errors.New("chat is already open")
+	ErrMaintenance = errors.New("server is under maintenance")
+)
+
+// Session of the client, which carries many chats over one multiplexed
+// connection. The client's control stream carries the commands, and every
+// chat has a stream of its own with its own base secrets, so the peers derive
+// their own key for it.
+type muxSession struct {
+	name    string
+	link    *communication.Multiplexer
+	control net.Conn
+	logger  *slog.Logger
+	// Streams of the open chats by the peer, nil until the chat is set up
+	chats map[string]*communication.Stream
+	// Shared by the chats, so a session can't flood its peers via many chats
+	messageBucket *ratelimit.Bucket
+}
+
+// Every message is written to the stream at once, so the handlers of the
+// chats send via the control stream as well
+func (m *muxSession) send(message string) error {
+	return communication.SendMessage(m.control, message)
+}
+
+// Handles the multiplexed session of the client, until it leaves. The login
+// is in the format "MULTIPLEX:name".
+func (s *DHServer) handleMultiplex(conn net.Conn, buffer []byte, name string, logger *slog.Logger) {
+	if err := validateName(name); err != nil {
+		logger.Warn("Invalid login", "error", err, "bytes", len(name))
+		s.metrics.errors.Inc(ERROR_LOGIN)
+		if err = communication.SendMessage(conn, loginRefusals[err]); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	logger = logger.With("client", name)
+	if s.InMaintenance() {
+		logger.Info("Client is refused due to the maintenance")
+		if err := communication.SendMessage(conn, constants.SERVER_MAINTENANCE); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	if !s.allowHandshake(remoteIP(conn.RemoteAddr())) {
+		logger.Warn("Handshake rate limit exceeded")
+		s.metrics.errors.Inc(ERROR_HANDSHAKE_LIMIT)
+		if err := communication.SendMessage(conn, constants.RATE_LIMITED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	if err := s.authenticate(conn, buffer, name, logger); err != nil {
+		logger.Warn("Authentication failed", "error", err)
+		s.metrics.errors.Inc(ERROR_AUTH)
+		if refusal, ok := authRefusals[err]; ok {
+			if err = communication.SendMessage(conn, refusal); err != nil {
+				logger.Warn("Couldn't send the message", "error", err)
+			}
+		}
+		return
+	}
+
+	// The name is reserved, until the session is set up
+	s.sessionsMut.Lock()
+	if _, ok := s.sessions[name]; ok {
+		s.sessionsMut.Unlock()
+		logger.Warn("Client already has a multiplexed session")
+		s.metrics.errors.Inc(ERROR_CLIENT_EXISTS)
+		if err := communication.SendMessage(conn, constants.CLIENT_EXISTS); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	s.sessions[name] = nil
+	s.sessionsMut.Unlock()
+	session := &muxSession{name: name, logger: logger, chats: make(map[string]*communication.Stream), messageBucket: s.newMessageBucket()}
+	defer s.closeSession(session)
+
+	// The notices are held, until the control stream is open, so they don't
+	// break the multiplexing
+	s.notifyVia(conn, nil)
+	if err := communication.SendMessage(conn, constants.MULTIPLEX_JOINED); err != nil {
+		logger.Warn("Couldn't send the message", "error", err)
+		return
+	}
+	establish(conn)
+	// From now on, the connection is multiplexed, and the first stream of the
+	// client is the control one
+	session.link = communication.NewMultiplexer(conn, false)
+	defer session.link.Close()
+	control, err := session.link.Accept()
+	if err != nil {
+		logger.Info("Client didn't open the control stream", "reason", err)
+		return
+	}
+	session.control = control
+	if !s.notifyVia(conn, control) {
+		if err = session.send(constants.SERVER_SHUTDOWN); err != nil {
+			logger.Warn("Couldn't notify the client about the shutdown", "error", err)
+		}
+	}
+	s.sessionsMut.Lock()
+	s.sessions[name] = session
+	s.sessionsMut.Unlock()
+	// The admin lists and kicks the session like any other client
+	client := newDHClient(control, name, "", logger)
+	client.session = session
+	s.registerClient(client)
+	defer s.unregisterClient(client)
+	logger.Info("Client opened a multiplexed session")
+
+	for {
+		message, err := communication.ReadMessage(control, buffer)
+		if err != nil {
+			logger.Info("Client closed the multiplexed session", "reason", err)
+			return
+		}
+		signal, payload := communication.ParseSignal(message, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.PING:
+			err = session.send(constants.PONG + constants.DATA_SEPARATOR + payload)
+		case constants.OPEN_CHAT:
+			if err = s.openChat(session, payload); err != nil {
+				logger.Info("Chat isn't opened", "interlocutor", payload, "error", err)
+				err = session.send(constants.CHAT_ERROR + constants.DATA_SEPARATOR + payload + constants.DATA_SEPARATOR + err.Error())
+			}
+		case constants.CONTACTS, constants.CONTACT_ACCEPT, constants.CONTACT_BLOCK:
+			err = s.handleContactCommand(control, name, logger, signal, payload)
+		default:
+			logger.Debug("Unknown message is dropped", "bytes", len(message))
+		}
+		if err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+			return
+		}
+	}
+}
+
+// Opens the chat between the sessions of the contacts. Both of them get the
+// stream of the chat, which starts with its base secrets.
+func (s *DHServer) openChat(session *muxSession, peer string) error {
+	if s.InMaintenance() {
+		return ErrMaintenance
+	}
+	if peer == session.name || !s.contacts.AreContacts(session.name, peer) {
+		return ErrNotAvailable
+	}
+	s.sessionsMut.Lock()
+	interlocutor := s.sessions[peer]
+	if interlocutor == nil {
+		s.sessionsMut.Unlock()
+		return ErrNotAvailable
+	}
+	if _, ok := session.chats[peer]; ok {
+		s.sessionsMut.Unlock()
+		return ErrChatExists
+	}
+	// The chat is reserved, until its streams are opened
+	session.chats[peer], interlocutor.chats[session.name] = nil, nil
+	s.sessionsMut.Unlock()
+
+	p, g, err := s.parameters()
+	if err != nil {
+		s.metrics.errors.Inc(ERROR_PARAMETERS)
+		s.closeChat(session, peer, nil)
+		return err
+	}
+	own, err := session.link.Open()
+	if err != nil {
+		s.closeChat(session, peer, nil)
+		return err
+	}
+	theirs, err := interlocutor.link.Open()
+	if err != nil {
+		own.Close()
+		s.closeChat(session, peer, nil)
+		return ErrNotAvailable
+	}
+	s.sessionsMut.Lock()
+	_, open := session.chats[peer]
+	if open {
+		session.chats[peer], interlocutor.chats[session.name] = own, theirs
+	}
+	s.sessionsMut.Unlock()
+	// Either session is closed meanwhile
+	if !open {
+		own.Close()
+		theirs.Close()
+		return ErrNotAvailable
+	}
+
+	// The chat is listed by the admin, as soon as the peers learn about it
+	chat := newChat()
+	ownClient := s.registerChatSide(session, peer, own, chat, 0)
+	theirClient := s.registerChatSide(interlocutor, session.name, theirs, chat, 1)
+	// The base secrets are the first message of both streams, so the salts of
+	// the peers always come after them
+	secrets := p.String() + constants.DATA_SEPARATOR + g.String()
+	err = communication.SendMessage(theirs, constants.CHAT_OPENED+constants.DATA_SEPARATOR+session.name+constants.DATA_SEPARATOR+secrets)
+	if err != nil {
+		err = ErrNotAvailable
+	} else {
+		err = communication.SendMessage(own, constants.CHAT_OPENED+constants.DATA_SEPARATOR+peer+constants.DATA_SEPARATOR+secrets)
+	}
+	if err != nil {
+		s.unregisterClient(ownClient)
+		s.unregisterClient(theirClient)
+		s.closeChat(session, peer, own)
+		return err
+	}
+	session.logger.Info("Chat is opened", "interlocutor", peer)
+	go s.relayStream(session, ownClient, own, theirs)
+	go s.relayStream(interlocutor, theirClient, theirs, own)
+	return nil
+}
+
+// Registers the session's side of the chat, so the admin lists and ends the
+// chat like the others
+func (s *DHServer) registerChatSide(session *muxSession, peer string, stream *communication.Stream, chat *Chat, side int) *DHClient {
+	client := newDHClient(stream, session.name, peer, session.logger)
+	client.session = session
+	client.joinChat(chat, side)
+	s.registerClient(client)
+	s.markPaired(client)
+	return client
+}
+
+// Relays the salts and the messages of the chat from the client's stream to
+// the peer's one, until either of them is closed
+func (s *DHServer) relayStream(session *muxSession, client *DHClient, in *communication.Stream, out net.Conn) {
+	peer := client.interlocutor
+	defer s.closeChat(session, peer, in)
+	defer s.unregisterClient(client)
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	for {
+		message, err := communication.ReadMessage(in, buffer)
+		if err != nil {
+			session.logger.Debug("Chat stream is over", "interlocutor", peer, "reason", err)
+			return
+		}
+		signal, data := communication.ParseSignal(message, constants.DATA_SEPARATOR)
+		switch signal {
+		case constants.CHAT_KEY:
+		case constants.CHAT_MESSAGE:
+			// The message over the limit is dropped, and the sender is notified about it
+			if !session.messageBucket.Allow(s.clock.Now()) {
+				s.metrics.errors.Inc(ERROR_MESSAGE_LIMIT)
+				if err = session.send(constants.MESSAGE_RATE_LIMITED); err != nil {
+					session.logger.Debug("Couldn't send the message", "error", err)
+				}
+				continue
+			}
+		default:
+			session.logger.Debug("Unknown chat message is dropped", "bytes", len(message))
+			continue
+		}
+		if err = communication.SendMessage(out, message); err != nil {
+			session.logger.Debug("Couldn't relay the message", "interlocutor", peer, "error", err)
+			return
+		}
+		if signal == constants.CHAT_MESSAGE {
+			s.metrics.relayedMessages.Inc()
+			s.metrics.relayedBytes.Add(float64(len(data)))
+		}
+	}
+}
+
+// Closes the chat of the session's stream for both peers, unless it's closed
+// already. The stream is nil, while the chat is reserved. The peers learn it's
+// over, as soon as their streams of the chat are closed.
+func (s *DHServer) closeChat(session *muxSession, peer string, stream *communication.Stream) {
+	s.sessionsMut.Lock()
+	own, open := session.chats[peer]
+	// The chat, which is opened again meanwhile, isn't this one
+	if !open || own != stream {
+		s.sessionsMut.Unlock()
+		return
+	}
+	delete(session.chats, peer)
+	var theirs *communication.Stream
+	if interlocutor := s.sessions[peer]; interlocutor != nil {
+		theirs = interlocutor.chats[session.name]
+		delete(interlocutor.chats, session.name)
+	}
+	s.sessionsMut.Unlock()
+	session.logger.Info("Chat is closed", "interlocutor", peer)
+	for _, stream := range []*communication.Stream{own, theirs} {
+		if stream != nil {
+			stream.Close()
+		}
+	}
+}
+
+// Closes every chat of the session, which is over
+func (s *DHServer) closeSession(session *muxSession) {
+	s.sessionsMut.Lock()
+	chats := make(map[string]*communication.Stream, len(session.chats))
+	for peer, stream := range session.chats {
+		chats[peer] = stream
+	}
+	s.sessionsMut.Unlock()
+	for peer, stream := range chats {
+		s.closeChat(session, peer, stream)
+	}
+	s.sessionsMut.Lock()
+	delete(s.sessions, session.name)
+	s.sessionsMut.Unlock()
+}
@@ -0,0 +1,212 @@
+package types
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// Opens the multiplexed session of the name, and returns its multiplexer and
+// control stream
+func joinMultiplex(t *testing.T, address string, name string) (*communication.Multiplexer, net.Conn) {
+	t.Helper()
+	conn := dial(t, address)
+	if response := login(t, conn, identityOf(name), constants.MULTIPLEX+constants.DATA_SEPARATOR+name, name); response != constants.MULTIPLEX_JOINED {
+		t.Fatalf("%s got %q instead of the session", name, response)
+	}
+	link := communication.NewMultiplexer(conn, true)
+	t.Cleanup(func() { link.Close() })
+	control, err := link.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pong tells the session is set up, so the others may open the chats with it
+	if err = communication.SendMessage(control, constants.PING+constants.DATA_SEPARATOR+"1"); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(t, control); message != constants.PONG+constants.DATA_SEPARATOR+"1" {
+		t.Fatalf("%s got %q instead of the pong", name, message)
+	}
+	return link, control
+}
+
+// Accepts the stream of the chat, and checks it starts with the base secrets
+func acceptChat(t *testing.T, link *communication.Multiplexer, peer string) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		stream, err := link.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- stream
+	}()
+	select {
+	case stream, ok := <-accepted:
+		if !ok {
+			t.Fatal("connection is closed before the chat")
+		}
+		signal, payload := communication.ParseSignal(read(t, stream), constants.DATA_SEPARATOR)
+		if signal != constants.CHAT_OPENED || !strings.HasPrefix(payload, peer+constants.DATA_SEPARATOR) {
+			t.Fatalf("chat stream starts with %s:%s", signal, payload)
+		}
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("no chat stream in time")
+	}
+	return nil
+}
+
+func TestMultiplexedChat(t *testing.T) {
+	_, address, _ := startServer(t, WithLimits(Limits{}))
+	aliceLink, aliceControl := joinMultiplex(t, address, "alice")
+	bobLink, _ := joinMultiplex(t, address, "bob")
+	if err := communication.SendMessage(aliceControl, constants.OPEN_CHAT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := acceptChat(t, aliceLink, "bob"), acceptChat(t, bobLink, "alice")
+
+	// The salts and the messages are relayed as they are, on the streams of the chat
+	for _, message := range []string{constants.CHAT_KEY + ":42", constants.CHAT_MESSAGE + ":hello"} {
+		if err := communication.SendMessage(alice, message); err != nil {
+			t.Fatal(err)
+		}
+		if received := read(t, bob); received != message {
+			t.Fatalf("bob got %q instead of %q", received, message)
+		}
+	}
+	if err := communication.SendMessage(bob, constants.CHAT_MESSAGE+":hi"); err != nil {
+		t.Fatal(err)
+	}
+	if received := read(t, alice); received != constants.CHAT_MESSAGE+":hi" {
+		t.Fatalf("alice got %q", received)
+	}
+
+	// The chat is open already, so it isn't opened twice
+	if err := communication.SendMessage(aliceControl, constants.OPEN_CHAT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(t, aliceControl); message != constants.CHAT_ERROR+constants.DATA_SEPARATOR+"bob"+constants.DATA_SEPARATOR+ErrChatExists.Error() {
+		t.Fatalf("alice got %q", message)
+	}
+
+	// Bob learns the chat is over from his stream, and the chat may be opened again
+	alice.Close()
+	_ = bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := communication.ReadMessage(bob, make([]byte, constants.BUFFER_SIZE)); !errors.Is(err, io.EOF) {
+		t.Fatalf("bob's stream ended with %v", err)
+	}
+	// The server forgets the chat before it closes the streams
+	if err := communication.SendMessage(aliceControl, constants.OPEN_CHAT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	acceptChat(t, aliceLink, "bob")
+	acceptChat(t, bobLink, "alice")
+}
+
+// The session's notices, e.g. the shutdown, are sent on its control stream
+func TestMultiplexedShutdown(t *testing.T) {
+	_, address, stop := startServer(t, WithLimits(Limits{}), WithShutdownTimeout(time.Minute))
+	link, control := joinMultiplex(t, address, "alice")
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	if message := read(t, control); message != constants.SERVER_SHUTDOWN {
+		t.Fatalf("alice got %q", message)
+	}
+	link.Close()
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The admin lists and ends the multiplexed chats, and kicks the sessions, like the others
+func TestMultiplexedAdmin(t *testing.T) {
+	server, address, _ := startServer(t, WithLimits(Limits{}))
+	aliceLink, aliceControl := joinMultiplex(t, address, "alice")
+	bobLink, bobControl := joinMultiplex(t, address, "bob")
+	if err := communication.SendMessage(aliceControl, constants.OPEN_CHAT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := acceptChat(t, aliceLink, "bob"), acceptChat(t, bobLink, "alice")
+
+	chats := server.ActiveChats()
+	if len(chats) != 1 || len(chats[0].Clients) != 2 || chats[0].Clients[0].Name != "alice" || chats[0].Clients[1].Interlocutor != "alice" {
+		t.Fatalf("chats are %+v", chats)
+	}
+	if !server.EndChat(chats[0].ID) {
+		t.Fatal("chat isn't found")
+	}
+	buffer := make([]byte, constants.BUFFER_SIZE)
+	for _, stream := range []net.Conn{alice, bob} {
+		if message := read(t, stream); message != constants.CHAT_ENDED {
+			t.Fatalf("stream got %q instead of the end", message)
+		}
+		_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := communication.ReadMessage(stream, buffer); !errors.Is(err, io.EOF) {
+			t.Fatalf("stream ended with %v", err)
+		}
+	}
+
+	// The kick closes the whole session, rather than its streams only
+	if !server.KickClient("bob") {
+		t.Fatal("bob isn't found")
+	}
+	if message := read(t, bobControl); message != constants.CLIENT_KICKED {
+		t.Fatalf("bob got %q instead of the kick", message)
+	}
+	select {
+	case <-bobLink.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("bob's connection isn't closed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		waiting := server.WaitingClients()
+		if len(waiting) == 1 && waiting[0].Name == "alice" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting clients are %+v", waiting)
+		}
+	}
+}
+
+// The session, which chats already, is notified about the contact request
+// via its control stream, and the maintenance refuses the new chats
+func TestMultiplexedNotices(t *testing.T) {
+	server, address, _ := startServer(t, WithLimits(Limits{}))
+	aliceLink, aliceControl := joinMultiplex(t, address, "alice")
+	bobLink, _ := joinMultiplex(t, address, "bob")
+	if err := communication.SendMessage(aliceControl, constants.OPEN_CHAT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := acceptChat(t, aliceLink, "bob"), acceptChat(t, bobLink, "alice")
+
+	if response := login(t, dial(t, address), identityOf("dave"), "dave:alice", "dave"); response != constants.CONTACT_REQUESTED {
+		t.Fatalf("dave got %q", response)
+	}
+	if message := read(t, aliceControl); message != constants.CONTACT_REQUEST+constants.DATA_SEPARATOR+"dave" {
+		t.Fatalf("alice got %q instead of the request", message)
+	}
+	// Nothing but the chat reaches its stream
+	if err := communication.SendMessage(bob, constants.CHAT_MESSAGE+":hi"); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(t, alice); message != constants.CHAT_MESSAGE+":hi" {
+		t.Fatalf("alice's chat got %q", message)
+	}
+
+	server.SetMaintenance(true)
+	if err := communication.SendMessage(aliceControl, constants.OPEN_CHAT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(t, aliceControl); message != constants.CHAT_ERROR+constants.DATA_SEPARATOR+"bob"+constants.DATA_SEPARATOR+ErrMaintenance.Error() {
+		t.Fatalf("alice got %q instead of the refusal", message)
+	}
+}
@@ -0,0 +1,105 @@
+package types
+
+import (
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/diffiehellman"
+)
+
+// Clock abstracts the time source of the server, so the timeouts can be controlled
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ParameterSource provides the base secrets (p and g) for every new chat
+type ParameterSource func() (*big.Int, *big.Int, error)
+
+// Option configures the DHServer on creation
+type Option func(*DHServer)
+
+// WithAddress sets the address used by ListenAndServe
+func WithAddress(address string) Option {
+	return func(s *DHServer) { s.address = address }
+}
+
+// WithLogger sets the structured logger, which is enriched with the
+// connection fields for every client
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *DHServer) { s.logger = logger }
+}
+
+func WithClock(clock Clock) Option {
+	return func(s *DHServer) { s.clock = clock }
+}
+
+// WithBroker replaces the in-memory pairing of the clients, e.g. with the
+// broker shared by several instances of the server
+func WithBroker(broker Broker) Option {
+	return func(s *DHServer) { s.broker = broker }
+}
+
+// WithParameterSource replaces the well-known group of the base secrets, e.g.
+// with the freshly generated or the precomputed values
+func WithParameterSource(source ParameterSource) Option {
+	return func(s *DHServer) { s.parameters = source }
+}
+
+// WithWaitTimeout sets how long the first client waits for its interlocutor
+func WithWaitTimeout(timeout time.Duration) Option {
+	return func(s *DHServer) { s.waitTimeout = timeout }
+}
+
+// WithShutdownTimeout sets how long the in-flight chats are awaited on shutdown
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(s *DHServer) { s.shutdownTimeout = timeout }
+}
+
+// WithTimeouts sets the handshake, idle and write deadlines of the connections
+func WithTimeouts(timeouts communication.Timeouts) Option {
+	return func(s *DHServer) { s.timeouts = timeouts }
+}
+
+// WithHeartbeatInterval sets how often the clients are pinged. A client is
+// considered away after missing two pings, and dead after missing three.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(s *DHServer) { s.heartbeatInterval = interval }
+}
+
+// WithResumeWindow sets how long the chat of a lost connection is kept for
+// the client to resume it with its session ticket
+func WithResumeWindow(window time.Duration) Option {
+	return func(s *DHServer) { s.resumeWindow = window }
+}
+
+// WithAccounts sets the storage of the registered names
+func WithAccounts(accounts AccountStorage) Option {
+	return func(s *DHServer) { s.accounts = accounts }
+}
+
+// WithOpenRegistration toggles the registration of the unknown names on
+// their first login. Otherwise, the names are registered via the admin API.
+func WithOpenRegistration(open bool) Option {
+	return func(s *DHServer) { s.openRegistration = open }
+}
+
+// WithContacts sets the storage of the contacts
+func WithContacts(contacts ContactStorage) Option {
+	return func(s *DHServer) { s.contacts = contacts }
+}
+
+// WithFederation links the server with the federated servers, so their
+// clients chat with each other
+func WithFederation(config Federation) Option {
+	return func(s *DHServer) { s.federation = newFederation(config) }
+}
+
+var defaultParameterSource ParameterSource = diffiehellman.GenerateBaseSecrets
@@ -0,0 +1,228 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+var (
+	ErrNotAvailable = errors.New("contact isn't available")
+	ErrNoInvitation = errors.New("there's no invitation from this name")
+)
+
+// Statuses of the contacts, listed by the presence directory
+const (
+	PRESENCE_AVAILABLE = "available"
+	PRESENCE_BUSY      = "busy"
+)
+
+// Online contact, as listed by the presence directory
+type PresenceInfo struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// The presence directory tracks the clients, which wait in the lobby for the
+// invitations. Only the names, which opted in, are visible to their contacts.
+type presence struct {
+	lobby   map[string]net.Conn
+	visible map[string]bool
+	// Pending invitations by the invitee
+	invitations relations
+	mut         sync.Mutex
+}
+
+func newPresence() *presence {
+	return &presence{
+		lobby:       make(map[string]net.Conn),
+		visible:     make(map[string]bool),
+		invitations: relations{},
+	}
+}
+
+// Lists the online contacts of the name, which are visible
+func (s *DHServer) onlineContacts(name string) []PresenceInfo {
+	busy := make(map[string]bool)
+	s.clientsMut.RLock()
+	for client := range s.clients {
+		busy[client.name] = true
+	}
+	s.clientsMut.RUnlock()
+
+	online := []PresenceInfo{}
+	s.presence.mut.Lock()
+	defer s.presence.mut.Unlock()
+	for _, contact := range s.contacts.List(name).Contacts {
+		if !s.presence.visible[contact] {
+			continue
+		}
+		if _, ok := s.presence.lobby[contact]; ok {
+			online = append(online, PresenceInfo{Name: contact, Status: PRESENCE_AVAILABLE})
+		} else if busy[contact] {
+			online = append(online, PresenceInfo{Name: contact, Status: PRESENCE_BUSY})
+		}
+	}
+	return online
+}
+
+// Handles the client, which waits in the lobby, until it leaves. The login
+// is in the format "LOBBY:name:visibility".
+func (s *DHServer) handleLobby(conn net.Conn, buffer []byte, login string, logger *slog.Logger) {
+	name, visibility, _ := strings.Cut(login, constants.DATA_SEPARATOR)
+	if err := validateName(name); err != nil {
+		logger.Warn("Invalid login", "error", err, "bytes", len(login))
+		s.metrics.errors.Inc(ERROR_LOGIN)
+		if err = communication.SendMessage(conn, loginRefusals[err]); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	logger = logger.With("client", name)
+	if !s.allowHandshake(remoteIP(conn.RemoteAddr())) {
+		logger.Warn("Handshake rate limit exceeded")
+		s.metrics.errors.Inc(ERROR_HANDSHAKE_LIMIT)
+		if err := communication.SendMessage(conn, constants.RATE_LIMITED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	if err := s.authenticate(conn, buffer, name, logger); err != nil {
+		logger.Warn("Authentication failed", "error", err)
+		s.metrics.errors.Inc(ERROR_AUTH)
+		if refusal, ok := authRefusals[err]; ok {
+			if err = communication.SendMessage(conn, refusal); err != nil {
+				logger.Warn("Couldn't send the message", "error", err)
+			}
+		}
+		return
+	}
+
+	s.presence.mut.Lock()
+	if _, ok := s.presence.lobby[name]; ok {
+		s.presence.mut.Unlock()
+		logger.Warn("Client is already in the lobby")
+		s.metrics.errors.Inc(ERROR_CLIENT_EXISTS)
+		if err := communication.SendMessage(conn, constants.CLIENT_EXISTS); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	s.presence.lobby[name] = conn
+	s.presence.visible[name] = visibility == constants.VISIBLE
+	s.presence.mut.Unlock()
+	defer func() {
+		s.presence.mut.Lock()
+		delete(s.presence.lobby, name)
+		delete(s.presence.invitations, name)
+		s.presence.mut.Unlock()
+	}()
+	logger.Info("Client joined the lobby", "visible", visibility == constants.VISIBLE)
+
+	if err := communication.SendMessage(conn, constants.LOBBY_JOINED); err != nil {
+		logger.Warn("Couldn't send the message", "error", err)
+		return
+	}
+	establish(conn)
+	for {
+		message, err := communication.ReadMessage(conn, buffer)
+		if err != nil {
+			logger.Info("Client left the lobby", "reason", err)
+			return
+		}
+		signal, payload := communication.ParseSignal(message, constants.DATA_SEPARATOR)
+		if err = s.handleLobbyCommand(conn, name, signal, payload, logger); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+			return
+		}
+	}
+}
+
+func (s *DHServer) handleLobbyCommand(conn net.Conn, name string, signal string, payload string, logger *slog.Logger) error {
+	switch signal {
+	case constants.PING:
+		return communication.SendMessage(conn, constants.PONG+constants.DATA_SEPARATOR+payload)
+	case constants.WHO:
+		list, err := json.Marshal(s.onlineContacts(name))
+		if err != nil {
+			return err
+		}
+		return communication.SendMessage(conn, constants.WHO_LIST+constants.DATA_SEPARATOR+string(list))
+	case constants.VISIBILITY:
+		s.presence.mut.Lock()
+		s.presence.visible[name] = payload == constants.VISIBLE
+		s.presence.mut.Unlock()
+		logger.Info("Visibility changed", "visible", payload == constants.VISIBLE)
+		return communication.SendMessage(conn, constants.VISIBILITY+constants.DATA_SEPARATOR+payload)
+	case constants.INVITE:
+		if err := s.invite(name, payload); err != nil {
+			return communication.SendMessage(conn, constants.INVITE_ERROR+constants.DATA_SEPARATOR+err.Error())
+		}
+		logger.Info("Invitation is sent", "interlocutor", payload)
+		return communication.SendMessage(conn, constants.INVITE_SENT+constants.DATA_SEPARATOR+payload)
+	case constants.INVITE_ACCEPT, constants.INVITE_DECLINE:
+		reply := constants.INVITE_ACCEPTED
+		if signal == constants.INVITE_DECLINE {
+			reply = constants.INVITE_DECLINED
+		}
+		if err := s.answerInvitation(name, payload, reply); err != nil {
+			return communication.SendMessage(conn, constants.INVITE_ERROR+constants.DATA_SEPARATOR+err.Error())
+		}
+		logger.Info("Invitation is answered", "interlocutor", payload, "answer", reply)
+		return communication.SendMessage(conn, reply+constants.DATA_SEPARATOR+payload)
+	}
+	logger.Debug("Unknown lobby message is dropped", "bytes", len(signal)+len(payload))
+	return nil
+}
+
+// Invites the contact in the lobby to chat. The hidden contact is reported
+// as unavailable, so the invitations don't reveal its presence.
+func (s *DHServer) invite(from string, to string) error {
+	if !s.contacts.AreContacts(from, to) {
+		return ErrNotAvailable
+	}
+	// The invitation is sent outside the lock, so a slow invitee doesn't hold the lobby
+	s.presence.mut.Lock()
+	invitee, ok := s.presence.lobby[to]
+	available := ok && s.presence.visible[to]
+	if available {
+		s.presence.invitations.add(to, from)
+	}
+	s.presence.mut.Unlock()
+	if !available {
+		return ErrNotAvailable
+	}
+	if err := communication.SendMessage(invitee, constants.INVITATION+constants.DATA_SEPARATOR+from); err != nil {
+		s.presence.mut.Lock()
+		s.presence.invitations.remove(to, from)
+		s.presence.mut.Unlock()
+		return ErrNotAvailable
+	}
+	return nil
+}
+
+// Sends the answer to the inviter. Both clients log in to the chat as soon
+// as the invitation is accepted.
+func (s *DHServer) answerInvitation(invitee string, inviter string, answer string) error {
+	s.presence.mut.Lock()
+	invited := s.presence.invitations[invitee][inviter]
+	s.presence.invitations.remove(invitee, inviter)
+	conn, ok := s.presence.lobby[inviter]
+	s.presence.mut.Unlock()
+	if !invited {
+		return ErrNoInvitation
+	}
+	if !ok {
+		return ErrNotAvailable
+	}
+	if err := communication.SendMessage(conn, answer+constants.DATA_SEPARATOR+invitee); err != nil {
+		return ErrNotAvailable
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+func joinLobby(t *testing.T, address string, name string) net.Conn {
+	t.Helper()
+	conn := dial(t, address)
+	lobbyLogin := constants.LOBBY + constants.DATA_SEPARATOR + name + constants.DATA_SEPARATOR + constants.VISIBLE
+	if response := login(t, conn, identityOf(name), lobbyLogin, name); response != constants.LOBBY_JOINED {
+		t.Fatalf("%s got %q instead of the lobby", name, response)
+	}
+	return conn
+}
+
+func TestInvitation(t *testing.T) {
+	_, address, _ := startServer(t, WithLimits(Limits{}), WithContacts(mutualContacts(t, "alice", "bob")))
+	alice, bob := joinLobby(t, address, "alice"), joinLobby(t, address, "bob")
+	if err := communication.SendMessage(bob, constants.INVITE+constants.DATA_SEPARATOR+"alice"); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(t, alice); message != constants.INVITATION+constants.DATA_SEPARATOR+"bob" {
+		t.Fatalf("alice got %q", message)
+	}
+	readUntil(t, bob, constants.INVITE_SENT)
+	if err := communication.SendMessage(alice, constants.INVITE_ACCEPT+constants.DATA_SEPARATOR+"bob"); err != nil {
+		t.Fatal(err)
+	}
+	if message := readUntil(t, bob, constants.INVITE_ACCEPTED); message != constants.INVITE_ACCEPTED+constants.DATA_SEPARATOR+"alice" {
+		t.Fatalf("bob got %q", message)
+	}
+	readUntil(t, alice, constants.INVITE_ACCEPTED)
+}
+
+// The invitee, which doesn't read, mustn't hold the lobby of the others
+func TestStalledInviteeDoesNotBlockLobby(t *testing.T) {
+	_, address, _ := startServer(t,
+		WithLimits(Limits{}),
+		WithContacts(mutualContacts(t, "alice", "bob", "carol")),
+		WithTimeouts(communication.Timeouts{Handshake: time.Minute, Idle: time.Minute, Write: 5 * time.Second}))
+	joinLobby(t, address, "alice")
+	bob, carol := joinLobby(t, address, "bob"), joinLobby(t, address, "carol")
+	if err := communication.SendMessage(bob, constants.INVITE+constants.DATA_SEPARATOR+"alice"); err != nil {
+		t.Fatal(err)
+	}
+	// The invitation to alice is being written meanwhile
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := communication.SendMessage(carol, constants.WHO); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, carol, constants.WHO_LIST)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("lobby was blocked for %v", elapsed)
+	}
+}
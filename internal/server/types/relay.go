@@ -0,0 +1,211 @@
+package types
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/internal/server/actions"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+// Sends the message to the interlocutor's handler. The handler may be gone
+// already, so it's never awaited.
+func (c *DHClient) notifyInterlocutor(message string) {
+	select {
+	case c.chat.mailboxes[1-c.side] <- message:
+	case <-c.chat.Done():
+	default:
+		c.logger.Debug("Interlocutor isn't available for the notification")
+	}
+}
+
+// Sends the message, which the chat can't go on without, to the interlocutor's
+// handler. Unlike the notification, it waits for the room in the mailbox.
+func (c *DHClient) deliver(message string, timeout <-chan time.Time) error {
+	select {
+	case c.chat.mailboxes[1-c.side] <- message:
+		return nil
+	case <-c.chat.Done():
+		return ErrInterlocutorLeft
+	case <-timeout:
+		return ErrInterlocutorBusy
+	}
+}
+
+// Relays the messages between the client and its interlocutor, and tracks
+// the client's presence via the heartbeats. ErrConnectionLost means the
+// chat may be resumed, any other result ends it.
+func (s *DHServer) relayChat(conn net.Conn, client *DHClient) error {
+	logger := client.logger
+	// The reader is released as soon as the relay is over, its connection is
+	// closed by the owner. It reads into its own buffer, since it may outlive the relay.
+	ctx, stop := context.WithCancel(client.chat.ctx)
+	defer stop()
+	ioReadChannel := make(chan string)
+	errorChannel := make(chan error)
+	messageBucket, controlBucket := s.newMessageBucket(), s.newControlBucket()
+	go actions.ReadFromConnection(ctx, conn, make([]byte, constants.BUFFER_SIZE), ioReadChannel, errorChannel)
+
+	lastSeen := s.clock.Now()
+	// The heartbeats keep the connection alive, but only the messages of
+	// either side keep the chat active
+	lastMessage := lastSeen
+	status := constants.STATUS_ONLINE
+	heartbeat := s.clock.After(s.heartbeatInterval)
+	// Shares the client's status with the interlocutor, whenever it changes
+	setStatus := func(newStatus string) {
+		if newStatus == status {
+			return
+		}
+		status = newStatus
+		logger.Info("Client status changed", "status", status)
+		client.notifyInterlocutor(constants.PEER_STATUS + constants.DATA_SEPARATOR + status)
+	}
+
+	for {
+		select {
+		// The client is notified about the shutdown already
+		case <-s.quit:
+			logger.Info("Chat is closed by the shutdown")
+			return nil
+
+		case <-client.chat.Done():
+			logger.Info("Interlocutor left the chat", "reason", context.Cause(client.chat.ctx))
+			// The messages, sent right before the interlocutor left, are still delivered
+			for len(client.inbox()) > 0 {
+				if err := communication.SendMessage(conn, <-client.inbox()); err != nil {
+					logger.Debug("Couldn't send the message", "error", err)
+				}
+			}
+			if err := communication.SendMessage(conn, constants.PEER_LEFT); err != nil {
+				logger.Debug("Couldn't send the message", "error", err)
+			}
+			return nil
+
+		case interlocutorMessage := <-client.inbox():
+			if err := communication.SendMessage(conn, interlocutorMessage); err != nil {
+				logger.Warn("Couldn't send the message", "error", err)
+				s.metrics.errors.Inc(ERROR_WRITE)
+				continue
+			}
+			if signal, _ := communication.ParseSignal(interlocutorMessage, constants.DATA_SEPARATOR); signal == constants.CHAT_MESSAGE {
+				lastMessage = s.clock.Now()
+			}
+			s.metrics.relayedMessages.Inc()
+			s.metrics.relayedBytes.Add(float64(len(interlocutorMessage)))
+			// The payload is never logged, only its size
+			logger.Debug("Relayed message to the client", "bytes", len(interlocutorMessage))
+
+		case clientMessage := <-ioReadChannel:
+			// Any message proves the client is alive
+			lastSeen = s.clock.Now()
+			setStatus(constants.STATUS_ONLINE)
+
+			signal, payload := communication.ParseSignal(clientMessage, constants.DATA_SEPARATOR)
+			switch signal {
+			case constants.PING:
+				if err := communication.SendMessage(conn, constants.PONG+constants.DATA_SEPARATOR+payload); err != nil {
+					logger.Warn("Couldn't send the message", "error", err)
+					s.metrics.errors.Inc(ERROR_WRITE)
+				}
+			case constants.PONG:
+				// The payload of the pong is the timestamp of the server's ping
+				sentAt, err := strconv.ParseInt(payload, 10, 64)
+				if err != nil {
+					logger.Debug("Invalid pong is dropped")
+					continue
+				}
+				rtt := s.clock.Now().Sub(time.Unix(0, sentAt))
+				s.metrics.heartbeatRTT.Observe(rtt.Seconds())
+				logger.Debug("Received a heartbeat", "rtt", rtt)
+			case constants.CHAT_MESSAGE:
+				// The message over the limit is dropped, and the sender is notified about it
+				if !messageBucket.Allow(s.clock.Now()) {
+					logger.Debug("Message rate limit exceeded")
+					s.metrics.errors.Inc(ERROR_MESSAGE_LIMIT)
+					if err := communication.SendMessage(conn, constants.MESSAGE_RATE_LIMITED); err != nil {
+						logger.Warn("Couldn't send the message", "error", err)
+					}
+					continue
+				}
+				lastMessage = s.clock.Now()
+				// The chat being over is handled by the next iteration
+				if err := client.send(clientMessage); err != nil {
+					continue
+				}
+				logger.Debug("Relayed message to the interlocutor", "bytes", len(clientMessage))
+			case constants.CHAT_CONTROL:
+				// The receipts and the typing are dropped quietly over the limits, and
+				// don't keep the chat active
+				if len(clientMessage) > constants.MAX_CONTROL_SIZE || !controlBucket.Allow(s.clock.Now()) {
+					logger.Debug("Control message over the limit is dropped", "bytes", len(clientMessage))
+					s.metrics.errors.Inc(ERROR_CONTROL_LIMIT)
+					continue
+				}
+				_ = client.send(clientMessage)
+			case constants.REKEY_SALT:
+				_ = client.send(clientMessage)
+			case constants.CONTACTS, constants.CONTACT_ACCEPT, constants.CONTACT_BLOCK:
+				if err := s.handleContactCommand(conn, client.name, client.logger, signal, payload); err != nil {
+					logger.Warn("Couldn't send the message", "error", err)
+				}
+			case constants.LEAVE:
+				logger.Info("Client left the chat")
+				return nil
+			default:
+				logger.Debug("Unknown message is dropped", "bytes", len(clientMessage))
+			}
+
+		case <-heartbeat:
+			heartbeat = s.clock.After(s.heartbeatInterval)
+			if s.timeouts.Idle > 0 && s.clock.Now().Sub(lastMessage) >= s.timeouts.Idle {
+				logger.Info("Chat is idle past the timeout")
+				s.endIdleChat(conn, client)
+				return nil
+			}
+			silence := s.clock.Now().Sub(lastSeen)
+			// The client, which doesn't answer the pings, is considered dead
+			if silence >= constants.HEARTBEAT_DEAD_MISSES*s.heartbeatInterval {
+				logger.Info("Client missed the heartbeats", "silence", silence)
+				s.metrics.errors.Inc(ERROR_HEARTBEAT_TIMEOUT)
+				return ErrConnectionLost
+			}
+			if silence >= constants.HEARTBEAT_AWAY_MISSES*s.heartbeatInterval {
+				setStatus(constants.STATUS_AWAY)
+			}
+			ping := constants.PING + constants.DATA_SEPARATOR + strconv.FormatInt(s.clock.Now().UnixNano(), 10)
+			if err := communication.SendMessage(conn, ping); err != nil {
+				logger.Debug("Couldn't send the heartbeat", "error", err)
+			}
+
+		case err := <-errorChannel:
+			if err.Error() == io.EOF.Error() {
+				logger.Info("Connection closed by client")
+				return ErrConnectionLost
+			}
+			// The client, which doesn't even answer the pings, is silent past the idle timeout
+			if communication.IsTimeout(err) {
+				logger.Info("Client went silent past the idle timeout")
+				s.endIdleChat(conn, client)
+				return nil
+			}
+			// The connection could be closed forcibly during the shutdown
+			logger.Warn("Connection read error", "error", err)
+			s.metrics.errors.Inc(ERROR_READ)
+			return ErrConnectionLost
+		}
+	}
+}
+
+// Disconnects the idle client, and informs its interlocutor
+func (s *DHServer) endIdleChat(conn net.Conn, client *DHClient) {
+	s.metrics.errors.Inc(ERROR_IDLE_TIMEOUT)
+	if err := communication.SendMessage(conn, constants.IDLE_TIMEOUT_EXCEEDED); err != nil {
+		client.logger.Debug("Couldn't send the message", "error", err)
+	}
+	client.notifyInterlocutor(constants.INTERLOCUTOR_IDLE)
+}
@@ -0,0 +1,59 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+func TestIdleChatIsClosedDespiteHeartbeats(t *testing.T) {
+	_, address, _ := startServer(t,
+		WithHeartbeatInterval(50*time.Millisecond),
+		WithTimeouts(communication.Timeouts{Handshake: time.Minute, Idle: 300 * time.Millisecond, Write: time.Second}))
+	alice, bob := pair(t, address)
+	aliceMessages, bobMessages := answerPings(alice), answerPings(bob)
+
+	// The messages of one side keep the chat of both active for longer than the idle timeout
+	for i := 0; i < 4; i++ {
+		if err := communication.SendMessage(alice, constants.CHAT_MESSAGE+constants.DATA_SEPARATOR+"hi"); err != nil {
+			t.Fatal(err)
+		}
+		awaitSignal(t, bobMessages, constants.CHAT_MESSAGE)
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, messages := range []<-chan string{aliceMessages, bobMessages} {
+		select {
+		case message := <-messages:
+			t.Fatalf("active chat got %q", message)
+		default:
+		}
+	}
+	// The pongs alone don't keep it
+	awaitIdleChat(t, aliceMessages, bobMessages)
+}
+
+// The receipts and the typing aren't the conversation, so they don't keep
+// the chat active
+func TestControlMessagesDontKeepChatActive(t *testing.T) {
+	_, address, _ := startServer(t,
+		WithHeartbeatInterval(50*time.Millisecond),
+		WithTimeouts(communication.Timeouts{Handshake: time.Minute, Idle: 300 * time.Millisecond, Write: time.Second}))
+	alice, bob := pair(t, address)
+	aliceMessages, bobMessages := answerPings(alice), answerPings(bob)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				_ = communication.SendMessage(alice, constants.CHAT_CONTROL+constants.DATA_SEPARATOR+"typing")
+			}
+		}
+	}()
+	awaitSignal(t, bobMessages, constants.CHAT_CONTROL)
+	awaitIdleChat(t, aliceMessages, bobMessages)
+}
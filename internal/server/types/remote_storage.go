@@ -0,0 +1,228 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/identity"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+var ErrInvalidStorageCall = errors.New("invalid storage call")
+
+// Methods of the storages, shared by the broker
+const (
+	STORAGE_LOOKUP       = "lookup"
+	STORAGE_REGISTER     = "register"
+	STORAGE_DELETE       = "delete"
+	STORAGE_NAMES        = "names"
+	STORAGE_REQUEST      = "request"
+	STORAGE_ACCEPT       = "accept"
+	STORAGE_BLOCK        = "block"
+	STORAGE_ARE_CONTACTS = "are_contacts"
+	STORAGE_LIST         = "list"
+)
+
+// Call of the storage, shared by the broker. The request is in the format
+// "BROKER_ACCOUNTS:call" or "BROKER_CONTACTS:call", and the reply is either
+// "BROKER_REPLY:result" or "BROKER_ERROR:error", both encoded as JSON.
+type storageCall struct {
+	Method string   `json:"method"`
+	Args   []string `json:"args"`
+}
+
+// The errors, which the callers tell apart, are restored from their text
+var storageErrors = []error{ErrAccountExists, ErrNoContactRequest}
+
+func restoreStorageError(message string) error {
+	for _, err := range storageErrors {
+		if err.Error() == message {
+			return err
+		}
+	}
+	return errors.New(message)
+}
+
+// Calls the storage, shared by the broker on the address, and decodes its result
+func callStorage(address string, signal string, method string, result any, args ...string) error {
+	call, err := json.Marshal(storageCall{Method: method, Args: args})
+	if err != nil {
+		return err
+	}
+	conn, err := transport.Dial(address)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(constants.HANDSHAKE_TIMEOUT * time.Second))
+	if err = communication.SendMessage(conn, signal+constants.DATA_SEPARATOR+string(call)); err != nil {
+		return fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+	}
+	reply, err := communication.ReadMessage(conn, make([]byte, constants.BUFFER_SIZE))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+	}
+	replySignal, payload := communication.ParseSignal(reply, constants.DATA_SEPARATOR)
+	switch replySignal {
+	case constants.BROKER_REPLY:
+		if result == nil {
+			return nil
+		}
+		if err = json.Unmarshal([]byte(payload), result); err != nil {
+			return fmt.Errorf("%w: %w", ErrBrokerUnavailable, err)
+		}
+		return nil
+	case constants.BROKER_ERROR:
+		return restoreStorageError(payload)
+	}
+	return ErrBrokerUnavailable
+}
+
+// Serves the call of the storage by another instance, replying with its result
+func serveStorageCall(conn net.Conn, signal string, payload string, accounts AccountStorage, contacts ContactStorage, logger *slog.Logger) {
+	defer conn.Close()
+	var call storageCall
+	var result any
+	err := json.Unmarshal([]byte(payload), &call)
+	if err != nil {
+		err = ErrInvalidStorageCall
+	} else if signal == constants.BROKER_ACCOUNTS {
+		result, err = callAccounts(accounts, call)
+	} else {
+		result, err = callContacts(contacts, call)
+	}
+	var encoded []byte
+	if err == nil {
+		encoded, err = json.Marshal(result)
+	}
+	reply := constants.BROKER_REPLY + constants.DATA_SEPARATOR + string(encoded)
+	if err != nil {
+		if errors.Is(err, ErrInvalidStorageCall) {
+			logger.Warn("Invalid storage call", "storage", signal, "bytes", len(payload))
+		}
+		reply = constants.BROKER_ERROR + constants.DATA_SEPARATOR + err.Error()
+	}
+	if err = communication.SendMessage(conn, reply); err != nil {
+		logger.Debug("Couldn't reply to the storage call", "error", err)
+	}
+}
+
+func callAccounts(accounts AccountStorage, call storageCall) (any, error) {
+	switch {
+	case call.Method == STORAGE_LOOKUP && len(call.Args) == 1:
+		// The unknown name is an empty key
+		key, ok := accounts.Lookup(call.Args[0])
+		if !ok {
+			return "", nil
+		}
+		return identity.EncodePublicKey(key), nil
+	case call.Method == STORAGE_REGISTER && len(call.Args) == 2:
+		key, err := identity.DecodePublicKey(call.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return nil, accounts.Register(call.Args[0], key)
+	case call.Method == STORAGE_DELETE && len(call.Args) == 1:
+		return nil, accounts.Delete(call.Args[0])
+	case call.Method == STORAGE_NAMES && len(call.Args) == 0:
+		return accounts.Names(), nil
+	}
+	return nil, ErrInvalidStorageCall
+}
+
+func callContacts(contacts ContactStorage, call storageCall) (any, error) {
+	switch {
+	case call.Method == STORAGE_REQUEST && len(call.Args) == 2:
+		return contacts.Request(call.Args[0], call.Args[1])
+	case call.Method == STORAGE_ACCEPT && len(call.Args) == 2:
+		return nil, contacts.Accept(call.Args[0], call.Args[1])
+	case call.Method == STORAGE_BLOCK && len(call.Args) == 2:
+		return nil, contacts.Block(call.Args[0], call.Args[1])
+	case call.Method == STORAGE_ARE_CONTACTS && len(call.Args) == 2:
+		return contacts.AreContacts(call.Args[0], call.Args[1]), nil
+	case call.Method == STORAGE_LIST && len(call.Args) == 1:
+		return contacts.List(call.Args[0]), nil
+	}
+	return nil, ErrInvalidStorageCall
+}
+
+// Accounts kept by another instance, which serves the broker, see ServeBroker
+type remoteAccounts struct {
+	address string
+}
+
+// NewRemoteAccounts keeps the accounts by the instance, which serves the
+// broker on the address, so every name is registered once for all instances
+func NewRemoteAccounts(address string) AccountStorage {
+	return remoteAccounts{address: address}
+}
+
+// The name is unknown, while the broker is unavailable. Its registration
+// fails meanwhile, so the name is never claimed twice.
+func (a remoteAccounts) Lookup(name string) (ed25519.PublicKey, bool) {
+	var encoded string
+	if err := callStorage(a.address, constants.BROKER_ACCOUNTS, STORAGE_LOOKUP, &encoded, name); err != nil || encoded == "" {
+		return nil, false
+	}
+	key, err := identity.DecodePublicKey(encoded)
+	return key, err == nil
+}
+
+func (a remoteAccounts) Register(name string, key ed25519.PublicKey) error {
+	return callStorage(a.address, constants.BROKER_ACCOUNTS, STORAGE_REGISTER, nil, name, identity.EncodePublicKey(key))
+}
+
+func (a remoteAccounts) Delete(name string) error {
+	return callStorage(a.address, constants.BROKER_ACCOUNTS, STORAGE_DELETE, nil, name)
+}
+
+func (a remoteAccounts) Names() []string {
+	names := []string{}
+	_ = callStorage(a.address, constants.BROKER_ACCOUNTS, STORAGE_NAMES, &names)
+	return names
+}
+
+// Contacts kept by another instance, which serves the broker, see ServeBroker
+type remoteContacts struct {
+	address string
+}
+
+// NewRemoteContacts keeps the contacts by the instance, which serves the
+// broker on the address, so the clients of all instances share them
+func NewRemoteContacts(address string) ContactStorage {
+	return remoteContacts{address: address}
+}
+
+func (c remoteContacts) Request(from string, to string) (bool, error) {
+	var accepted bool
+	err := callStorage(c.address, constants.BROKER_CONTACTS, STORAGE_REQUEST, &accepted, from, to)
+	return accepted, err
+}
+
+func (c remoteContacts) Accept(owner string, from string) error {
+	return callStorage(c.address, constants.BROKER_CONTACTS, STORAGE_ACCEPT, nil, owner, from)
+}
+
+func (c remoteContacts) Block(owner string, other string) error {
+	return callStorage(c.address, constants.BROKER_CONTACTS, STORAGE_BLOCK, nil, owner, other)
+}
+
+// Nobody is a contact, while the broker is unavailable
+func (c remoteContacts) AreContacts(first string, second string) bool {
+	var contacts bool
+	_ = callStorage(c.address, constants.BROKER_CONTACTS, STORAGE_ARE_CONTACTS, &contacts, first, second)
+	return contacts
+}
+
+func (c remoteContacts) List(owner string) ContactList {
+	list := ContactList{Contacts: []string{}, Requests: []string{}, Blocked: []string{}}
+	_ = callStorage(c.address, constants.BROKER_CONTACTS, STORAGE_LIST, &list, owner)
+	return list
+}
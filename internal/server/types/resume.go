@@ -0,0 +1,206 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+var ErrConnectionLost = errors.New("connection lost")
+
+// Handed by the resuming connection to the handler of the lost one
+type resumeRequest struct {
+	conn net.Conn
+	// Closed by the chat handler, once it's done with the connection
+	done chan struct{}
+}
+
+// Returns the connection back to its own handler
+func (r *resumeRequest) release() {
+	if r != nil {
+		close(r.done)
+	}
+}
+
+func newTicket() (string, error) {
+	ticket := make([]byte, 16)
+	if _, err := rand.Read(ticket); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ticket), nil
+}
+
+// Issues a new session ticket to the client, which replaces the previous one
+func (s *DHServer) issueTicket(conn net.Conn, client *DHClient) error {
+	ticket, err := newTicket()
+	if err != nil {
+		return err
+	}
+	s.clientsMut.Lock()
+	delete(s.tickets, client.ticket)
+	client.ticket = ticket
+	s.tickets[ticket] = client
+	s.clientsMut.Unlock()
+	return communication.SendMessage(conn, constants.SESSION_TICKET+constants.DATA_SEPARATOR+ticket)
+}
+
+func (s *DHServer) revokeTicket(client *DHClient) {
+	s.clientsMut.Lock()
+	delete(s.tickets, client.ticket)
+	client.ticket = ""
+	s.clientsMut.Unlock()
+}
+
+// Keeps the chat of the lost connection, until the client resumes it.
+// The interlocutor's messages are kept meanwhile, as many as the queue allows.
+func (s *DHServer) awaitResume(client *DHClient) (*resumeRequest, bool) {
+	// Neither the shutdown nor the admin disconnection are resumable, and
+	// the forwarded client has no ticket to resume with
+	if client.forwarded {
+		return nil, false
+	}
+	select {
+	case <-s.quit:
+		return nil, false
+	case <-client.disconnected:
+		return nil, false
+	default:
+	}
+	client.logger.Info("Waiting for the client to resume the chat", "window", s.resumeWindow)
+	client.notifyInterlocutor(constants.PEER_STATUS + constants.DATA_SEPARATOR + constants.STATUS_RECONNECTING)
+
+	expired := s.clock.After(s.resumeWindow)
+	for {
+		select {
+		case request := <-client.resumed:
+			return request, true
+		case message := <-client.inbox():
+			if len(client.pending) < constants.CHAT_QUEUE_SIZE {
+				client.pending = append(client.pending, message)
+			}
+		// The interlocutor has left as well, so there's nothing to resume
+		case <-client.chat.Done():
+			return nil, false
+		case <-expired:
+			client.logger.Info("Client didn't resume the chat in time")
+			return nil, false
+		case <-s.quit:
+			return nil, false
+		case <-client.disconnected:
+			return nil, false
+		}
+	}
+}
+
+// Switches the chat to the resumed connection, and rekeys it. The peers sign
+// their public salts with the old key and mix it into the new one, so the
+// chat goes on only with the party that derived the old key.
+func (s *DHServer) resumeChat(conn net.Conn, client *DHClient) error {
+	s.clientsMut.Lock()
+	client.conn, client.clientAddress = conn, conn.RemoteAddr()
+	s.clientsMut.Unlock()
+	client.logger.Info("Client resumed the chat", "remote_addr", conn.RemoteAddr().String())
+	s.metrics.resumedSessions.Inc()
+
+	if err := communication.SendMessage(conn, constants.RESUMED); err != nil {
+		return err
+	}
+	if err := s.issueTicket(conn, client); err != nil {
+		return err
+	}
+	p, g, err := s.parameters()
+	if err != nil {
+		return err
+	}
+	// Both peers derive a fresh key with the new base secrets, exchanging
+	// their public salts via the relay
+	rekey := constants.REKEY + constants.DATA_SEPARATOR + p.String() + constants.DATA_SEPARATOR + g.String()
+	if err = communication.SendMessage(conn, rekey); err != nil {
+		return err
+	}
+	// The interlocutor, who misses the rekey, couldn't read the resumed chat
+	if err = client.deliver(rekey, s.clock.After(s.timeouts.Handshake)); err != nil {
+		return err
+	}
+	client.notifyInterlocutor(constants.PEER_STATUS + constants.DATA_SEPARATOR + constants.STATUS_ONLINE)
+
+	// The messages, which arrived meanwhile, are delivered before the new ones
+	for _, message := range client.pending {
+		if err = communication.SendMessage(conn, message); err != nil {
+			return err
+		}
+	}
+	client.pending = nil
+	establish(conn)
+	return nil
+}
+
+// Hands the connection over to the handler of the chat, identified by the
+// ticket, and waits until that handler is done with it. The ticket alone
+// isn't enough, the client proves the name of the chat is its own.
+func (s *DHServer) resumeSession(conn net.Conn, buffer []byte, ticket string, logger *slog.Logger) {
+	// Every resumption costs an identity check and a rekey of the chat
+	if !s.allowHandshake(remoteIP(conn.RemoteAddr())) {
+		logger.Warn("Handshake rate limit exceeded")
+		s.metrics.errors.Inc(ERROR_HANDSHAKE_LIMIT)
+		if err := communication.SendMessage(conn, constants.RATE_LIMITED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+
+	s.clientsMut.RLock()
+	client, ok := s.tickets[ticket]
+	s.clientsMut.RUnlock()
+	if !ok {
+		logger.Warn("Unknown session ticket")
+		s.metrics.errors.Inc(ERROR_RESUME)
+		if err := communication.SendMessage(conn, constants.RESUME_FAILED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	logger = logger.With("client", client.name)
+	if err := s.authenticateOwner(conn, buffer, client.name); err != nil {
+		logger.Warn("Authentication failed", "error", err)
+		s.metrics.errors.Inc(ERROR_AUTH)
+		if refusal, ok := authRefusals[err]; ok {
+			if err = communication.SendMessage(conn, refusal); err != nil {
+				logger.Warn("Couldn't send the message", "error", err)
+			}
+		}
+		return
+	}
+	// The ticket may have been replaced meanwhile, and the lost connection
+	// may still look alive to the server
+	s.clientsMut.RLock()
+	current, lost := s.tickets[ticket], client.conn
+	s.clientsMut.RUnlock()
+	if current != client {
+		logger.Warn("Session ticket is outdated")
+		s.metrics.errors.Inc(ERROR_RESUME)
+		if err := communication.SendMessage(conn, constants.RESUME_FAILED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+	lost.Close()
+
+	request := &resumeRequest{conn: conn, done: make(chan struct{})}
+	select {
+	case client.resumed <- request:
+		<-request.done
+	case <-s.clock.After(s.timeouts.Handshake):
+		logger.Warn("Chat wasn't resumed in time")
+		s.metrics.errors.Inc(ERROR_RESUME)
+		if err := communication.SendMessage(conn, constants.RESUME_FAILED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+	case <-s.quit:
+	}
+}
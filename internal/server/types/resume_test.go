@@ -0,0 +1,35 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+func TestResumeRequiresOwner(t *testing.T) {
+	_, address, _ := startServer(t)
+	alice, bob, ticket, _ := pairWithTickets(t, address)
+	aliceMessages, bobMessages := answerPings(alice), answerPings(bob)
+
+	// The stolen ticket isn't enough to take the chat over
+	mallory := dial(t, address)
+	if response := login(t, mallory, newIdentity(t), constants.RESUME+constants.DATA_SEPARATOR+ticket, "alice"); response != constants.AUTH_FAILED {
+		t.Fatalf("mallory got %q", response)
+	}
+	if err := communication.SendMessage(alice, constants.CHAT_MESSAGE+constants.DATA_SEPARATOR+"hi"); err != nil {
+		t.Fatal(err)
+	}
+	awaitSignal(t, bobMessages, constants.CHAT_MESSAGE)
+
+	// The owner resumes the lost connection, and both peers are rekeyed
+	alice.Close()
+	for range aliceMessages {
+	}
+	resumed := dial(t, address)
+	if response := login(t, resumed, identityOf("alice"), constants.RESUME+constants.DATA_SEPARATOR+ticket, "alice"); response != constants.RESUMED {
+		t.Fatalf("alice got %q", response)
+	}
+	awaitSignal(t, answerPings(resumed), constants.REKEY)
+	awaitSignal(t, bobMessages, constants.REKEY)
+}
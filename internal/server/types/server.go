@@ -1,147 +1,539 @@
 package types
 
 import (
-	"io"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
-	"strings"
+	"net/url"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dikuropiatnyk/dh-chat/internal/constants"
 	"github.com/dikuropiatnyk/dh-chat/internal/server/actions"
 	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
 )
 
+var ErrServerStarted = errors.New("server is already started")
+
 type DHServer struct {
-	addrress    string
-	listener    net.Listener
-	waitingPool map[string]*DHClient
-	mut         sync.RWMutex
+	address         string
+	listener        net.Listener
+	broker          Broker
+	logger          *slog.Logger
+	clock           Clock
+	parameters      ParameterSource
+	waitTimeout     time.Duration
+	shutdownTimeout time.Duration
+	metrics         *serverMetrics
+	// Every accepted connection is tracked, so clients can be notified on
+	// shutdown, with the connection the notices are sent to
+	connections map[net.Conn]net.Conn
+	// Set once the clients are notified about the shutdown
+	notified bool
+	connMut  sync.Mutex
+	handlers sync.WaitGroup
+	// Closed as soon as the shutdown begins to release the waiting clients
+	quit chan struct{}
+	// Semaphore of the rejections being delivered
+	rejections chan struct{}
+	// Named clients, both waiting and chatting, exposed via the admin API
+	clients     map[*DHClient]struct{}
+	clientsMut  sync.RWMutex
+	maintenance atomic.Bool
+	limits      Limits
+	quotas      *quotas
+	timeouts    communication.Timeouts
+	// How often the clients of the established chats are pinged
+	heartbeatInterval time.Duration
+	// Session tickets of the established chats, guarded by clientsMut
+	tickets      map[string]*DHClient
+	resumeWindow time.Duration
+	// Registered names, unknown ones are registered on the first login, if the registration is open
+	accounts         AccountStorage
+	openRegistration bool
+	contacts         ContactStorage
+	presence         *presence
+	// Multiplexed sessions by the client name
+	sessions    map[string]*muxSession
+	sessionsMut sync.Mutex
+	// Links with the servers of other offices, nil unless federated
+	federation *federation
 }
 
-func NewDHServer() *DHServer {
-	return &DHServer{addrress: constants.SERVER_ADDRESS, waitingPool: make(map[string]*DHClient)}
+func NewDHServer(options ...Option) *DHServer {
+	s := &DHServer{
+		address:           constants.SERVER_ADDRESS,
+		broker:            NewMemoryBroker(),
+		logger:            slog.Default(),
+		clock:             systemClock{},
+		parameters:        defaultParameterSource,
+		waitTimeout:       constants.INTERLOCUTOR_WAIT_TIME * time.Second,
+		shutdownTimeout:   constants.SHUTDOWN_TIMEOUT * time.Second,
+		connections:       make(map[net.Conn]net.Conn),
+		quit:              make(chan struct{}),
+		rejections:        make(chan struct{}, constants.MAX_PENDING_REJECTIONS),
+		clients:           make(map[*DHClient]struct{}),
+		limits:            DefaultLimits(),
+		quotas:            newQuotas(),
+		heartbeatInterval: constants.HEARTBEAT_INTERVAL * time.Second,
+		tickets:           make(map[string]*DHClient),
+		resumeWindow:      constants.RESUME_WINDOW * time.Second,
+		accounts:          NewMemoryAccounts(),
+		openRegistration:  true,
+		contacts:          NewMemoryContacts(),
+		presence:          newPresence(),
+		sessions:          make(map[string]*muxSession),
+		timeouts: communication.Timeouts{
+			Handshake: constants.HANDSHAKE_TIMEOUT * time.Second,
+			Idle:      constants.IDLE_TIMEOUT * time.Second,
+			Write:     constants.WRITE_TIMEOUT * time.Second,
+		},
+		metrics: newServerMetrics(),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.parameters = s.metrics.timeParameters(s.parameters, s.clock)
+	return s
 }
 
-func (s *DHServer) CheckWaitingPool(clientName string) (*DHClient, bool) {
-	s.mut.RLock()
-	defer s.mut.RUnlock()
-	client, ok := s.waitingPool[clientName]
-	return client, ok
+func (s *DHServer) trackConnection(conn net.Conn) {
+	s.connMut.Lock()
+	s.connections[conn] = conn
+	s.connMut.Unlock()
+	s.metrics.connections.Inc()
 }
 
-func (s *DHServer) AddClientToWaitingPool(clientName string, client *DHClient) {
-	s.mut.Lock()
-	s.waitingPool[clientName] = client
-	s.mut.Unlock()
-	log.Printf("Added %s to the waiting pool\n", clientName)
+// Sends the notices of the server to the other connection instead, e.g. to
+// the control stream of the multiplexed one, or holds them, if it's nil.
+// Reports whether the shutdown notice is still to come, otherwise the caller
+// sends it itself.
+func (s *DHServer) notifyVia(conn net.Conn, notices net.Conn) bool {
+	s.connMut.Lock()
+	defer s.connMut.Unlock()
+	if _, ok := s.connections[conn]; ok {
+		s.connections[conn] = notices
+	}
+	return !s.notified
 }
 
-func (s *DHServer) DeleteClientFromWaitingPool(clientName string) {
-	s.mut.Lock()
-	delete(s.waitingPool, clientName)
-	s.mut.Unlock()
-	log.Printf("Deleted %s from the waiting pool\n", clientName)
+func (s *DHServer) untrackConnection(conn net.Conn) {
+	s.connMut.Lock()
+	delete(s.connections, conn)
+	s.connMut.Unlock()
+	s.metrics.connections.Dec()
+}
+
+// Addr returns the address the server is bound to, or nil if it's not serving yet
+func (s *DHServer) Addr() net.Addr {
+	s.connMut.Lock()
+	defer s.connMut.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
 }
 
-func (s *DHServer) Start() {
-	listner, err := net.Listen(constants.SERVER_CONNECTION_TYPE, s.addrress)
+// ListenAndServe binds the configured address and serves it until the context is cancelled
+func (s *DHServer) ListenAndServe(ctx context.Context) error {
+	listener, err := transport.Listen(s.address)
 	if err != nil {
-		log.Fatalln("Bootup error:", err)
-		return
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on the listener until the context is cancelled,
+// and then shuts the server down gracefully. The listener is closed on return.
+// A nil error means the server was stopped via the context.
+func (s *DHServer) Serve(ctx context.Context, listener net.Listener) error {
+	s.connMut.Lock()
+	if s.listener != nil {
+		s.connMut.Unlock()
+		return ErrServerStarted
+	}
+	s.listener = listener
+	s.connMut.Unlock()
+	s.logger.Info("DHServer is starting", "address", listener.Addr().String())
+
+	if s.federation != nil && s.federation.Address != "" {
+		linkListener, err := s.federation.TLS.Listen(&url.URL{Scheme: "tls", Host: s.federation.Address})
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		s.logger.Info("Federation listener is starting", "address", linkListener.Addr().String(), "name", s.federation.Name)
+		defer linkListener.Close()
+		go s.acceptLinks(linkListener)
 	}
-	log.Println("DHServer is starting at", s.addrress)
-	defer listner.Close()
-	s.listener = listner
-	s.AcceptConnections()
+
+	// Closing the listener is the only way to unblock the Accept call
+	acceptDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Shutdown requested, stop accepting connections")
+		case <-acceptDone:
+		}
+		listener.Close()
+	}()
+	err := s.AcceptConnections()
+	close(acceptDone)
+	s.Shutdown(s.shutdownTimeout)
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// AcceptConnections handles the incoming connections until the listener is closed
+func (s *DHServer) AcceptConnections() error {
+	return s.acceptConnections(s.listener)
 }
 
-func (s *DHServer) AcceptConnections() {
+// ServeListener accepts the connections on the additional listener, e.g. the
+// WebSocket one, alongside the main one, until the server is shut down. The
+// listener is closed on return.
+func (s *DHServer) ServeListener(listener net.Listener) error {
+	s.logger.Info("Additional listener is starting", "address", listener.Addr().String())
+	acceptDone := make(chan struct{})
+	go func() {
+		select {
+		case <-s.quit:
+		case <-acceptDone:
+		}
+		listener.Close()
+	}()
+	err := s.acceptConnections(listener)
+	close(acceptDone)
+	return err
+}
+
+func (s *DHServer) acceptConnections(listener net.Listener) error {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Connection error:", err)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.logger.Warn("Connection error", "error", err)
+			s.metrics.errors.Inc(ERROR_ACCEPT)
+			continue
+		}
+		// The additional listeners are closed only after the clients are
+		// notified, the new clients aren't accepted meanwhile
+		select {
+		case <-s.quit:
+			s.rejectConnection(conn, constants.SERVER_SHUTDOWN)
 			continue
+		default:
+		}
+		s.serveConnection(conn)
+	}
+}
+
+// Spawns the handler of the accepted connection
+func (s *DHServer) serveConnection(conn net.Conn) {
+	// The quotas are checked before spawning a handler for the connection
+	ip := remoteIP(conn.RemoteAddr())
+	if !s.acquireConnection(ip) {
+		s.logger.Warn("Connection limit exceeded", "remote_addr", conn.RemoteAddr().String())
+		s.metrics.errors.Inc(ERROR_CONNECTION_LIMIT)
+		s.rejectConnection(conn, constants.TOO_MANY_CONNECTIONS)
+		return
+	}
+	// From now on, every read and write of the connection has a deadline
+	conn = communication.NewTimedConn(conn, s.timeouts)
+	s.trackConnection(conn)
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		defer s.releaseConnection(ip)
+		defer s.recoverHandler(conn)
+		s.HandleConnection(conn)
+	}()
+}
+
+// A bug in a single handler mustn't take the whole server down
+func (s *DHServer) recoverHandler(conn net.Conn) {
+	if r := recover(); r != nil {
+		s.logger.Error("Connection handler panicked", "remote_addr", conn.RemoteAddr().String(), "panic", r, "stack", string(debug.Stack()))
+		s.metrics.errors.Inc(ERROR_PANIC)
+		conn.Close()
+	}
+}
+
+// Notifies the refused client with the signal and closes its connection.
+// The rejection is sent in the background, so a stalled client can't block
+// the accept loop. During a flood, the connections over the pending
+// rejections are closed without the notification.
+func (s *DHServer) rejectConnection(conn net.Conn, signal string) {
+	select {
+	case s.rejections <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-s.rejections }()
+		_ = conn.SetWriteDeadline(s.clock.Now().Add(constants.REJECTION_WRITE_TIMEOUT * time.Second))
+		if err := communication.SendMessage(conn, signal); err != nil {
+			s.logger.Debug("Couldn't send the rejection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		}
+		conn.Close()
+	}()
+}
+
+// Shutdown notifies all connected clients that the server is going down and
+// waits for their chats to finish. Connections, which are still open after
+// the timeout, are closed forcibly.
+func (s *DHServer) Shutdown(timeout time.Duration) {
+	// The clients are notified outside the lock, so a slow one delays neither
+	// the others nor the handlers, which untrack their connections
+	s.connMut.Lock()
+	connections := make([]net.Conn, 0, len(s.connections))
+	for _, notices := range s.connections {
+		if notices != nil {
+			connections = append(connections, notices)
+		}
+	}
+	s.notified = true
+	s.connMut.Unlock()
+	var notified sync.WaitGroup
+	for _, conn := range connections {
+		notified.Add(1)
+		go func(conn net.Conn) {
+			defer notified.Done()
+			if err := communication.SendMessage(conn, constants.SERVER_SHUTDOWN); err != nil {
+				s.logger.Warn("Couldn't notify the client about the shutdown", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			}
+		}(conn)
+	}
+	notified.Wait()
+	close(s.quit)
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.logger.Info("All connections are drained")
+	case <-s.clock.After(timeout):
+		s.logger.Warn("Shutdown timeout exceeded, closing remaining connections")
+		s.connMut.Lock()
+		for conn := range s.connections {
+			conn.Close()
 		}
-		go s.HandleConnection(conn)
+		s.connMut.Unlock()
+		<-drained
 	}
+	s.logger.Info("DHServer is stopped")
 }
 
 func (s *DHServer) HandleConnection(conn net.Conn) {
-	defer actions.CloseConnection(conn)
-	log.Println("Received connection from", conn.RemoteAddr())
+	// Every record of the connection carries its fields, more are added as soon as they are known
+	logger := s.logger.With("remote_addr", conn.RemoteAddr().String())
+	defer s.untrackConnection(conn)
+	defer func() { actions.CloseConnection(conn, logger) }()
+	logger.Info("Received connection")
 	buffer := make([]byte, constants.BUFFER_SIZE)
 	// First reading from the connection to get the client name and the interlocutor
 	clientData, err := communication.ReadMessage(conn, buffer)
 	if err != nil {
+		s.metrics.errors.Inc(ERROR_READ)
+		return
+	}
+	// The client, which lost its connection, resumes the chat instead of logging in
+	if signal, ticket := communication.ParseSignal(clientData, constants.DATA_SEPARATOR); signal == constants.RESUME {
+		s.resumeSession(conn, buffer, ticket, logger)
+		return
+	}
+	// The client, which waits for the invitations, joins the lobby instead of the chat
+	if signal, login := communication.ParseSignal(clientData, constants.DATA_SEPARATOR); signal == constants.LOBBY {
+		s.handleLobby(conn, buffer, login, logger)
+		return
+	}
+	// The client, which chats with many interlocutors at once, opens a multiplexed session
+	if signal, name := communication.ParseSignal(clientData, constants.DATA_SEPARATOR); signal == constants.MULTIPLEX {
+		s.handleMultiplex(conn, buffer, name, logger)
+		return
+	}
+	// The client data is in the format "clientName:interlocutor"
+	clientName, interlocutor, err := ParseLogin(clientData)
+	if err != nil {
+		// The malformed login is never logged, only its size
+		logger.Warn("Invalid login", "error", err, "bytes", len(clientData))
+		s.metrics.errors.Inc(ERROR_LOGIN)
+		if err = communication.SendMessage(conn, loginRefusals[err]); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
 		return
 	}
-	// Split the client data into the client name and the interlocutor
-	// The client data is in the format "clientName;interlocutor"
-	clientDataSlice := strings.Split(clientData, constants.DATA_SEPARATOR)
-	clientName, interlocutor := clientDataSlice[0], clientDataSlice[1]
+	logger = logger.With("client", clientName, "interlocutor", interlocutor)
 
-	// Making sure the client is not already in the waiting pool
-	_, ok := s.CheckWaitingPool(clientName)
-	if ok {
-		log.Printf("Client %s is already in the waiting pool!\n", clientName)
-		if err = communication.SendMessage(conn, constants.CLIENT_EXISTS); err != nil {
-			log.Println("Couldn't send the message:", err)
+	// The chat with the client of another server may be hosted by that server
+	server, interlocutor, err := s.hostOf(interlocutor)
+	if err != nil {
+		logger.Info("Interlocutor's server isn't federated")
+		if err = communication.SendMessage(conn, loginRefusals[err]); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+
+	// No new pairings are allowed during the maintenance
+	if s.InMaintenance() {
+		logger.Info("Client is refused due to the maintenance")
+		if err = communication.SendMessage(conn, constants.SERVER_MAINTENANCE); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+
+	// Every login costs an identity check and may register a name
+	if !s.allowHandshake(remoteIP(conn.RemoteAddr())) {
+		logger.Warn("Handshake rate limit exceeded")
+		s.metrics.errors.Inc(ERROR_HANDSHAKE_LIMIT)
+		if err = communication.SendMessage(conn, constants.RATE_LIMITED); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
+		return
+	}
+
+	// Only the owner of the name may claim it
+	if err = s.authenticate(conn, buffer, clientName, logger); err != nil {
+		logger.Warn("Authentication failed", "error", err)
+		s.metrics.errors.Inc(ERROR_AUTH)
+		if refusal, ok := authRefusals[err]; ok {
+			if err = communication.SendMessage(conn, refusal); err != nil {
+				logger.Warn("Couldn't send the message", "error", err)
+			}
+		}
+		return
+	}
+
+	if server != "" {
+		s.forwardChat(conn, clientName, interlocutor, server, logger)
+		return
+	}
+	s.pairClient(conn, buffer, clientName, interlocutor, false, logger)
+}
+
+// Pairs the client with its interlocutor and relays their chat. The client,
+// forwarded by the federated server, resumes via that server, which doesn't
+// know the tickets of this one, so its chat isn't resumable.
+func (s *DHServer) pairClient(conn net.Conn, buffer []byte, clientName string, interlocutor string, forwarded bool, logger *slog.Logger) {
+	var err error
+	// Only the mutual contacts may chat. Naming the stranger asks it to become a
+	// contact, while naming the one who asked accepts the request.
+	if !s.contacts.AreContacts(clientName, interlocutor) {
+		accepted, err := s.contacts.Request(clientName, interlocutor)
+		if err != nil {
+			logger.Warn("Couldn't save the contact request", "error", err)
+			return
+		}
+		if !accepted {
+			logger.Info("Contact request is sent")
+			s.notifyContactRequest(interlocutor, clientName)
+			if err = communication.SendMessage(conn, constants.CONTACT_REQUESTED); err != nil {
+				logger.Warn("Couldn't send the message", "error", err)
+			}
+			return
+		}
+		logger.Info("Contact request is accepted")
+	}
+
+	// The client either joins the chat of its waiting interlocutor, or waits for one
+	chat, side, err := s.broker.Pair(clientName, interlocutor)
+	if err != nil {
+		if !errors.Is(err, ErrClientExists) {
+			logger.Error("Couldn't pair the client", "error", err)
+			s.metrics.errors.Inc(ERROR_BROKER)
 			return
 		}
+		logger.Warn("Client is already waiting")
+		s.metrics.errors.Inc(ERROR_CLIENT_EXISTS)
+		if err = communication.SendMessage(conn, constants.CLIENT_EXISTS); err != nil {
+			logger.Warn("Couldn't send the message", "error", err)
+		}
 		return
 	}
 
-	client := NewDHClient(conn.RemoteAddr(), clientName, interlocutor)
+	client := NewDHClient(conn, clientName, interlocutor, logger)
+	client.forwarded = forwarded
 	defer client.Close()
+	client.joinChat(chat, side)
+	s.registerClient(client)
+	defer s.unregisterClient(client)
 
-	// Check if the interlocutor is in the waiting pool
-	availableClient, ok := s.CheckWaitingPool(interlocutor)
-	// If no interlocutor is found, add the client to the waiting pool
-	if !(ok && availableClient.interlocutor == clientName) {
-		client.readChannel, client.writeChannel = make(chan string, 2), make(chan string, 2)
-		s.AddClientToWaitingPool(clientName, client)
-		err = client.HandleFirstClient(conn, buffer)
-		s.DeleteClientFromWaitingPool(clientName)
+	if side == 0 {
+		s.metrics.waitingClients.Inc()
+		client.logger.Debug("Client is waiting for the interlocutor")
+		err = client.HandleFirstClient(conn, buffer, s.clock.After(s.waitTimeout), s.quit)
+		s.metrics.waitingClients.Dec()
 		if err != nil {
-			log.Println("Client handling error:", err)
+			client.logger.Warn("Client handling error", "error", err)
+			if errors.Is(err, ErrWaitingTimeoutExceeded) {
+				s.metrics.errors.Inc(ERROR_WAIT_TIMEOUT)
+			} else if !errors.Is(err, ErrServerShutdown) && !errors.Is(err, ErrClientDisconnected) && !errors.Is(err, ErrClientLeft) {
+				s.metrics.errors.Inc(ERROR_HANDSHAKE)
+			}
 			return
 		}
+		s.markPaired(client)
 		// If the interlocutor is found, start an immediate synchronization
 	} else {
-		client.readChannel, client.writeChannel = availableClient.writeChannel, availableClient.readChannel
-		if err = client.HandleSecondClient(conn, buffer); err != nil {
-			log.Println("Client handling error:", err)
+		// The second client drives the chat synchronization, so it's the one to measure it
+		handshakeStart := s.clock.Now()
+		if err = client.HandleSecondClient(conn, buffer, s.parameters); err != nil {
+			client.logger.Warn("Client handling error", "error", err)
+			s.metrics.errors.Inc(ERROR_HANDSHAKE)
 			return
 		}
+		s.metrics.handshakeLatency.Observe(s.clock.Now().Sub(handshakeStart).Seconds())
+		s.markPaired(client)
+		s.metrics.activeChats.Inc()
+		defer s.metrics.activeChats.Dec()
 	}
 
-	ioReadChannel := make(chan string)
-	errorChannel := make(chan error)
-
-	go actions.ReadFromConnection(conn, buffer, ioReadChannel, errorChannel)
-
-	// Here comes the actual chatting!
-	for {
-		select {
-		case interlocutorMessage, ok := <-client.readChannel:
-			if !ok {
-				log.Println(ErrReadChannelClosed)
-				return
-			}
-			if err := communication.SendMessage(conn, interlocutorMessage); err != nil {
-				log.Println("Couldn't send the message:", err)
-				continue
-			}
-			log.Printf("[%s] received message from [%s]: \n%s\n", client.name, client.interlocutor, interlocutorMessage)
-		case clientMessage := <-ioReadChannel:
-			client.writeChannel <- clientMessage
-			log.Printf("[%s] sent message to [%s]: \n%s\n", client.name, client.interlocutor, clientMessage)
-		case err := <-errorChannel:
-			if err.Error() == io.EOF.Error() {
-				log.Println("Connection closed by client")
-				return
-			}
+	if !forwarded {
+		if err = s.issueTicket(conn, client); err != nil {
+			client.logger.Warn("Couldn't issue the session ticket", "error", err)
+		}
+		defer s.revokeTicket(client)
+	}
+	establish(conn)
+	// Here comes the actual chatting! The lost connection is replaced with the
+	// resumed one, as long as the client comes back in time
+	var resumed *resumeRequest
+	// The resumed connection is owned by its own handler, and so released back to it
+	defer func() { resumed.release() }()
+	for errors.Is(s.relayChat(conn, client), ErrConnectionLost) {
+		request, ok := s.awaitResume(client)
+		resumed.release()
+		resumed = request
+		if !ok {
+			return
+		}
+		conn = request.conn
+		if err = s.resumeChat(conn, client); err != nil {
+			client.logger.Warn("Couldn't resume the chat", "error", err)
+			return
 		}
 	}
 }
+
+// The reads of the established chat are limited with the idle timeout
+func establish(conn net.Conn) {
+	if timedConn, ok := conn.(*communication.TimedConn); ok {
+		timedConn.Established()
+	}
+}
@@ -0,0 +1,95 @@
+package types
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/internal/constants"
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+	"github.com/dikuropiatnyk/dh-chat/pkg/transport"
+)
+
+func TestShutdownDrainsClients(t *testing.T) {
+	_, address, stop := startServer(t,
+		WithShutdownTimeout(time.Minute),
+		WithContacts(mutualContacts(t, "alice", "bob", "carol", "dave")))
+	alice, bob := pair(t, address)
+	carol := dial(t, address)
+	if response := login(t, carol, newIdentity(t), "carol:dave", "carol"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("carol got %q instead of waiting", response)
+	}
+
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	// Both the chatting and the waiting clients are notified, and their
+	// handlers are over long before the timeout
+	readUntil(t, alice, constants.SERVER_SHUTDOWN)
+	readUntil(t, bob, constants.SERVER_SHUTDOWN)
+	readUntil(t, carol, constants.SERVER_SHUTDOWN)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Minute {
+		t.Fatalf("shutdown waited for the timeout: %v", elapsed)
+	}
+}
+
+func TestShutdownClosesStalledConnections(t *testing.T) {
+	_, address, stop := startServer(t,
+		WithShutdownTimeout(100*time.Millisecond),
+		WithTimeouts(communication.Timeouts{Handshake: time.Minute, Idle: time.Minute, Write: 50 * time.Millisecond}))
+	// The client neither logs in nor reads, so the notification can't reach it
+	stalled := dial(t, address)
+	waiting := dial(t, address)
+	if response := login(t, waiting, newIdentity(t), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	go io.Copy(io.Discard, waiting)
+
+	start := time.Now()
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("shutdown didn't wait for the stalled connection: %v", elapsed)
+	}
+	_ = stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := communication.ReadMessage(stalled, make([]byte, constants.BUFFER_SIZE)); !errors.Is(err, io.EOF) {
+		t.Fatalf("stalled connection isn't closed: %v", err)
+	}
+}
+
+// The WebSocket clients are served alongside the main listener, until the
+// shutdown closes their listener
+func TestServeWebSocketListener(t *testing.T) {
+	server, _, stop := startServer(t, WithShutdownTimeout(time.Minute))
+	listener, err := transport.Listen("ws://127.0.0.1:0" + constants.WEBSOCKET_PATH)
+	if err != nil {
+		t.Skip("loopback isn't available:", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.ServeListener(listener) }()
+
+	conn := dial(t, "ws://"+listener.Addr().String()+constants.WEBSOCKET_PATH)
+	if response := login(t, conn, identityOf("alice"), "alice:bob", "alice"); response != constants.NO_INTERLOCUTOR {
+		t.Fatalf("alice got %q instead of waiting", response)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	readUntil(t, conn, constants.SERVER_SHUTDOWN)
+	if err = <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("listener is served until %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener is served after the shutdown")
+	}
+}
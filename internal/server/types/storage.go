@@ -0,0 +1,24 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Writes the data to a temporary file, which then replaces the target, so a
+// crash never leaves it half-written
+func writeFileAtomically(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"strings"
+	"sync"
 )
 
 func GetInput(prompt string, reader *bufio.Reader) (string, error) {
@@ -14,3 +15,79 @@ func GetInput(prompt string, reader *bufio.Reader) (string, error) {
 	}
 	return strings.Trim(input, "\n"), nil
 }
+
+// Lines are the lines of the input, read in the background, so waiting for
+// them can be combined with other events
+type Lines struct {
+	// Receives every line, and is closed once the reading is over
+	C    <-chan string
+	err  error
+	done chan struct{}
+	stop chan struct{}
+	once sync.Once
+	// Interrupts the pending read, and reports whether it's possible at all
+	interrupt func() bool
+}
+
+// Err returns the error, which has ended the reading, once C is closed
+func (l *Lines) Err() error {
+	<-l.done
+	return l.err
+}
+
+// Stop ends the reading. The pending read of the input is interrupted, where
+// the platform allows it, so the input is free for other readers afterwards.
+func (l *Lines) Stop() {
+	l.once.Do(func() {
+		close(l.stop)
+		if l.interrupt() {
+			<-l.done
+		}
+	})
+}
+
+// The release is called, once the reading is over, with the line, which
+// was read, but not delivered
+func newLines(read func() (string, error), interrupt func() bool, release func(unread string)) *Lines {
+	c := make(chan string)
+	l := &Lines{C: c, done: make(chan struct{}), stop: make(chan struct{}), interrupt: interrupt}
+	go func() {
+		defer close(l.done)
+		var unread string
+		defer func() { release(unread) }()
+		defer close(c)
+		for {
+			input, err := read()
+			if err != nil {
+				select {
+				case <-l.stop:
+				default:
+					l.err = err
+				}
+				return
+			}
+			select {
+			case c <- input:
+			case <-l.stop:
+				unread = input
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Reads the lines of the buffered reader, which can't be interrupted
+func readBuffered(reader *bufio.Reader) func() (string, error) {
+	return func() (string, error) {
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return strings.Trim(input, "\n"), nil
+	}
+}
+
+func cannotInterrupt() bool {
+	return false
+}
@@ -0,0 +1,71 @@
+package communication
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts of the connection operations. Zero values disable the corresponding deadline.
+type Timeouts struct {
+	// Applied to the reads until the chat is established
+	Handshake time.Duration
+	// Applied to the reads of the established chat
+	Idle time.Duration
+	// Applied to every write
+	Write time.Duration
+}
+
+// TimedConn sets a fresh deadline before every read and write, so a stalled
+// peer can't hold the connection forever
+type TimedConn struct {
+	net.Conn
+	readTimeout  atomic.Int64
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+}
+
+// NewTimedConn wraps the connection, applying the handshake timeout to the reads
+func NewTimedConn(conn net.Conn, timeouts Timeouts) *TimedConn {
+	c := &TimedConn{Conn: conn, writeTimeout: timeouts.Write, idleTimeout: timeouts.Idle}
+	c.readTimeout.Store(int64(timeouts.Handshake))
+	return c
+}
+
+// Established switches the reads from the handshake timeout to the idle one
+func (c *TimedConn) Established() {
+	c.SetReadTimeout(c.idleTimeout)
+}
+
+func (c *TimedConn) SetReadTimeout(timeout time.Duration) {
+	c.readTimeout.Store(int64(timeout))
+}
+
+func (c *TimedConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(deadline(time.Duration(c.readTimeout.Load()))); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *TimedConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(deadline(c.writeTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// The zero time clears the deadline
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// IsTimeout reports whether the error is caused by an exceeded deadline
+func IsTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
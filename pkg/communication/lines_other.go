@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || netbsd || openbsd)
+
+package communication
+
+import (
+	"bufio"
+	"os"
+)
+
+// ReadLines reads the lines of the file in the background. The pending read
+// can't be interrupted on this platform, so it takes the next line, once the
+// reading is stopped.
+func ReadLines(file *os.File) *Lines {
+	return newLines(readBuffered(bufio.NewReader(file)), cannotInterrupt, func(string) {})
+}
@@ -0,0 +1,130 @@
+//go:build linux || darwin || dragonfly || netbsd || openbsd
+
+package communication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Size of a single read of the lines
+const LINES_CHUNK_SIZE = 4096
+
+// Bits in a word of the descriptor set
+const fdSetWordBits = int(unsafe.Sizeof(syscall.FdSet{}.Bits[0])) * 8
+
+var errLinesInterrupted = errors.New("reading of the lines is interrupted")
+
+var (
+	unreadMut sync.Mutex
+	// The input of the files, which was read, but not taken as lines yet.
+	// It's given to the next reader of the same file.
+	unreadInput = map[uintptr][]byte{}
+)
+
+// ReadLines reads the lines of the file in the background. The file is read
+// only once select reports it's readable, so the wait can be interrupted,
+// while the mode of the file is left as it is. The input, which is read, but
+// not taken, is kept for the next reading of the file.
+func ReadLines(file *os.File) *Lines {
+	fd := file.Fd()
+	var wake [2]int
+	if err := syscall.Pipe(wake[:]); err != nil {
+		return newLines(readBuffered(bufio.NewReader(file)), cannotInterrupt, func(string) {})
+	}
+	if !fitsFdSet(int(fd)) || !fitsFdSet(wake[0]) {
+		syscall.Close(wake[0])
+		syscall.Close(wake[1])
+		return newLines(readBuffered(bufio.NewReader(file)), cannotInterrupt, func(string) {})
+	}
+
+	unreadMut.Lock()
+	reader := &fileLines{file: file, fd: int(fd), wake: wake[0], buffer: unreadInput[fd]}
+	delete(unreadInput, fd)
+	unreadMut.Unlock()
+
+	interrupt := func() bool {
+		_, err := syscall.Write(wake[1], []byte{0})
+		return err == nil
+	}
+	release := func(unread string) {
+		syscall.Close(wake[0])
+		syscall.Close(wake[1])
+		if unread != "" {
+			reader.buffer = append([]byte(unread+"\n"), reader.buffer...)
+		}
+		if len(reader.buffer) > 0 {
+			unreadMut.Lock()
+			unreadInput[fd] = reader.buffer
+			unreadMut.Unlock()
+		}
+	}
+	return newLines(reader.readLine, interrupt, release)
+}
+
+// The lines of the file, which is read only once it's readable
+type fileLines struct {
+	file *os.File
+	fd   int
+	// Becomes readable, once the reading is interrupted
+	wake   int
+	buffer []byte
+}
+
+func (f *fileLines) readLine() (string, error) {
+	for {
+		if i := bytes.IndexByte(f.buffer, '\n'); i >= 0 {
+			line := string(f.buffer[:i])
+			f.buffer = f.buffer[i+1:]
+			return line, nil
+		}
+		if err := f.waitReadable(); err != nil {
+			return "", err
+		}
+		chunk := make([]byte, LINES_CHUNK_SIZE)
+		n, err := f.file.Read(chunk)
+		f.buffer = append(f.buffer, chunk[:n]...)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Waits until the file is readable, or the reading is interrupted
+func (f *fileLines) waitReadable() error {
+	for {
+		var set syscall.FdSet
+		addFd(&set, f.fd)
+		addFd(&set, f.wake)
+		err := selectRead(max(f.fd, f.wake)+1, &set)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if hasFd(&set, f.wake) {
+			return errLinesInterrupted
+		}
+		if hasFd(&set, f.fd) {
+			return nil
+		}
+	}
+}
+
+func fitsFdSet(fd int) bool {
+	return fd < len(syscall.FdSet{}.Bits)*fdSetWordBits
+}
+
+func addFd(set *syscall.FdSet, fd int) {
+	set.Bits[fd/fdSetWordBits] |= 1 << (fd % fdSetWordBits)
+}
+
+func hasFd(set *syscall.FdSet, fd int) bool {
+	return set.Bits[fd/fdSetWordBits]&(1<<(fd%fdSetWordBits)) != 0
+}
@@ -0,0 +1,89 @@
+//go:build linux || darwin || dragonfly || netbsd || openbsd
+
+package communication
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func receiveLine(t *testing.T, lines *Lines) string {
+	t.Helper()
+	select {
+	case line, ok := <-lines.C:
+		if !ok {
+			t.Fatalf("lines are over: %v", lines.Err())
+		}
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("no line is read")
+		return ""
+	}
+}
+
+// The stopped reading keeps the input, which isn't taken yet, for the next one
+func TestReadLinesKeepsInput(t *testing.T) {
+	input, typed, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	defer typed.Close()
+	if _, err = typed.WriteString("first\nsecond\nthi"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := ReadLines(input)
+	if line := receiveLine(t, lines); line != "first" {
+		t.Fatalf("got %q instead of the first line", line)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		lines.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("reading isn't stopped")
+	}
+
+	lines = ReadLines(input)
+	defer lines.Stop()
+	if _, err = typed.WriteString("rd\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"second", "third"} {
+		if line := receiveLine(t, lines); line != expected {
+			t.Fatalf("got %q instead of %q", line, expected)
+		}
+	}
+}
+
+// The pending wait for the input is interrupted, so nothing is taken after the stop
+func TestReadLinesStopWithoutInput(t *testing.T) {
+	input, typed, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	defer typed.Close()
+
+	lines := ReadLines(input)
+	lines.Stop()
+	if _, ok := <-lines.C; ok {
+		t.Fatal("line is read after the stop")
+	}
+	if err = lines.Err(); err != nil {
+		t.Fatalf("stopped reading has failed: %v", err)
+	}
+	if _, err = typed.WriteString("later\n"); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 16)
+	n, err := input.Read(buffer)
+	if err != nil || string(buffer[:n]) != "later\n" {
+		t.Fatalf("got %q, %v instead of the input", buffer[:n], err)
+	}
+}
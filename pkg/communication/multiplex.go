@@ -0,0 +1,476 @@
+package communication
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every frame of the multiplexed connection starts with its type, the stream
+// ID and the size of the payload. The window update carries the increment in
+// the size field instead.
+const (
+	FRAME_HEADER_SIZE = 9
+	// Large writes are split into the frames, so the streams take turns on the connection
+	MAX_FRAME_SIZE = 16 * 1024
+	// How much data may be sent to the stream, before the reader consumes it
+	STREAM_WINDOW = 256 * 1024
+	// Streams opened by the peer, which aren't accepted yet
+	ACCEPT_BACKLOG = 64
+)
+
+// Types of the frames
+const (
+	FRAME_DATA byte = iota
+	FRAME_OPEN
+	FRAME_CLOSE
+	FRAME_WINDOW_UPDATE
+)
+
+var (
+	ErrMultiplexerClosed = errors.New("multiplexed connection is closed")
+	ErrStreamClosed      = errors.New("stream is closed")
+	ErrProtocolViolation = errors.New("peer violated the multiplexing protocol")
+)
+
+// Multiplexer carries many independent streams over one connection. Every
+// stream has its own flow control, so a large transfer on one stream doesn't
+// hold the others back.
+type Multiplexer struct {
+	conn    net.Conn
+	streams map[uint32]*Stream
+	// The dialing side opens the odd streams, the accepting side the even ones
+	nextID   uint32
+	parity   uint32
+	accepted chan *Stream
+	// Streams, which nobody accepts, so the peer is told to close them. The
+	// reader queues them, so it never waits for the connection to be writable.
+	refused chan uint32
+	// Closed as soon as the connection is over, err tells why
+	done     chan struct{}
+	err      error
+	mut      sync.Mutex
+	writeMut sync.Mutex
+}
+
+// NewMultiplexer starts reading the frames of the connection. Both sides of
+// the connection must agree on which of them is the dialing one.
+func NewMultiplexer(conn net.Conn, dialing bool) *Multiplexer {
+	m := &Multiplexer{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		nextID:   2,
+		accepted: make(chan *Stream, ACCEPT_BACKLOG),
+		refused:  make(chan uint32, ACCEPT_BACKLOG),
+		done:     make(chan struct{}),
+	}
+	if dialing {
+		m.nextID = 1
+	}
+	m.parity = m.nextID % 2
+	go m.readFrames()
+	go m.writeRefusals()
+	return m
+}
+
+// Open opens a new stream, which the peer receives via Accept
+func (m *Multiplexer) Open() (*Stream, error) {
+	m.mut.Lock()
+	if m.err != nil {
+		m.mut.Unlock()
+		return nil, m.err
+	}
+	stream := newStream(m, m.nextID)
+	m.streams[stream.id] = stream
+	m.nextID += 2
+	m.mut.Unlock()
+	if err := m.writeFrame(FRAME_OPEN, stream.id, 0, nil); err != nil {
+		m.forget(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the stream opened by the peer
+func (m *Multiplexer) Accept() (*Stream, error) {
+	select {
+	case stream := <-m.accepted:
+		return stream, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// Close closes the connection with all its streams
+func (m *Multiplexer) Close() error {
+	m.fail(ErrMultiplexerClosed)
+	return nil
+}
+
+// Done is closed as soon as the connection is over
+func (m *Multiplexer) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *Multiplexer) Err() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.err
+}
+
+// The header and the payload are written at once, so the frames of the
+// concurrent streams can't interleave
+func (m *Multiplexer) writeFrame(frameType byte, id uint32, size uint32, payload []byte) error {
+	frame := make([]byte, FRAME_HEADER_SIZE+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], size)
+	copy(frame[FRAME_HEADER_SIZE:], payload)
+	m.writeMut.Lock()
+	defer m.writeMut.Unlock()
+	select {
+	case <-m.done:
+		return m.Err()
+	default:
+	}
+	if _, err := m.conn.Write(frame); err != nil {
+		m.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Tells the peer to close the refused streams, until the connection is over
+func (m *Multiplexer) writeRefusals() {
+	for {
+		select {
+		case id := <-m.refused:
+			if err := m.writeFrame(FRAME_CLOSE, id, 0, nil); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Multiplexer) readFrames() {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			m.fail(err)
+			return
+		}
+		frameType, id, size := header[0], binary.BigEndian.Uint32(header[1:]), binary.BigEndian.Uint32(header[5:])
+		var payload []byte
+		if frameType == FRAME_DATA {
+			if size > MAX_FRAME_SIZE {
+				m.fail(ErrProtocolViolation)
+				return
+			}
+			payload = make([]byte, size)
+			if _, err := io.ReadFull(m.conn, payload); err != nil {
+				m.fail(err)
+				return
+			}
+		}
+		if err := m.handleFrame(frameType, id, size, payload); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Multiplexer) handleFrame(frameType byte, id uint32, size uint32, payload []byte) error {
+	m.mut.Lock()
+	stream, ok := m.streams[id]
+	m.mut.Unlock()
+	switch frameType {
+	case FRAME_OPEN:
+		// The peer must open the streams of its own parity only
+		if ok || id%2 == m.parity {
+			return ErrProtocolViolation
+		}
+		stream = newStream(m, id)
+		m.mut.Lock()
+		m.streams[id] = stream
+		m.mut.Unlock()
+		select {
+		case m.accepted <- stream:
+		default:
+			// Nobody accepts the streams, so the peer is told to back off
+			m.forget(id)
+			select {
+			case m.refused <- id:
+			default:
+				// The peer keeps opening the streams, while it doesn't read the refusals
+				return ErrProtocolViolation
+			}
+		}
+	case FRAME_DATA:
+		// The data may still arrive to the stream, which is closed locally
+		if ok {
+			return stream.receive(payload)
+		}
+	case FRAME_WINDOW_UPDATE:
+		if ok {
+			return stream.grow(size)
+		}
+	case FRAME_CLOSE:
+		// No frame of the stream follows the close, so it's forgotten, while
+		// the locally closed one is forgotten already
+		if ok {
+			m.forget(id)
+			stream.closeRemotely()
+		}
+	default:
+		return ErrProtocolViolation
+	}
+	return nil
+}
+
+func (m *Multiplexer) forget(id uint32) {
+	m.mut.Lock()
+	delete(m.streams, id)
+	m.mut.Unlock()
+}
+
+// Ends the connection with the error, every stream fails with it
+func (m *Multiplexer) fail(err error) {
+	m.mut.Lock()
+	if m.err != nil {
+		m.mut.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.done)
+	m.mut.Unlock()
+	m.conn.Close()
+	for _, stream := range streams {
+		stream.closeRemotely()
+	}
+}
+
+// Stream is one of the streams of the multiplexed connection. It's a net.Conn
+// itself, so the messages are sent over it as usual.
+type Stream struct {
+	id  uint32
+	mux *Multiplexer
+	// Data received, but not read yet
+	buffer []byte
+	// Data read since the last window update
+	consumed   uint32
+	sendWindow uint32
+	// The peer won't send any more data
+	remoteClosed  bool
+	localClosed   bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// Signalled whenever the stream changes, so the blocked reads and writes re-check it
+	readable chan struct{}
+	writable chan struct{}
+	mut      sync.Mutex
+	// Held for the whole write, so the frames of the concurrent writes don't
+	// interleave within the stream
+	writeMut sync.Mutex
+}
+
+func newStream(mux *Multiplexer, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		mux:        mux,
+		sendWindow: STREAM_WINDOW,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func signal(changed chan struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) notify() {
+	signal(s.readable)
+	signal(s.writable)
+}
+
+func (s *Stream) receive(payload []byte) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	// The peer mustn't send more than the window allows
+	if len(s.buffer)+len(payload) > STREAM_WINDOW {
+		return ErrProtocolViolation
+	}
+	s.buffer = append(s.buffer, payload...)
+	signal(s.readable)
+	return nil
+}
+
+func (s *Stream) grow(increment uint32) error {
+	s.mut.Lock()
+	// The peer mustn't reopen more of the window than was sent
+	if increment > STREAM_WINDOW-s.sendWindow {
+		s.mut.Unlock()
+		return ErrProtocolViolation
+	}
+	s.sendWindow += increment
+	s.mut.Unlock()
+	signal(s.writable)
+	return nil
+}
+
+func (s *Stream) closeRemotely() {
+	s.mut.Lock()
+	s.remoteClosed = true
+	s.mut.Unlock()
+	s.notify()
+}
+
+// Waits for the stream to change until the deadline
+func wait(changed chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Read returns the received data, or io.EOF once the peer has closed the stream
+func (s *Stream) Read(b []byte) (int, error) {
+	s.mut.Lock()
+	for len(s.buffer) == 0 {
+		if s.localClosed {
+			s.mut.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if s.remoteClosed {
+			s.mut.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mut.Unlock()
+		if err := wait(s.readable, deadline); err != nil {
+			return 0, err
+		}
+		s.mut.Lock()
+	}
+	n := copy(b, s.buffer)
+	s.buffer = s.buffer[n:]
+	s.consumed += uint32(n)
+	// The window is reopened in batches, so the updates don't flood the connection
+	var increment uint32
+	if s.consumed >= STREAM_WINDOW/2 && !s.remoteClosed {
+		increment, s.consumed = s.consumed, 0
+	}
+	s.mut.Unlock()
+	if increment > 0 {
+		if err := s.mux.writeFrame(FRAME_WINDOW_UPDATE, s.id, increment, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write sends the data in the frames, as fast as the peer's window allows
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	written := 0
+	for written < len(b) {
+		s.mut.Lock()
+		for s.sendWindow == 0 && !s.localClosed && !s.remoteClosed {
+			deadline := s.writeDeadline
+			s.mut.Unlock()
+			if err := wait(s.writable, deadline); err != nil {
+				return written, err
+			}
+			s.mut.Lock()
+		}
+		if s.localClosed || s.remoteClosed {
+			s.mut.Unlock()
+			if err := s.mux.Err(); err != nil {
+				return written, err
+			}
+			return written, ErrStreamClosed
+		}
+		size := min(len(b)-written, int(s.sendWindow), MAX_FRAME_SIZE)
+		s.sendWindow -= uint32(size)
+		s.mut.Unlock()
+		if err := s.mux.writeFrame(FRAME_DATA, s.id, uint32(size), b[written:written+size]); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// Close tells the peer the stream is over. The data sent before is still
+// delivered, the data received afterwards is dropped.
+func (s *Stream) Close() error {
+	s.mut.Lock()
+	if s.localClosed {
+		s.mut.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.mut.Unlock()
+	s.notify()
+	s.mux.forget(s.id)
+	err := s.mux.writeFrame(FRAME_CLOSE, s.id, 0, nil)
+	if errors.Is(err, ErrMultiplexerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mut.Lock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.mut.Unlock()
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mut.Lock()
+	s.readDeadline = t
+	s.mut.Unlock()
+	signal(s.readable)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mut.Lock()
+	s.writeDeadline = t
+	s.mut.Unlock()
+	signal(s.writable)
+	return nil
+}
@@ -0,0 +1,296 @@
+package communication
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connects two multiplexers over the pipe, the first one is the dialing side
+func multiplexers(t *testing.T) (*Multiplexer, *Multiplexer) {
+	t.Helper()
+	dialer, acceptor := net.Pipe()
+	dialing, accepting := NewMultiplexer(dialer, true), NewMultiplexer(acceptor, false)
+	t.Cleanup(func() {
+		dialing.Close()
+		accepting.Close()
+	})
+	return dialing, accepting
+}
+
+// Opens the stream on the first multiplexer, and accepts it on the second one
+func openStream(t *testing.T, opening *Multiplexer, accepting *Multiplexer) (*Stream, *Stream) {
+	t.Helper()
+	opened, err := opening.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := accepting.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.ID() != accepted.ID() {
+		t.Fatalf("stream %d is accepted as %d", opened.ID(), accepted.ID())
+	}
+	return opened, accepted
+}
+
+func readMessage(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	message, err := ReadMessage(conn, make([]byte, 4*MAX_FRAME_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestStreamsCarryMessages(t *testing.T) {
+	dialing, accepting := multiplexers(t)
+	// Both sides open the streams, the IDs of the sides never collide
+	first, firstAccepted := openStream(t, dialing, accepting)
+	second, secondAccepted := openStream(t, accepting, dialing)
+	if first.ID()%2 != 1 || second.ID()%2 != 0 {
+		t.Fatalf("streams %d and %d have the wrong parity", first.ID(), second.ID())
+	}
+	for _, streams := range [][2]*Stream{{first, firstAccepted}, {secondAccepted, second}, {second, secondAccepted}} {
+		go SendMessage(streams[0], "hello")
+		if message := readMessage(t, streams[1]); message != "hello" {
+			t.Fatalf("got %q", message)
+		}
+	}
+}
+
+// The messages written at once are delivered whole, even though they are
+// split into many frames
+func TestConcurrentWritesDontInterleave(t *testing.T) {
+	dialing, accepting := multiplexers(t)
+	stream, accepted := openStream(t, dialing, accepting)
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			message := strings.Repeat(string(rune('a'+i)), 3*MAX_FRAME_SIZE+1)
+			if err := SendMessage(stream, message); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for range writers {
+		message := readMessage(t, accepted)
+		if len(message) != 3*MAX_FRAME_SIZE+1 || strings.Trim(message, message[:1]) != "" {
+			t.Fatalf("message of %d bytes is mixed with the others", len(message))
+		}
+	}
+	wg.Wait()
+}
+
+// The stream, whose reader is stalled, doesn't hold back the others
+func TestStalledStreamDoesntBlockOthers(t *testing.T) {
+	dialing, accepting := multiplexers(t)
+	stalled, _ := openStream(t, dialing, accepting)
+	stream, accepted := openStream(t, dialing, accepting)
+	filled := make(chan error, 1)
+	go func() {
+		_, err := stalled.Write(make([]byte, 2*STREAM_WINDOW))
+		filled <- err
+	}()
+	go SendMessage(stream, "still here")
+	if message := readMessage(t, accepted); message != "still here" {
+		t.Fatalf("got %q", message)
+	}
+	// The writer of the stalled stream waits for the window
+	_ = stalled.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := <-filled; !isDeadline(err) {
+		t.Fatalf("stalled write ended with %v", err)
+	}
+}
+
+func isDeadline(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// The window is reopened as the reader consumes the data
+func TestWindowIsReopened(t *testing.T) {
+	dialing, accepting := multiplexers(t)
+	stream, accepted := openStream(t, dialing, accepting)
+	data := bytes.Repeat([]byte("x"), 3*STREAM_WINDOW)
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data)
+		written <- err
+	}()
+	_ = accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(accepted, received); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data is corrupted")
+	}
+}
+
+func TestCloseEndsStreams(t *testing.T) {
+	dialing, accepting := multiplexers(t)
+	stream, accepted := openStream(t, dialing, accepting)
+	go SendMessage(stream, "bye")
+	if message := readMessage(t, accepted); message != "bye" {
+		t.Fatalf("got %q", message)
+	}
+	// The closed stream still delivers what was sent before, then the peer reads EOF
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read of the closed stream ended with %v", err)
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("write to the closed stream ended with %v", err)
+	}
+
+	other, otherAccepted := openStream(t, dialing, accepting)
+	dialing.Close()
+	if _, err := otherAccepted.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read of the closed connection ended with %v", err)
+	}
+	if _, err := accepting.Accept(); err == nil {
+		t.Fatal("stream is accepted on the closed connection")
+	}
+	if _, err := other.Write([]byte("x")); !errors.Is(err, ErrMultiplexerClosed) {
+		t.Fatalf("write to the closed connection ended with %v", err)
+	}
+}
+
+// The peer, which opens the streams of the other side, breaks the connection
+func TestProtocolViolation(t *testing.T) {
+	dialer, acceptor := net.Pipe()
+	accepting := NewMultiplexer(acceptor, false)
+	defer accepting.Close()
+	defer dialer.Close()
+	// The dialing side must open the odd streams only
+	frame := make([]byte, FRAME_HEADER_SIZE)
+	frame[0], frame[4] = FRAME_OPEN, 2
+	go dialer.Write(frame)
+	select {
+	case <-accepting.Done():
+		if !errors.Is(accepting.Err(), ErrProtocolViolation) {
+			t.Fatalf("connection failed with %v", accepting.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("violation is tolerated")
+	}
+}
+
+func rawFrame(frameType byte, id uint32, size uint32, payload []byte) []byte {
+	frame := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], size)
+	return append(frame, payload...)
+}
+
+// The window update mustn't open the window wider than it was
+func TestWindowOverflow(t *testing.T) {
+	dialer, acceptor := net.Pipe()
+	accepting := NewMultiplexer(acceptor, false)
+	defer accepting.Close()
+	defer dialer.Close()
+	go func() {
+		_, _ = dialer.Write(rawFrame(FRAME_OPEN, 1, 0, nil))
+		_, _ = dialer.Write(rawFrame(FRAME_WINDOW_UPDATE, 1, math.MaxUint32, nil))
+	}()
+	stream, err := accepting.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepting.Done():
+		if !errors.Is(accepting.Err(), ErrProtocolViolation) {
+			t.Fatalf("connection failed with %v", accepting.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("overflow is tolerated")
+	}
+	if stream.sendWindow != STREAM_WINDOW {
+		t.Fatalf("window is %d", stream.sendWindow)
+	}
+}
+
+// The streams over the backlog are refused without waiting for the peer to
+// read the refusals, so the frames of the other streams still arrive
+func TestRefusalDoesntBlockReader(t *testing.T) {
+	dialer, acceptor := net.Pipe()
+	accepting := NewMultiplexer(acceptor, false)
+	defer accepting.Close()
+	defer dialer.Close()
+	written := make(chan error, 1)
+	go func() {
+		// The backlog and the accepted stream leave one of them over
+		for id := uint32(1); id <= 2*ACCEPT_BACKLOG+3; id += 2 {
+			if _, err := dialer.Write(rawFrame(FRAME_OPEN, id, 0, nil)); err != nil {
+				written <- err
+				return
+			}
+		}
+		_, err := dialer.Write(rawFrame(FRAME_DATA, 1, 2, []byte("hi")))
+		written <- err
+	}()
+	stream, err := accepting.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 2)
+	if _, err = io.ReadFull(stream, received); err != nil || string(received) != "hi" {
+		t.Fatalf("got %q, %v", received, err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_ = dialer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(dialer, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != FRAME_CLOSE || binary.BigEndian.Uint32(header[1:]) == 1 {
+		t.Fatalf("got the frame %v instead of the refusal", header)
+	}
+}
+
+// The stream, which is closed on both sides, isn't kept by either multiplexer
+func TestClosedStreamsAreForgotten(t *testing.T) {
+	dialing, accepting := multiplexers(t)
+	stream, accepted := openStream(t, dialing, accepting)
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read of the closed stream ended with %v", err)
+	}
+	for _, m := range []*Multiplexer{dialing, accepting} {
+		m.mut.Lock()
+		streams := len(m.streams)
+		m.mut.Unlock()
+		if streams != 0 {
+			t.Fatalf("%d streams are still kept", streams)
+		}
+	}
+	// The late close of the peer's side is harmless
+	if err := accepted.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,24 +1,53 @@
 package communication
 
 import (
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"strings"
 
 	"github.com/dikuropiatnyk/dh-chat/pkg/crypt"
 )
 
+// Every message is prefixed with its size, so the messages written one after
+// another can't be merged or split by the stream
+const HEADER_SIZE = 4
+
+var ErrMessageTooLarge = errors.New("message exceeds the buffer size")
+
 func ReadMessage(conn net.Conn, buffer []byte) (string, error) {
-	n, err := conn.Read(buffer)
-	if err != nil {
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header)
+	// The stream can't be recovered after this point, the caller must close it
+	if uint64(size) > uint64(len(buffer)) {
+		return "", ErrMessageTooLarge
+	}
+	if _, err := io.ReadFull(conn, buffer[:size]); err != nil {
 		return "", err
 	}
-	return string(buffer[:n]), nil
+	return string(buffer[:size]), nil
 }
 
 func SendMessage(conn net.Conn, message string) error {
-	_, err := conn.Write([]byte(message))
+	// The header and the message are written at once, so concurrent writers
+	// can't interleave them
+	frame := make([]byte, HEADER_SIZE+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[HEADER_SIZE:], message)
+	_, err := conn.Write(frame)
 	return err
 }
 
+// ParseSignal splits the message in the format "signal:payload"
+func ParseSignal(message string, separator string) (string, string) {
+	signal, payload, _ := strings.Cut(message, separator)
+	return signal, payload
+}
+
 func ReadEncryptedMessage(conn net.Conn, buffer []byte, key []byte) (string, error) {
 	encryptedMessage, err := ReadMessage(conn, buffer)
 	if err != nil {
@@ -0,0 +1,10 @@
+//go:build darwin || dragonfly || netbsd || openbsd
+
+package communication
+
+import "syscall"
+
+// Waits without a timeout, until one of the descriptors of the set is readable
+func selectRead(nfd int, set *syscall.FdSet) error {
+	return syscall.Select(nfd, set, nil, nil, nil)
+}
@@ -0,0 +1,9 @@
+package communication
+
+import "syscall"
+
+// Waits without a timeout, until one of the descriptors of the set is readable
+func selectRead(nfd int, set *syscall.FdSet) error {
+	_, err := syscall.Select(nfd, set, nil, nil, nil)
+	return err
+}
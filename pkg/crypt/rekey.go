@@ -0,0 +1,47 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Context of the key, which authenticates the rekey, so it differs from the
+// key of the messages
+var rekeyInfo = []byte("dh-chat rekey")
+
+// DeriveNextKey derives the key of the rekeyed chat. The previous key salts
+// the derivation, so only the parties of the previous key get the next one,
+// whatever the exchange.
+func DeriveNextKey(key *big.Int, previousKey []byte) ([]byte, error) {
+	hkdf := hkdf.New(sha256.New, key.Bytes(), previousKey, nil)
+	derivedKey := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(hkdf, derivedKey); err != nil {
+		return nil, err
+	}
+	return derivedKey, nil
+}
+
+// SignRekey authenticates the public parameters of the rekey with the key of the chat
+func SignRekey(message string, key []byte) (string, error) {
+	macKey := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, rekeyInfo), macKey); err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyRekey reports whether the parameters are signed with the key of the chat
+func VerifyRekey(message string, signature string, key []byte) bool {
+	expected, err := SignRekey(message, key)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
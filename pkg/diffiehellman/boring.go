@@ -2,7 +2,9 @@ package diffiehellman
 
 import (
 	"crypto/rand"
+	"errors"
 	"math/big"
+	"sync"
 )
 
 const (
@@ -11,22 +13,54 @@ const (
 	KEY_SIZE  = 256
 )
 
+// The 2048-bit MODP group of RFC 3526. Its modulus is the safe prime p=2q+1,
+// so 2 generates the subgroup of the prime order q. The safe primes of such a
+// size take minutes to find, so the well-known one is used instead.
+const MODP_2048_PRIME = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var (
+	ErrWeakPrime        = errors.New("base number isn't a safe prime of enough bits")
+	ErrInvalidGenerator = errors.New("generator is out of range")
+)
+
+// Safe primes, which are validated already, since the test takes a while
+var safePrimes sync.Map
+
 func GenerateBaseSecrets() (*big.Int, *big.Int, error) {
-	// Generate a base prime number (q), which will be used to get a modulus
-	// The number will be approixmately 600+ digits long
-	q, err := rand.Prime(rand.Reader, BIT_SIZE)
-	if err != nil {
-		return &big.Int{}, &big.Int{}, err
-	}
-	// Create a "strong" prime number, which is a prime number of the form 2q+1 - this will be the modulus
-	p := new(big.Int).Add(new(big.Int).Mul(big.NewInt(2), q), big.NewInt(1))
-	// With such approach, p will be guaranteed to be a huge prime number,
-	// g (generator) can be 2, because such p values will always
-	// have primitive root modulo of {1, 2, q, 2q}
-	// More details - https://crypto.stackexchange.com/a/829
+	p, _ := new(big.Int).SetString(MODP_2048_PRIME, 16)
 	return p, big.NewInt(GENERATOR), nil
 }
 
+// Makes sure the base secrets, which came from the other side, are safe to use:
+// p must be the safe prime of BIT_SIZE bits at least, and g must be in [2, p-2],
+// so the salts can't be confined to the small subgroup.
+func ValidateBaseSecrets(p *big.Int, g *big.Int) error {
+	if _, validated := safePrimes.Load(p.String()); !validated {
+		if p.BitLen() < BIT_SIZE || !p.ProbablyPrime(20) {
+			return ErrWeakPrime
+		}
+		q := new(big.Int).Rsh(p, 1)
+		if !q.ProbablyPrime(20) {
+			return ErrWeakPrime
+		}
+		safePrimes.Store(p.String(), struct{}{})
+	}
+	if g.Cmp(big.NewInt(2)) < 0 || g.Cmp(new(big.Int).Sub(p, big.NewInt(2))) > 0 {
+		return ErrInvalidGenerator
+	}
+	return nil
+}
+
 func GeneratePrivateSalt(p *big.Int) (*big.Int, error) {
 	shift := big.NewInt(1)
 	// Generate a private secret, which is a random number between 1 and p-1
@@ -0,0 +1,165 @@
+// Package discovery announces the clients on the local network and finds the
+// announced ones. As mDNS does, the announcements are sent to a multicast
+// group, so every member of the group on the network receives them.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidGroup = errors.New("discovery group must be a multicast address")
+
+const (
+	// Administratively scoped group, which doesn't leave the local network
+	DEFAULT_GROUP     = "239.255.42.99:7788"
+	ANNOUNCE_INTERVAL = 2 * time.Second
+	// The announcement fits a single datagram of any network
+	MAX_ANNOUNCEMENT_SIZE = 1024
+	// Marks the announcements of the chat among the other traffic of the group
+	SERVICE = "dh-chat"
+)
+
+// Peer is the client announced on the network
+type Peer struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	// Address of the direct chat with the peer, empty if it chats via the server
+	Address string `json:"address,omitempty"`
+}
+
+type announcement struct {
+	Service string `json:"service"`
+	Peer
+}
+
+func resolveGroup(group string) (*net.UDPAddr, error) {
+	address, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !address.IP.IsMulticast() {
+		return nil, ErrInvalidGroup
+	}
+	return address, nil
+}
+
+// Announce sends the peer to the group with the interval, until the context
+// is cancelled. The lost datagrams are made up by the next announcements.
+func Announce(ctx context.Context, group string, peer Peer, interval time.Duration) error {
+	address, err := resolveGroup(group)
+	if err != nil {
+		return err
+	}
+	message, err := json.Marshal(announcement{Service: SERVICE, Peer: peer})
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", nil, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// A single failed announcement, e.g. while the network is down, isn't fatal
+		_, _ = conn.Write(message)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Browse listens to the group for the duration and returns the announced
+// peers, sorted by their names. The host of the peer's address, which isn't
+// specified, is replaced with the host the announcement came from.
+func Browse(ctx context.Context, group string, duration time.Duration) ([]Peer, error) {
+	address, err := resolveGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(duration)
+	if contextDeadline, ok := ctx.Deadline(); ok && contextDeadline.Before(deadline) {
+		deadline = contextDeadline
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// The cancellation interrupts the pending read
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	// The peers are told apart by both the name and the identity
+	peers := make(map[Peer]bool)
+	buffer := make([]byte, MAX_ANNOUNCEMENT_SIZE)
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		var received announcement
+		if json.Unmarshal(buffer[:n], &received) != nil || received.Service != SERVICE || received.Name == "" {
+			continue
+		}
+		if received.Address != "" {
+			received.Address = reachable(received.Address, source.IP)
+		}
+		peers[received.Peer] = true
+	}
+
+	found := make([]Peer, 0, len(peers))
+	for peer := range peers {
+		found = append(found, peer)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Name != found[j].Name {
+			return found[i].Name < found[j].Name
+		}
+		return found[i].Address < found[j].Address
+	})
+	return found, nil
+}
+
+// Replaces the unspecified host of the address, e.g. ":9090" or
+// "ws://0.0.0.0:9090/ws", with the host the announcement came from
+func reachable(address string, source net.IP) string {
+	if !strings.Contains(address, "://") {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || !unspecified(host) {
+			return address
+		}
+		return net.JoinHostPort(source.String(), port)
+	}
+	target, err := url.Parse(address)
+	if err != nil || target.Host == "" || !unspecified(target.Hostname()) {
+		return address
+	}
+	target.Host = net.JoinHostPort(source.String(), target.Port())
+	return target.String()
+}
+
+func unspecified(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
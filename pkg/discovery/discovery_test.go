@@ -0,0 +1,46 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testGroup = "239.255.42.99:17788"
+
+// The peer is announced until its context is cancelled, so the listener,
+// which accepted its peer already, isn't offered to the others
+func TestAnnounceStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	announced := make(chan error, 1)
+	peer := Peer{Name: "alice", Fingerprint: "SHA256:alice", Address: "127.0.0.1:9000"}
+	go func() { announced <- Announce(ctx, testGroup, peer, 50*time.Millisecond) }()
+
+	peers, err := Browse(context.Background(), testGroup, 300*time.Millisecond)
+	if err != nil || len(peers) == 0 {
+		cancel()
+		t.Skip("multicast isn't available:", err)
+	}
+	if peers[0] != peer {
+		t.Fatalf("browsed %+v", peers[0])
+	}
+	cancel()
+	select {
+	case err := <-announced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("announcement goes on after the cancel")
+	}
+	if peers, _ = Browse(context.Background(), testGroup, 300*time.Millisecond); len(peers) != 0 {
+		t.Fatalf("peers are still announced: %+v", peers)
+	}
+}
+
+func TestInvalidGroup(t *testing.T) {
+	if err := Announce(context.Background(), "127.0.0.1:7788", Peer{}, time.Second); !errors.Is(err, ErrInvalidGroup) {
+		t.Fatalf("announce ended with %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var ErrInvalidKey = errors.New("invalid identity key")
+
+// Prefix of the signed challenges, so the signature can't be reused in another protocol
+const CHALLENGE_CONTEXT = "dh-chat-auth:"
+
+// Challenge is the message the client signs to prove it owns the name
+func Challenge(name string, nonce string) []byte {
+	return []byte(CHALLENGE_CONTEXT + name + ":" + nonce)
+}
+
+// NewNonce returns a random hex nonce for a single challenge
+func NewNonce() (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// Sign signs the challenge of the name with the private key
+func Sign(key ed25519.PrivateKey, name string, nonce string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, Challenge(name, nonce)))
+}
+
+// Verify checks the signature of the challenge, both are base64 encoded
+func Verify(publicKey ed25519.PublicKey, name string, nonce string, signature string) bool {
+	rawSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(publicKey, Challenge(name, nonce), rawSignature)
+}
+
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKey
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Fingerprint is the short hex digest of the public key, to be compared by humans
+func Fingerprint(key ed25519.PublicKey) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:8])
+}
+
+// Load reads the private key from the file, generating it on the first use.
+// Only the seed is stored, readable by the owner only.
+func Load(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return generate(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKey
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func generate(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, key.Seed(), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DefaultPath is the identity file in the user's config directory
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "dh-chat", "identity")
+}
@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Default buckets of the histograms, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Collector is any metric, which can be exposed in the Prometheus text format
+type Collector interface {
+	write(w io.Writer) error
+}
+
+// Registry keeps the collectors in the order of registration
+type Registry struct {
+	collectors []Collector
+	mut        sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(collector Collector) {
+	r.mut.Lock()
+	r.collectors = append(r.collectors, collector)
+	r.mut.Unlock()
+}
+
+// WriteText writes all the registered metrics in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	for _, collector := range r.collectors {
+		if err := collector.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler exposes the registry to the scrapers
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		_ = r.WriteText(w)
+	})
+}
+
+// Float value, which can be updated concurrently
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(delta float64) {
+	for {
+		old := f.bits.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if f.bits.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(value float64) {
+	f.bits.Store(math.Float64bits(value))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+type Counter struct {
+	name  string
+	help  string
+	value atomicFloat
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc()              { c.value.Add(1) }
+func (c *Counter) Add(delta float64) { c.value.Add(delta) }
+func (c *Counter) Value() float64    { return c.value.Load() }
+
+func (c *Counter) write(w io.Writer) error {
+	if err := writeHeader(w, c.name, c.help, "counter"); err != nil {
+		return err
+	}
+	return writeSample(w, c.name, "", c.value.Load())
+}
+
+type Gauge struct {
+	name  string
+	help  string
+	value atomicFloat
+}
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Inc()              { g.value.Add(1) }
+func (g *Gauge) Dec()              { g.value.Add(-1) }
+func (g *Gauge) Add(delta float64) { g.value.Add(delta) }
+func (g *Gauge) Set(value float64) { g.value.Set(value) }
+func (g *Gauge) Value() float64    { return g.value.Load() }
+
+func (g *Gauge) write(w io.Writer) error {
+	if err := writeHeader(w, g.name, g.help, "gauge"); err != nil {
+		return err
+	}
+	return writeSample(w, g.name, "", g.value.Load())
+}
+
+// CounterVec is a family of counters, partitioned by a single label
+type CounterVec struct {
+	name     string
+	help     string
+	label    string
+	counters map[string]*atomicFloat
+	mut      sync.RWMutex
+}
+
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	v := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*atomicFloat)}
+	r.register(v)
+	return v
+}
+
+func (v *CounterVec) Inc(labelValue string) {
+	v.mut.RLock()
+	counter, ok := v.counters[labelValue]
+	v.mut.RUnlock()
+	if !ok {
+		v.mut.Lock()
+		if counter, ok = v.counters[labelValue]; !ok {
+			counter = &atomicFloat{}
+			v.counters[labelValue] = counter
+		}
+		v.mut.Unlock()
+	}
+	counter.Add(1)
+}
+
+func (v *CounterVec) Value(labelValue string) float64 {
+	v.mut.RLock()
+	defer v.mut.RUnlock()
+	if counter, ok := v.counters[labelValue]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+func (v *CounterVec) write(w io.Writer) error {
+	if err := writeHeader(w, v.name, v.help, "counter"); err != nil {
+		return err
+	}
+	v.mut.RLock()
+	defer v.mut.RUnlock()
+	// Sorted label values keep the output stable between scrapes
+	labelValues := make([]string, 0, len(v.counters))
+	for labelValue := range v.counters {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		labels := formatLabel(v.label, labelValue)
+		if err := writeSample(w, v.name, labels, v.counters[labelValue].Load()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomicFloat
+}
+
+// NewHistogram registers a histogram with the sorted upper bounds of the buckets
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(value)
+}
+
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+
+func (h *Histogram) write(w io.Writer) error {
+	if err := writeHeader(w, h.name, h.help, "histogram"); err != nil {
+		return err
+	}
+	for i, bound := range h.buckets {
+		labels := formatLabel("le", strconv.FormatFloat(bound, 'g', -1, 64))
+		if err := writeSample(w, h.name+"_bucket", labels, float64(h.counts[i].Load())); err != nil {
+			return err
+		}
+	}
+	count := float64(h.count.Load())
+	if err := writeSample(w, h.name+"_bucket", formatLabel("le", "+Inf"), count); err != nil {
+		return err
+	}
+	if err := writeSample(w, h.name+"_sum", "", h.sum.Load()); err != nil {
+		return err
+	}
+	return writeSample(w, h.name+"_count", "", count)
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	return err
+}
+
+func writeSample(w io.Writer, name string, labels string, value float64) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(label string, value string) string {
+	return fmt.Sprintf(`{%s="%s"}`, label, labelEscaper.Replace(value))
+}
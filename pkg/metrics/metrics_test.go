@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	tests := []struct {
+		observed []float64
+		// Cumulative counts of the buckets 0.1, 1 and 10
+		counts []uint64
+		sum    float64
+	}{
+		{observed: nil, counts: []uint64{0, 0, 0}},
+		{observed: []float64{0.05}, counts: []uint64{1, 1, 1}, sum: 0.05},
+		// The bound belongs to its own bucket
+		{observed: []float64{0.1, 1, 10}, counts: []uint64{1, 2, 3}, sum: 11.1},
+		{observed: []float64{0.5, 2, 3}, counts: []uint64{0, 1, 3}, sum: 5.5},
+		// The values over the last bound are counted only by +Inf
+		{observed: []float64{100, 0.01}, counts: []uint64{1, 1, 1}, sum: 100.01},
+	}
+	for _, test := range tests {
+		histogram := NewRegistry().NewHistogram("test_seconds", "Test.", []float64{0.1, 1, 10})
+		for _, value := range test.observed {
+			histogram.Observe(value)
+		}
+		for i, count := range test.counts {
+			if got := histogram.counts[i].Load(); got != count {
+				t.Errorf("%v: bucket %v has %d instead of %d", test.observed, histogram.buckets[i], got, count)
+			}
+		}
+		if histogram.Count() != uint64(len(test.observed)) {
+			t.Errorf("%v: count is %d", test.observed, histogram.Count())
+		}
+		if sum := histogram.sum.Load(); sum < test.sum-1e-9 || sum > test.sum+1e-9 {
+			t.Errorf("%v: sum is %v instead of %v", test.observed, sum, test.sum)
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	tests := []struct {
+		value string
+		label string
+	}{
+		{value: "plain", label: `{type="plain"}`},
+		{value: `back\slash`, label: `{type="back\\slash"}`},
+		{value: `"quoted"`, label: `{type="\"quoted\""}`},
+		{value: "two\nlines", label: `{type="two\nlines"}`},
+		{value: `\"` + "\n", label: `{type="\\\"\n"}`},
+	}
+	for _, test := range tests {
+		if label := formatLabel("type", test.value); label != test.label {
+			t.Errorf("formatLabel(%q) = %s instead of %s", test.value, label, test.label)
+		}
+	}
+}
+
+func TestHandlerOutput(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewGauge("test_waiting", "Waiting clients.").Set(3)
+	counter := registry.NewCounter("test_relayed_total", "Relayed messages.")
+	counter.Add(2.5)
+	failures := registry.NewCounterVec("test_errors_total", "Errors by type.", "type")
+	failures.Inc("write")
+	failures.Inc("read")
+	failures.Inc("write")
+	histogram := registry.NewHistogram("test_seconds", "Durations.", []float64{0.5, 1})
+	histogram.Observe(0.25)
+	histogram.Observe(2)
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != CONTENT_TYPE {
+		t.Fatalf("content type is %q", contentType)
+	}
+	body, err := io.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The metrics are in the order of registration, and the labels are sorted
+	expected := strings.Join([]string{
+		"# HELP test_waiting Waiting clients.",
+		"# TYPE test_waiting gauge",
+		"test_waiting 3",
+		"# HELP test_relayed_total Relayed messages.",
+		"# TYPE test_relayed_total counter",
+		"test_relayed_total 2.5",
+		"# HELP test_errors_total Errors by type.",
+		"# TYPE test_errors_total counter",
+		`test_errors_total{type="read"} 1`,
+		`test_errors_total{type="write"} 2`,
+		"# HELP test_seconds Durations.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.5"} 1`,
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="+Inf"} 2`,
+		"test_seconds_sum 2.25",
+		"test_seconds_count 2",
+	}, "\n") + "\n"
+	if string(body) != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s", body, expected)
+	}
+}
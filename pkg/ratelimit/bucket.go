@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket, refilled with the given rate up to the burst size.
+// The time is passed explicitly, so the bucket doesn't depend on the clock.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mut    sync.Mutex
+}
+
+// NewBucket creates a full bucket. A non-positive rate disables the limit.
+func NewBucket(rate float64, burst int, now time.Time) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// Allow takes a token from the bucket, if there is any
+func (b *Bucket) Allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Full reports whether the bucket is refilled completely, so it can be dropped
+// without loosening the limit
+func (b *Bucket) Full(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+	b.last = now
+}
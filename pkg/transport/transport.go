@@ -0,0 +1,159 @@
+// Package transport chooses how the connections are made by the scheme of
+// the address, e.g. tcp://localhost:8080, unix:///run/dh.sock or mem://chat.
+// Every transport yields the framed message streams of the communication
+// package.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/dikuropiatnyk/dh-chat/pkg/communication"
+)
+
+var ErrUnknownScheme = errors.New("unknown transport scheme")
+
+// The address without a scheme is a TCP one, e.g. localhost:8080
+const DEFAULT_SCHEME = "tcp"
+
+// Conn carries the framed messages. It's a net.Conn still, so the deadlines
+// and the addresses work as usual.
+type Conn interface {
+	net.Conn
+	Send(message string) error
+	Receive(buffer []byte) (string, error)
+}
+
+// Listener accepts the framed connections, its Accept returns them as well
+type Listener interface {
+	net.Listener
+	AcceptConn() (Conn, error)
+}
+
+// Transport dials and listens on the addresses of its scheme
+type Transport interface {
+	Dial(address *url.URL) (Conn, error)
+	Listen(address *url.URL) (Listener, error)
+}
+
+// Frame carries the framed messages over the byte stream, e.g. the one of a
+// custom transport
+func Frame(conn net.Conn) Conn {
+	return framedConn{conn}
+}
+
+// FrameListener frames every connection the listener accepts
+func FrameListener(listener net.Listener) Listener {
+	return framedListener{listener}
+}
+
+// Raw returns the byte stream under the framed connection, e.g. to inspect
+// its TLS state
+func Raw(conn net.Conn) net.Conn {
+	if framed, ok := conn.(framedConn); ok {
+		return framed.Conn
+	}
+	return conn
+}
+
+type framedConn struct {
+	net.Conn
+}
+
+func (c framedConn) Send(message string) error {
+	return communication.SendMessage(c.Conn, message)
+}
+
+func (c framedConn) Receive(buffer []byte) (string, error) {
+	return communication.ReadMessage(c.Conn, buffer)
+}
+
+type framedListener struct {
+	net.Listener
+}
+
+func (l framedListener) Accept() (net.Conn, error) {
+	return l.AcceptConn()
+}
+
+func (l framedListener) AcceptConn() (Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Frame(conn), nil
+}
+
+// Frames the result of the byte stream transport
+func framed(conn net.Conn, err error) (Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	return Frame(conn), nil
+}
+
+func framedListen(listener net.Listener, err error) (Listener, error) {
+	if err != nil {
+		return nil, err
+	}
+	return FrameListener(listener), nil
+}
+
+var (
+	transports = map[string]Transport{
+		"tcp":  TCP{},
+		"unix": Unix{},
+		"tls":  TLS{},
+		"mem":  NewMemory(),
+		"ws":   WebSocket{},
+		"wss":  WebSocket{},
+	}
+	transportsMut sync.RWMutex
+)
+
+// Register makes the transport available for the scheme, replacing the previous one
+func Register(scheme string, transport Transport) {
+	transportsMut.Lock()
+	transports[scheme] = transport
+	transportsMut.Unlock()
+}
+
+// Parse splits the address into its transport and its URL
+func Parse(address string) (Transport, *url.URL, error) {
+	if !strings.Contains(address, "://") {
+		address = DEFAULT_SCHEME + "://" + address
+	}
+	target, err := url.Parse(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	transportsMut.RLock()
+	transport, ok := transports[target.Scheme]
+	transportsMut.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnknownScheme, target.Scheme)
+	}
+	return transport, target, nil
+}
+
+// Dial connects to the address with the transport of its scheme
+func Dial(address string) (Conn, error) {
+	transport, target, err := Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Dial(target)
+}
+
+// Listen listens on the address with the transport of its scheme
+func Listen(address string) (Listener, error) {
+	transport, target, err := Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Listen(target)
+}
@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Every transport yields the framed message streams on both sides
+func TestTransportsCarryMessages(t *testing.T) {
+	addresses := map[string]string{
+		"mem":  "mem://" + t.Name(),
+		"tcp":  "tcp://127.0.0.1:0",
+		"unix": "unix://" + filepath.Join(t.TempDir(), "dh.sock"),
+		"ws":   "ws://127.0.0.1:0/ws",
+	}
+	for scheme, address := range addresses {
+		t.Run(scheme, func(t *testing.T) {
+			listener, err := Listen(address)
+			if err != nil {
+				t.Skip("transport isn't available:", err)
+			}
+			defer listener.Close()
+			// The listening address tells the dialer the chosen port
+			switch scheme {
+			case "tcp":
+				address = "tcp://" + listener.Addr().String()
+			case "ws":
+				address = "ws://" + listener.Addr().String() + "/ws"
+			}
+			accepted := make(chan Conn, 1)
+			go func() {
+				conn, err := listener.AcceptConn()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- conn
+			}()
+			client, err := Dial(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			server, ok := <-accepted
+			if !ok {
+				t.Fatal("connection isn't accepted")
+			}
+			defer server.Close()
+
+			go client.Send("hello")
+			if message, err := server.Receive(make([]byte, 64)); err != nil || message != "hello" {
+				t.Fatalf("got %q, %v", message, err)
+			}
+			go server.Send("hi")
+			if message, err := client.Receive(make([]byte, 64)); err != nil || message != "hi" {
+				t.Fatalf("got %q, %v", message, err)
+			}
+		})
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	if _, err := Dial("carrier-pigeon://home"); !errors.Is(err, ErrUnknownScheme) {
+		t.Fatalf("dial ended with %v", err)
+	}
+}
+
+func TestRawConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if Raw(Frame(client)) != client {
+		t.Fatal("framed connection hides its byte stream")
+	}
+	if Raw(client) != client {
+		t.Fatal("byte stream isn't returned as it is")
+	}
+}
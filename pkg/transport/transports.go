@@ -0,0 +1,212 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dikuropiatnyk/dh-chat/pkg/websocket"
+)
+
+var (
+	ErrNoCertificate   = errors.New("TLS requires a certificate")
+	ErrAddressInUse    = errors.New("in-memory address is already in use")
+	ErrNoListener      = errors.New("nobody listens on the in-memory address")
+	ErrUnsupportedMode = errors.New("transport doesn't support this mode")
+)
+
+// TCP connects to the host and port of the address, e.g. tcp://localhost:8080
+type TCP struct{}
+
+func (TCP) Dial(address *url.URL) (Conn, error) {
+	return framed(net.Dial("tcp", address.Host))
+}
+
+func (TCP) Listen(address *url.URL) (Listener, error) {
+	return framedListen(net.Listen("tcp", address.Host))
+}
+
+// Unix connects to the socket file of the path, e.g. unix:///run/dh.sock
+type Unix struct{}
+
+func (Unix) Dial(address *url.URL) (Conn, error) {
+	return framed(net.Dial("unix", address.Path))
+}
+
+func (Unix) Listen(address *url.URL) (Listener, error) {
+	return framedListen(net.Listen("unix", address.Path))
+}
+
+// TLS is TCP secured with TLS, e.g. tls://chat.example.com:8443. The nil
+// config verifies the server with the system roots, and can't listen.
+type TLS struct {
+	Config *tls.Config
+	// Limits the dial along with the TLS handshake, no limit if zero
+	Timeout time.Duration
+}
+
+// NewServerTLS loads the certificate and its key, which the listener presents
+func NewServerTLS(certFile string, keyFile string) (TLS, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return TLS{}, err
+	}
+	return TLS{Config: &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}}, nil
+}
+
+// NewClientTLS trusts the servers signed by the authorities of the PEM file,
+// e.g. the self-signed certificate of the server
+func NewClientTLS(caFile string) (TLS, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return TLS{}, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return TLS{}, ErrNoCertificate
+	}
+	return TLS{Config: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}, nil
+}
+
+// NewMutualTLS presents the certificate and verifies the certificate of the
+// other side, both as the dialer and as the listener, with the authorities
+// of the PEM file. It's meant for the links between the servers.
+func NewMutualTLS(certFile string, keyFile string, caFile string) (TLS, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return TLS{}, err
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return TLS{}, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return TLS{}, ErrNoCertificate
+	}
+	return TLS{Config: &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}}, nil
+}
+
+func (t TLS) Dial(address *url.URL) (Conn, error) {
+	config := &tls.Config{}
+	if t.Config != nil {
+		config = t.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = address.Hostname()
+	}
+	return framed(tls.DialWithDialer(&net.Dialer{Timeout: t.Timeout}, "tcp", address.Host, config))
+}
+
+func (t TLS) Listen(address *url.URL) (Listener, error) {
+	if t.Config == nil || (len(t.Config.Certificates) == 0 && t.Config.GetCertificate == nil) {
+		return nil, ErrNoCertificate
+	}
+	return framedListen(tls.Listen("tcp", address.Host, t.Config))
+}
+
+// WebSocket connects to the WebSocket endpoint, e.g. ws://localhost:8081/ws.
+// Its listener serves the plain ws:// only, TLS is left to the reverse proxy.
+type WebSocket struct{}
+
+func (WebSocket) Dial(address *url.URL) (Conn, error) {
+	return framed(websocket.Dial(address.String()))
+}
+
+func (WebSocket) Listen(address *url.URL) (Listener, error) {
+	if address.Scheme != "ws" {
+		return nil, fmt.Errorf("%w: listening on %s", ErrUnsupportedMode, address.Scheme)
+	}
+	return framedListen(websocket.Listen(address.Host, address.Path))
+}
+
+// Memory connects the dialer and the listener of the same process with a
+// pipe, e.g. mem://chat. It's meant for embedding and for tests.
+type Memory struct {
+	listeners map[string]*memoryListener
+	mut       sync.Mutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]*memoryListener)}
+}
+
+func (m *Memory) Dial(address *url.URL) (Conn, error) {
+	m.mut.Lock()
+	listener, ok := m.listeners[address.Host]
+	m.mut.Unlock()
+	if !ok {
+		return nil, ErrNoListener
+	}
+	client, server := net.Pipe()
+	select {
+	case listener.accepted <- server:
+		return Frame(client), nil
+	case <-listener.done:
+		return nil, ErrNoListener
+	}
+}
+
+func (m *Memory) Listen(address *url.URL) (Listener, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.listeners[address.Host]; ok {
+		return nil, ErrAddressInUse
+	}
+	listener := &memoryListener{
+		address:  memoryAddr(address.Host),
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	listener.close = func() {
+		m.mut.Lock()
+		delete(m.listeners, address.Host)
+		m.mut.Unlock()
+		close(listener.done)
+	}
+	m.listeners[address.Host] = listener
+	return FrameListener(listener), nil
+}
+
+type memoryAddr string
+
+func (memoryAddr) Network() string  { return "mem" }
+func (a memoryAddr) String() string { return string(a) }
+
+type memoryListener struct {
+	address  memoryAddr
+	accepted chan net.Conn
+	done     chan struct{}
+	close    func()
+	once     sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(l.close)
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.address
+}
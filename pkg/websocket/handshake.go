@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time given to the handshake of the client, including the proxy and TLS
+const DIAL_TIMEOUT = 10 * time.Second
+
+// Upgrade takes over the HTTP connection of the WebSocket handshake. The
+// refused request is answered with an error, so the caller only returns.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade is expected", http.StatusBadRequest)
+		return nil, ErrHandshakeFailed
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrHandshakeFailed
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket isn't supported", http.StatusInternalServerError)
+		return nil, ErrHandshakeFailed
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The client may send its frames right after the request, so they are read from the buffer
+	return newConn(conn, buffered.Reader, false), nil
+}
+
+// Reports whether the comma-separated header contains the token
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Dial connects to the ws:// or wss:// URL. The HTTP(S) proxy of the
+// environment is tunnelled through with CONNECT, as the browsers do.
+func Dial(rawURL string) (*Conn, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	// The proxy is chosen as for the HTTP request of the same security
+	httpURL := *target
+	switch target.Scheme {
+	case "ws":
+		httpURL.Scheme = "http"
+	case "wss":
+		httpURL.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrHandshakeFailed, target.Scheme)
+	}
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), map[string]string{"ws": "80", "wss": "443"}[target.Scheme])
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &httpURL})
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = dialProxy(proxy, address)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, DIAL_TIMEOUT)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	if target.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: target.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	reader, err := handshake(conn, target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return newConn(conn, reader, true), nil
+}
+
+// Tunnels through the HTTP proxy to the address
+func dialProxy(proxy *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddress, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err = conn.Write([]byte(request + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy doesn't send anything after its response, until the tunnel is used
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: proxy responded %s", ErrHandshakeFailed, response.Status)
+	}
+	return conn, nil
+}
+
+// Sends the upgrade request and checks the response of the server
+func handshake(conn net.Conn, target *url.URL) (*bufio.Reader, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := "GET " + target.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + target.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: server responded %s", ErrHandshakeFailed, response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: invalid accept key", ErrHandshakeFailed)
+	}
+	return reader, nil
+}
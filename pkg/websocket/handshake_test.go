@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept key is %s", key)
+	}
+}
+
+func TestUpgradeRefusals(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{name: "plain request", headers: map[string]string{}, status: http.StatusBadRequest},
+		{name: "no key", headers: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, status: http.StatusBadRequest},
+		{name: "old version", headers: map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Key": "a2V5", "Sec-WebSocket-Version": "8"}, status: http.StatusUpgradeRequired},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		if _, err := Upgrade(recorder, request); !errors.Is(err, ErrHandshakeFailed) {
+			t.Errorf("%s: upgrade ended with %v", test.name, err)
+		}
+		if recorder.Code != test.status {
+			t.Errorf("%s: status is %d instead of %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
+
+// The client and the server upgraded by the handshake carry the data both ways
+func TestHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}))
+	defer server.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, 4)
+	if _, err = io.ReadFull(conn, received); err != nil || string(received) != "echo" {
+		t.Fatalf("got %q, %v", received, err)
+	}
+}
+
+// The server, which doesn't prove it has read the key, isn't trusted
+func TestInvalidAcceptKey(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err = http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + acceptKey("another key") + "\r\n\r\n"))
+	}()
+	if _, err = Dial("ws://" + listener.Addr().String() + "/ws"); !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("dial ended with %v", err)
+	}
+}
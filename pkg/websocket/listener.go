@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Listener accepts the WebSocket connections on the path of its HTTP server
+type Listener struct {
+	listener net.Listener
+	server   *http.Server
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Listen serves the WebSocket upgrades on the path of the address. The
+// requests to the other paths are refused.
+func Listen(address string, path string) (*Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{listener: listener, accepted: make(chan net.Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		select {
+		case l.accepted <- conn:
+		case <-l.done:
+			conn.Close()
+		}
+	})
+	l.server = &http.Server{Handler: mux}
+	go l.server.Serve(listener)
+	return l, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.server.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,247 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) as a byte
+// stream: the payloads of the data frames make up the stream, so any framed
+// protocol runs over it as it does over TCP.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Opcodes of the frames
+const (
+	OPCODE_CONTINUATION = 0x0
+	OPCODE_TEXT         = 0x1
+	OPCODE_BINARY       = 0x2
+	OPCODE_CLOSE        = 0x8
+	OPCODE_PING         = 0x9
+	OPCODE_PONG         = 0xA
+)
+
+const (
+	// Appended to the key of the client to prove the server speaks WebSocket
+	ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// Control frames are never fragmented and are short
+	MAX_CONTROL_PAYLOAD = 125
+	// Status codes of the close frame
+	CLOSE_NORMAL         = 1000
+	CLOSE_PROTOCOL_ERROR = 1002
+	// Time given to deliver the close frame
+	CLOSE_TIMEOUT = time.Second
+)
+
+var (
+	ErrProtocolViolation = errors.New("peer violated the WebSocket protocol")
+	ErrHandshakeFailed   = errors.New("WebSocket handshake failed")
+)
+
+// Conn is the WebSocket connection as a net.Conn. Every write is sent as a
+// single binary frame, the reads return the payloads of the data frames.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// Frames of the client are masked, frames of the server aren't
+	client bool
+	// The rest of the current data frame
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskIndex int
+	closed    bool
+	writeMut  sync.Mutex
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, reader: reader, client: client}
+}
+
+// Derives the accept key of the handshake from the key of the client
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// Reads the header of the next frame. The control frames are handled right
+// away, the data frame is left to be read by the caller.
+func (c *Conn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	final, opcode := header[0]&0x80 != 0, header[0]&0x0F
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7F)
+	// Only the client masks its frames, and the extensions are never negotiated
+	if masked == c.client || header[0]&0x70 != 0 {
+		return c.fail()
+	}
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+		// The most significant bit of the length must be zero
+		if length > math.MaxInt64 {
+			return c.fail()
+		}
+	}
+	c.masked, c.maskIndex = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case OPCODE_CONTINUATION, OPCODE_TEXT, OPCODE_BINARY:
+		c.remaining = length
+		return nil
+	case OPCODE_CLOSE, OPCODE_PING, OPCODE_PONG:
+		if !final || length > MAX_CONTROL_PAYLOAD {
+			return c.fail()
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case OPCODE_PING:
+			return c.writeFrame(OPCODE_PONG, payload)
+		case OPCODE_CLOSE:
+			// The close is echoed, and the stream is over
+			c.closed = true
+			c.writeClose(CLOSE_NORMAL)
+			return io.EOF
+		}
+		return nil
+	}
+	return c.fail()
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskIndex%4]
+		c.maskIndex++
+	}
+}
+
+// Closes the connection, which violated the protocol
+func (c *Conn) fail() error {
+	c.writeClose(CLOSE_PROTOCOL_ERROR)
+	c.conn.Close()
+	return ErrProtocolViolation
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(OPCODE_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// The header and the payload are written at once, so the concurrent writers
+// can't interleave them
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, value := range payload {
+			frame = append(frame, value^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Sends the close frame, the delivery isn't guaranteed
+func (c *Conn) writeClose(code uint16) {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(CLOSE_TIMEOUT))
+	_ = c.writeFrame(OPCODE_CLOSE, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// Close sends the close frame and closes the connection
+func (c *Conn) Close() error {
+	c.writeClose(CLOSE_NORMAL)
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
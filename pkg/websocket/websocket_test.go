@@ -0,0 +1,231 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connects the client and the server sides over the pipe, the raw side of
+// the server is returned to play the client by hand
+func serverConn(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	return newConn(server, bufio.NewReader(server), false), client
+}
+
+// Builds the frame, masked with the mask, unless it's nil
+func rawFrame(final bool, opcode byte, payload []byte, mask []byte) []byte {
+	first := opcode
+	if final {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, value := range payload {
+		frame = append(frame, value^mask[i%4])
+	}
+	return frame
+}
+
+var testMask = []byte{0x12, 0x34, 0x56, 0x78}
+
+// Reads the unmasked frame of the server
+func readRawFrame(t *testing.T, conn net.Conn) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("frame of the server is masked")
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+func TestClientFramesAreMasked(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	client := newConn(clientSide, bufio.NewReader(clientSide), true)
+	server := newConn(serverSide, bufio.NewReader(serverSide), false)
+	message := []byte("hello, server")
+	go client.Write(message)
+
+	// The payload on the wire isn't the plain one
+	var header [6]byte
+	if _, err := io.ReadFull(server.reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1] != 0x80|byte(len(message)) {
+		t.Fatalf("header is %x", header[:2])
+	}
+	masked := make([]byte, len(message))
+	if _, err := io.ReadFull(server.reader, masked); err != nil {
+		t.Fatal(err)
+	}
+	for i := range masked {
+		masked[i] ^= header[2+i%4]
+	}
+	if !bytes.Equal(masked, message) {
+		t.Fatalf("unmasked payload is %q", masked)
+	}
+}
+
+func TestMaskingIsEnforced(t *testing.T) {
+	tests := []struct {
+		name   string
+		client bool
+		mask   []byte
+	}{
+		{name: "unmasked frame of the client", client: false, mask: nil},
+		{name: "masked frame of the server", client: true, mask: testMask},
+	}
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		conn := newConn(local, bufio.NewReader(local), test.client)
+		go remote.Write(rawFrame(true, OPCODE_BINARY, []byte("hi"), test.mask))
+		// The violation is answered with the close frame
+		go io.Copy(io.Discard, remote)
+		if _, err := conn.Read(make([]byte, 2)); !errors.Is(err, ErrProtocolViolation) {
+			t.Errorf("%s: read ended with %v", test.name, err)
+		}
+		remote.Close()
+	}
+}
+
+// The fragments make up the stream, while the control frames between them
+// are handled right away
+func TestFragmentedFrames(t *testing.T) {
+	conn, client := serverConn(t)
+	go func() {
+		_, _ = client.Write(rawFrame(false, OPCODE_BINARY, []byte("hel"), testMask))
+		_, _ = client.Write(rawFrame(true, OPCODE_PING, []byte("ping"), testMask))
+		_, _ = client.Write(rawFrame(false, OPCODE_CONTINUATION, []byte("lo, "), testMask))
+		_, _ = client.Write(rawFrame(true, OPCODE_CONTINUATION, []byte("world"), testMask))
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, len("hello, world"))
+		_, err := io.ReadFull(conn, data)
+		if err != nil {
+			data = nil
+		}
+		received <- data
+	}()
+	if opcode, payload := readRawFrame(t, client); opcode != OPCODE_PONG || string(payload) != "ping" {
+		t.Fatalf("got the frame %x %q instead of the pong", opcode, payload)
+	}
+	if data := <-received; string(data) != "hello, world" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+// The lengths of 16 and 64 bits are both read, while the control frames are short
+func TestFrameLengths(t *testing.T) {
+	conn, client := serverConn(t)
+	for _, size := range []int{125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		go client.Write(rawFrame(true, OPCODE_BINARY, payload, testMask))
+		received := make([]byte, size)
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatalf("%d bytes are corrupted", size)
+		}
+	}
+
+	go client.Write(rawFrame(true, OPCODE_PING, bytes.Repeat([]byte("x"), MAX_CONTROL_PAYLOAD+1), testMask))
+	go io.Copy(io.Discard, client)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("oversized ping ended with %v", err)
+	}
+}
+
+// The length over 63 bits breaks the connection
+func TestOversizedFrame(t *testing.T) {
+	conn, client := serverConn(t)
+	header := []byte{0x80 | OPCODE_BINARY, 0x80 | 127}
+	header = binary.BigEndian.AppendUint64(header, 1<<63)
+	go client.Write(append(header, testMask...))
+	go io.Copy(io.Discard, client)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("oversized frame ended with %v", err)
+	}
+}
+
+func TestFragmentedControlFrame(t *testing.T) {
+	conn, client := serverConn(t)
+	go client.Write(rawFrame(false, OPCODE_PING, []byte("ping"), testMask))
+	go io.Copy(io.Discard, client)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("fragmented ping ended with %v", err)
+	}
+}
+
+// The close of the peer is echoed, and the stream is over
+func TestCloseIsEchoed(t *testing.T) {
+	conn, client := serverConn(t)
+	go client.Write(rawFrame(true, OPCODE_CLOSE, binary.BigEndian.AppendUint16(nil, CLOSE_NORMAL), testMask))
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	opcode, payload := readRawFrame(t, client)
+	if opcode != OPCODE_CLOSE || binary.BigEndian.Uint16(payload) != CLOSE_NORMAL {
+		t.Fatalf("got the frame %x %x instead of the close", opcode, payload)
+	}
+	if err := <-read; err != io.EOF {
+		t.Fatalf("read ended with %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the close ended with %v", err)
+	}
+}
+
+// The pong of the peer is dropped quietly
+func TestPongIsIgnored(t *testing.T) {
+	conn, client := serverConn(t)
+	go func() {
+		_, _ = client.Write(rawFrame(true, OPCODE_PONG, []byte("late"), testMask))
+		_, _ = client.Write(rawFrame(true, OPCODE_BINARY, []byte("data"), testMask))
+	}()
+	received := make([]byte, 4)
+	if _, err := io.ReadFull(conn, received); err != nil || string(received) != "data" {
+		t.Fatalf("got %q, %v", received, err)
+	}
+}